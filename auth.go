@@ -21,46 +21,136 @@ var (
 	ErrUnauthorized = errors.New("Unauthorized")
 )
 
+// AuthConfig configures HTTPAuthWithConfig and WebSocketAuthWithConfig.
+type AuthConfig struct {
+	Secret []byte `mapstructure:"secret,omitempty"`
+	// DecryptionKey decrypts JWE tokens; nil falls back to the key set with auth.SetDecryptionKey.
+	DecryptionKey []byte `mapstructure:"decryption_key,omitempty"`
+	// RequireEncryption rejects plain JWS tokens once tokens are encrypted.
+	RequireEncryption bool `mapstructure:"require_encryption,omitempty"`
+}
+
+// parseOptions returns the options of auth.ParseTokenWithOptions.
+func (config *AuthConfig) parseOptions() *auth.ParseOptions {
+	return &auth.ParseOptions{DecryptionKey: config.DecryptionKey, RequireEncryption: config.RequireEncryption}
+}
+
 // HTTPAuth is a middleware that wraps an http.HandlerFunc with JWT authentication logic.
+// When a tenant has been resolved, its JWTSecret takes precedence over secret and the
+// token's tenant claim must match it. Tokens still waiting for a second factor are rejected
+// with MFARequiredResponse until they have been upgraded through MFAVerify.
 func HTTPAuth(secret []byte, next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Get the Authorization header
-		authHeader := r.Header.Get("Authorization")
+	return HTTPAuthWithConfig(&AuthConfig{Secret: secret}, next)
+}
 
-		if authHeader == "" {
-			UnauthorizedResponse.Write(w)
+// HTTPAuthWithConfig is HTTPAuth with its own decryption key and encryption requirement.
+func HTTPAuthWithConfig(config *AuthConfig, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, errResp := authenticate(config, r)
+		if errResp != nil {
+			errResp.Write(w)
 			return
 		}
-		// Check if the header has the correct format
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			UnauthorizedResponse.Write(w)
+		if claims.MFAPending {
+			MFARequiredResponse.Write(w)
 			return
 		}
-		token := parts[1]
+		// Call the next handler
+		next(w, r.WithContext(context.WithValue(r.Context(), ClaimsKey, claims)))
+	}
+}
 
-		// Validate JWT token
-		claims, err := auth.ParseToken(secret, token)
-		if err != nil {
+// RequireRole is a middleware that rejects requests whose claims lack role with ForbiddenResponse.
+// It must run after HTTPAuth, which puts the claims in the request context.
+func RequireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(ClaimsKey).(*auth.JWTClaims)
+		if !ok {
 			UnauthorizedResponse.Write(w)
 			return
 		}
-		// Call the next handler
-		next(w, r.WithContext(context.WithValue(r.Context(), ClaimsKey, claims)))
+		if !claims.HasRole(role) {
+			ForbiddenResponse.Write(w)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// authenticate validates the bearer token of a request and returns its claims,
+// or the response to reject the request with.
+func authenticate(config *AuthConfig, r *http.Request) (*auth.JWTClaims, *Response) {
+	// Get the Authorization header
+	authHeader := r.Header.Get("Authorization")
+
+	if authHeader == "" {
+		return nil, &UnauthorizedResponse
+	}
+	// Check if the header has the correct format
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return nil, &UnauthorizedResponse
+	}
+	return verifyToken(config, r, parts[1])
+}
+
+// verifyToken validates a token of a request against the resolved tenant's secret, if there is
+// one, and returns its claims or the response to reject the request with.
+func verifyToken(config *AuthConfig, r *http.Request, token string) (*auth.JWTClaims, *Response) {
+	tenant, hasTenant := TenantFromContext(r.Context())
+	key := config.Secret
+	if hasTenant && len(tenant.JWTSecret) > 0 {
+		key = tenant.JWTSecret
+	}
+	claims, err := auth.ParseTokenWithOptions(key, token, config.parseOptions())
+	if err != nil {
+		return nil, &UnauthorizedResponse
+	}
+	if hasTenant && !tenantMatches(tenant, claims) {
+		return nil, &ForbiddenResponse
+	}
+	return claims, nil
+}
+
+// WebSocketAuthMiddleware returns WebSocketAuth as a WebsocketMiddleware for ChainWebSocket.
+func WebSocketAuthMiddleware(secret []byte) WebsocketMiddleware {
+	return func(next WebsocketHandlerFunc) WebsocketHandlerFunc {
+		return WebSocketAuth(secret, next)
 	}
 }
 
 // WebSocketAuth is a middleware that wraps a WebsocketHandlerFunc with JWT authentication logic.
+// Like HTTPAuth, it verifies tokens with the resolved tenant's JWTSecret and rejects tokens of
+// other tenants.
 func WebSocketAuth(secret []byte, next WebsocketHandlerFunc) WebsocketHandlerFunc {
-	return func(conn *websocket.Conn, r *http.Request) {
+	return WebSocketAuthWithConfig(&AuthConfig{Secret: secret}, next)
+}
+
+// WebSocketAuthWithConfig is WebSocketAuth with its own decryption key and encryption requirement.
+func WebSocketAuthWithConfig(config *AuthConfig, next WebsocketHandlerFunc) WebsocketHandlerFunc {
+	return func(conn *WebSocketConn, r *http.Request) {
 		token := r.URL.Query().Get("token")
-		claims, err := auth.ParseToken(secret, token)
-		if err != nil {
-			conn.WriteMessage(websocket.CloseMessage, []byte("Invalid token"))
+		claims, errResp := verifyToken(config, r, token)
+		if errResp != nil {
+			reason := "Invalid token"
+			if errResp.Error.Code == http.StatusForbidden {
+				reason = "Token of another tenant"
+			}
+			conn.Close(websocket.ClosePolicyViolation, reason)
 			return
 		}
+		if claims.MFAPending {
+			conn.Close(websocket.ClosePolicyViolation, "MFA required")
+			return
+		}
+		if !conn.slot.claim(claims.UserID) {
+			conn.Close(websocket.ClosePolicyViolation, "Too many connections")
+			return
+		}
+		// Make the claims available on the connection context as well
+		ctx := context.WithValue(r.Context(), ClaimsKey, claims)
+		conn.setContext(ctx)
 		// Call the next handler
-		next(conn, r.WithContext(context.WithValue(r.Context(), ClaimsKey, claims)))
-		// Call the next handler
+		next(conn, r.WithContext(ctx))
 	}
 }
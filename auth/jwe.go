@@ -0,0 +1,295 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Key management algorithms supported for JWE compact serialization (RFC 7518).
+const (
+	// KeyAlgorithmDirect uses the key itself as the content encryption key.
+	// The key length selects the content encryption: 16 bytes A128GCM, 24 bytes A192GCM, 32 bytes A256GCM.
+	KeyAlgorithmDirect = "dir"
+	// KeyAlgorithmA128KW, KeyAlgorithmA192KW and KeyAlgorithmA256KW wrap a random A256GCM
+	// content encryption key with AES Key Wrap using a 16, 24 or 32 byte key.
+	KeyAlgorithmA128KW = "A128KW"
+	KeyAlgorithmA192KW = "A192KW"
+	KeyAlgorithmA256KW = "A256KW"
+)
+
+var (
+	ErrEncryptedToken       = errors.New("token is encrypted but no decryption key is configured")
+	ErrPlainToken           = errors.New("token is not encrypted")
+	ErrTokenDecryption      = errors.New("token decryption failed")
+	ErrUnsupportedAlgorithm = errors.New("unsupported JWE algorithm")
+	ErrInvalidKeySize       = errors.New("invalid key size for JWE algorithm")
+)
+
+// decryptionKey is the key ParseToken uses for encrypted tokens; it may be set while tokens are parsed.
+var decryptionKey atomic.Pointer[[]byte]
+
+// SetDecryptionKey configures the key ParseToken, and therefore HTTPAuth and WebSocketAuth,
+// uses to transparently decrypt JWE tokens. Plain JWS tokens are still accepted.
+// A nil key disables decryption. ParseOptions configure the key per call instead.
+func SetDecryptionKey(key []byte) {
+	if key == nil {
+		decryptionKey.Store(nil)
+		return
+	}
+	decryptionKey.Store(&key)
+}
+
+// ParseOptions configure how ParseTokenWithOptions handles encrypted tokens.
+type ParseOptions struct {
+	// DecryptionKey decrypts JWE tokens; nil falls back to the key set with SetDecryptionKey.
+	DecryptionKey []byte
+	// RequireEncryption rejects plain JWS tokens with ErrPlainToken.
+	RequireEncryption bool
+}
+
+// decryptionKey returns the key of the options, or the one set with SetDecryptionKey.
+func (opts *ParseOptions) decryptionKey() []byte {
+	if opts != nil && opts.DecryptionKey != nil {
+		return opts.DecryptionKey
+	}
+	if key := decryptionKey.Load(); key != nil {
+		return *key
+	}
+	return nil
+}
+
+type jweHeader struct {
+	Algorithm   string `json:"alg"`
+	Encryption  string `json:"enc"`
+	ContentType string `json:"cty,omitempty"`
+}
+
+// IsEncryptedToken reports whether a token uses the five part JWE compact serialization.
+func IsEncryptedToken(token string) bool {
+	return strings.Count(token, ".") == 4
+}
+
+// GenerateEncryptedJWT creates a signed JWT like GenerateJWT and nests it in a JWE encrypted with encryptionKey.
+func GenerateEncryptedJWT(secretKey, encryptionKey []byte, alg string, userID uuid.UUID, expiresAt *time.Time) (*JWTClaims, string, error) {
+	claims, signed, err := GenerateJWT(secretKey, userID, expiresAt)
+	if err != nil {
+		return nil, "", err
+	}
+	encrypted, err := EncryptToken(encryptionKey, alg, signed)
+	if err != nil {
+		return nil, "", err
+	}
+	return claims, encrypted, nil
+}
+
+// EncryptToken nests a signed token in a JWE compact serialization using the given key management algorithm.
+func EncryptToken(key []byte, alg string, token string) (string, error) {
+	header := jweHeader{Algorithm: alg, ContentType: "JWT"}
+	var cek, encryptedKey []byte
+	switch alg {
+	case KeyAlgorithmDirect:
+		enc, err := gcmEncryption(len(key))
+		if err != nil {
+			return "", err
+		}
+		header.Encryption = enc
+		cek = key
+	case KeyAlgorithmA128KW, KeyAlgorithmA192KW, KeyAlgorithmA256KW:
+		if err := checkKeyWrapSize(alg, key); err != nil {
+			return "", err
+		}
+		header.Encryption = "A256GCM"
+		cek = make([]byte, 32)
+		if _, err := rand.Read(cek); err != nil {
+			return "", err
+		}
+		var err error
+		if encryptedKey, err = aesKeyWrap(key, cek); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, alg)
+	}
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	protected := base64.RawURLEncoding.EncodeToString(headerJSON)
+
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nil, iv, []byte(token), []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+
+	return strings.Join([]string{
+		protected,
+		base64.RawURLEncoding.EncodeToString(encryptedKey),
+		base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, "."), nil
+}
+
+// DecryptToken decrypts a JWE compact serialization and returns the nested token.
+func DecryptToken(key []byte, token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 {
+		return "", fmt.Errorf("%w: expected 5 parts, got %d", ErrTokenDecryption, len(parts))
+	}
+	decoded := make([][]byte, len(parts))
+	for i, part := range parts {
+		var err error
+		if decoded[i], err = base64.RawURLEncoding.DecodeString(part); err != nil {
+			return "", fmt.Errorf("%w: %v", ErrTokenDecryption, err)
+		}
+	}
+	var header jweHeader
+	if err := json.Unmarshal(decoded[0], &header); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrTokenDecryption, err)
+	}
+
+	var cek []byte
+	switch header.Algorithm {
+	case KeyAlgorithmDirect:
+		enc, err := gcmEncryption(len(key))
+		if err != nil {
+			return "", err
+		}
+		if enc != header.Encryption {
+			return "", fmt.Errorf("%w: key does not match %s", ErrInvalidKeySize, header.Encryption)
+		}
+		if len(decoded[1]) != 0 {
+			return "", fmt.Errorf("%w: unexpected encrypted key", ErrTokenDecryption)
+		}
+		cek = key
+	case KeyAlgorithmA128KW, KeyAlgorithmA192KW, KeyAlgorithmA256KW:
+		if err := checkKeyWrapSize(header.Algorithm, key); err != nil {
+			return "", err
+		}
+		var err error
+		if cek, err = aesKeyUnwrap(key, decoded[1]); err != nil {
+			return "", err
+		}
+		if enc, err := gcmEncryption(len(cek)); err != nil || enc != header.Encryption {
+			return "", fmt.Errorf("%w: content key does not match %s", ErrTokenDecryption, header.Encryption)
+		}
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, header.Algorithm)
+	}
+
+	gcm, err := newGCM(cek)
+	if err != nil {
+		return "", err
+	}
+	if len(decoded[2]) != gcm.NonceSize() {
+		return "", fmt.Errorf("%w: invalid IV", ErrTokenDecryption)
+	}
+	sealed := append(decoded[3], decoded[4]...)
+	plaintext, err := gcm.Open(nil, decoded[2], sealed, []byte(parts[0]))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrTokenDecryption, err)
+	}
+	return string(plaintext), nil
+}
+
+// gcmEncryption names the AES-GCM content encryption for a key length.
+func gcmEncryption(keySize int) (string, error) {
+	switch keySize {
+	case 16, 24, 32:
+		return fmt.Sprintf("A%dGCM", keySize*8), nil
+	}
+	return "", fmt.Errorf("%w: %d bytes", ErrInvalidKeySize, keySize)
+}
+
+func checkKeyWrapSize(alg string, key []byte) error {
+	if fmt.Sprintf("A%dKW", len(key)*8) != alg {
+		return fmt.Errorf("%w: %s needs a %s bit key, got %d bytes", ErrInvalidKeySize, alg, alg[1:4], len(key))
+	}
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyWrapIV is the default initial value of RFC 3394.
+var keyWrapIV = []byte{0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6}
+
+// aesKeyWrap wraps a key as specified by RFC 3394.
+func aesKeyWrap(kek, key []byte) ([]byte, error) {
+	if len(key)%8 != 0 || len(key) < 16 {
+		return nil, fmt.Errorf("%w: cannot wrap %d bytes", ErrInvalidKeySize, len(key))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(key) / 8
+	r := make([]byte, 8+len(key))
+	copy(r, keyWrapIV)
+	copy(r[8:], key)
+	b := make([]byte, 16)
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(b, r[:8])
+			copy(b[8:], r[i*8:i*8+8])
+			block.Encrypt(b, b)
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(r[:8], binary.BigEndian.Uint64(b[:8])^t)
+			copy(r[i*8:], b[8:])
+		}
+	}
+	return r, nil
+}
+
+// aesKeyUnwrap unwraps a key wrapped by aesKeyWrap and checks its integrity.
+func aesKeyUnwrap(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped)%8 != 0 || len(wrapped) < 24 {
+		return nil, fmt.Errorf("%w: invalid wrapped key", ErrTokenDecryption)
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(wrapped)/8 - 1
+	r := make([]byte, len(wrapped))
+	copy(r, wrapped)
+	b := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(b[:8], binary.BigEndian.Uint64(r[:8])^t)
+			copy(b[8:], r[i*8:i*8+8])
+			block.Decrypt(b, b)
+			copy(r[:8], b[:8])
+			copy(r[i*8:], b[8:])
+		}
+	}
+	if subtle.ConstantTimeCompare(r[:8], keyWrapIV) != 1 {
+		return nil, fmt.Errorf("%w: key unwrap integrity check failed", ErrTokenDecryption)
+	}
+	return r[8:], nil
+}
@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TestAESKeyWrap tests the AES Key Wrap implementation against the RFC 3394 test vectors.
+func TestAESKeyWrap(t *testing.T) {
+	// Test cases
+	tests := []struct {
+		name     string
+		kek      string
+		key      string
+		expected string
+	}{
+		{
+			name:     "128 bit KEK, 128 bit key",
+			kek:      "000102030405060708090A0B0C0D0E0F",
+			key:      "00112233445566778899AABBCCDDEEFF",
+			expected: "1FA68B0A8112B447AEF34BD8FB5A7B829D3E862371D2CFE5",
+		},
+		{
+			name:     "256 bit KEK, 256 bit key",
+			kek:      "000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F",
+			key:      "00112233445566778899AABBCCDDEEFF000102030405060708090A0B0C0D0E0F",
+			expected: "28C9F404C4B810F4CBCCB35CFB87F8263F5786E2D80ED326CBC7F0E71A99F43BFB988B9B7A02DD21",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			kek, _ := hex.DecodeString(tc.kek)
+			key, _ := hex.DecodeString(tc.key)
+			expected, _ := hex.DecodeString(tc.expected)
+
+			wrapped, err := aesKeyWrap(kek, key)
+			if err != nil {
+				t.Fatalf("Failed to wrap key: %v", err)
+			}
+			if !bytes.Equal(wrapped, expected) {
+				t.Errorf("Expected %X, got %X", expected, wrapped)
+			}
+
+			unwrapped, err := aesKeyUnwrap(kek, wrapped)
+			if err != nil {
+				t.Fatalf("Failed to unwrap key: %v", err)
+			}
+			if !bytes.Equal(unwrapped, key) {
+				t.Errorf("Expected %X, got %X", key, unwrapped)
+			}
+
+			// Tampering is detected by the integrity check
+			wrapped[len(wrapped)-1] ^= 1
+			if _, err := aesKeyUnwrap(kek, wrapped); !errors.Is(err, ErrTokenDecryption) {
+				t.Errorf("Expected ErrTokenDecryption, got %v", err)
+			}
+		})
+	}
+}
+
+// TestEncryptToken tests encrypting and decrypting nested tokens with the supported algorithms.
+func TestEncryptToken(t *testing.T) {
+	key16 := bytes.Repeat([]byte{1}, 16)
+	key24 := bytes.Repeat([]byte{2}, 24)
+	key32 := bytes.Repeat([]byte{3}, 32)
+
+	// Test cases
+	tests := []struct {
+		name        string
+		alg         string
+		key         []byte
+		decryptKey  []byte
+		expectError error
+	}{
+		{name: "Direct A128GCM", alg: KeyAlgorithmDirect, key: key16, decryptKey: key16},
+		{name: "Direct A256GCM", alg: KeyAlgorithmDirect, key: key32, decryptKey: key32},
+		{name: "A128KW", alg: KeyAlgorithmA128KW, key: key16, decryptKey: key16},
+		{name: "A192KW", alg: KeyAlgorithmA192KW, key: key24, decryptKey: key24},
+		{name: "A256KW", alg: KeyAlgorithmA256KW, key: key32, decryptKey: key32},
+		{name: "Wrong direct key", alg: KeyAlgorithmDirect, key: key32, decryptKey: bytes.Repeat([]byte{4}, 32), expectError: ErrTokenDecryption},
+		{name: "Wrong wrapping key", alg: KeyAlgorithmA256KW, key: key32, decryptKey: bytes.Repeat([]byte{4}, 32), expectError: ErrTokenDecryption},
+		{name: "Direct key of other size", alg: KeyAlgorithmDirect, key: key32, decryptKey: key16, expectError: ErrInvalidKeySize},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			encrypted, err := EncryptToken(tc.key, tc.alg, "header.payload.signature")
+			if err != nil {
+				t.Fatalf("Failed to encrypt token: %v", err)
+			}
+			if !IsEncryptedToken(encrypted) {
+				t.Errorf("Expected %q to be an encrypted token", encrypted)
+			}
+			if strings.Contains(encrypted, "payload") {
+				t.Error("Expected the nested token not to be readable")
+			}
+
+			decrypted, err := DecryptToken(tc.decryptKey, encrypted)
+			if tc.expectError != nil {
+				if !errors.Is(err, tc.expectError) {
+					t.Errorf("Expected error %v, got %v", tc.expectError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to decrypt token: %v", err)
+			}
+			if decrypted != "header.payload.signature" {
+				t.Errorf("Expected nested token, got %q", decrypted)
+			}
+		})
+	}
+
+	// Invalid parameters are rejected
+	if _, err := EncryptToken(key16, "RSA-OAEP", "token"); !errors.Is(err, ErrUnsupportedAlgorithm) {
+		t.Errorf("Expected ErrUnsupportedAlgorithm, got %v", err)
+	}
+	if _, err := EncryptToken(key16, KeyAlgorithmA256KW, "token"); !errors.Is(err, ErrInvalidKeySize) {
+		t.Errorf("Expected ErrInvalidKeySize, got %v", err)
+	}
+	if _, err := DecryptToken(key16, "a.b.c"); !errors.Is(err, ErrTokenDecryption) {
+		t.Errorf("Expected ErrTokenDecryption, got %v", err)
+	}
+}
+
+// TestParseEncryptedToken tests that ParseToken transparently decrypts tokens once a decryption key is configured.
+func TestParseEncryptedToken(t *testing.T) {
+	secret := []byte("test-secret-key")
+	encryptionKey := bytes.Repeat([]byte{7}, 32)
+	userID := uuid.New()
+	expiresAt := time.Now().Add(time.Hour)
+
+	_, token, err := GenerateEncryptedJWT(secret, encryptionKey, KeyAlgorithmA256KW, userID, &expiresAt)
+	if err != nil {
+		t.Fatalf("Failed to generate encrypted token: %v", err)
+	}
+
+	// Without a decryption key the token is rejected
+	SetDecryptionKey(nil)
+	if _, err := ParseToken(secret, token); !errors.Is(err, ErrEncryptedToken) {
+		t.Errorf("Expected ErrEncryptedToken, got %v", err)
+	}
+
+	SetDecryptionKey(encryptionKey)
+	defer SetDecryptionKey(nil)
+
+	claims, err := ParseToken(secret, token)
+	if err != nil {
+		t.Fatalf("Failed to parse encrypted token: %v", err)
+	}
+	if claims.UserID != userID {
+		t.Errorf("Expected UserID %v, got %v", userID, claims.UserID)
+	}
+
+	// Plain tokens are still accepted
+	_, plain, _ := GenerateJWT(secret, userID, &expiresAt)
+	if _, err := ParseToken(secret, plain); err != nil {
+		t.Errorf("Expected plain token to be accepted, got %v", err)
+	}
+
+	// The nested token is still verified
+	if _, err := ParseToken([]byte("wrong-secret"), token); err == nil {
+		t.Error("Expected error for wrong signing secret, got nil")
+	}
+}
+
+// TestParseTokenWithOptions tests per call decryption keys and rejecting plain tokens.
+func TestParseTokenWithOptions(t *testing.T) {
+	secret := []byte("test-secret-key")
+	encryptionKey := bytes.Repeat([]byte{7}, 32)
+	userID := uuid.New()
+	expiresAt := time.Now().Add(time.Hour)
+	_, encrypted, err := GenerateEncryptedJWT(secret, encryptionKey, KeyAlgorithmDirect, userID, &expiresAt)
+	if err != nil {
+		t.Fatalf("Failed to generate encrypted token: %v", err)
+	}
+	_, plain, _ := GenerateJWT(secret, userID, &expiresAt)
+
+	tests := []struct {
+		name        string
+		token       string
+		opts        *ParseOptions
+		expectError error
+	}{
+		{name: "Encrypted token with key", token: encrypted, opts: &ParseOptions{DecryptionKey: encryptionKey}},
+		{name: "Encrypted token without key", token: encrypted, opts: &ParseOptions{}, expectError: ErrEncryptedToken},
+		{name: "Plain token", token: plain, opts: &ParseOptions{DecryptionKey: encryptionKey}},
+		{name: "Plain token with encryption required", token: plain, opts: &ParseOptions{DecryptionKey: encryptionKey, RequireEncryption: true}, expectError: ErrPlainToken},
+		{name: "Encrypted token with encryption required", token: encrypted, opts: &ParseOptions{DecryptionKey: encryptionKey, RequireEncryption: true}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			claims, err := ParseTokenWithOptions(secret, tc.token, tc.opts)
+			if tc.expectError != nil {
+				if !errors.Is(err, tc.expectError) {
+					t.Errorf("Expected %v, got %v", tc.expectError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to parse token: %v", err)
+			}
+			if claims.UserID != userID {
+				t.Errorf("Expected UserID %v, got %v", userID, claims.UserID)
+			}
+		})
+	}
+}
@@ -14,20 +14,44 @@ type JWTClaims struct {
 	UserID    uuid.UUID `json:"user_id"`
 	IssuedAt  time.Time `json:"issued_at"`
 	ExpiresAt time.Time `json:"expires_at"`
+	TenantID  string    `json:"tenant_id,omitempty"`
+	// MFAPending marks a first-factor token that must be upgraded with a second factor before use.
+	MFAPending bool `json:"mfa_pending,omitempty"`
+	// Roles are checked by authorization middlewares such as possum.RequireRole.
+	Roles []string `json:"roles,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// HasRole reports whether the claims grant role.
+func (claims *JWTClaims) HasRole(role string) bool {
+	for _, r := range claims.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
 // GenerateJWT creates a signed JWT token with user ID and expiration time claims.
 // Returns the claims, token string, and any error that occurred during generation.
 func GenerateJWT(secretKey []byte, userID uuid.UUID, expiresAt *time.Time) (*JWTClaims, string, error) {
+	claims := NewClaims(userID, expiresAt)
+	tokenString, err := SignToken(secretKey, claims)
+	if err != nil {
+		return nil, "", err
+	}
+	return claims, tokenString, nil
+}
+
+// NewClaims creates the claims GenerateJWT signs, expiring in 24 hours if expiresAt is nil.
+func NewClaims(userID uuid.UUID, expiresAt *time.Time) *JWTClaims {
 	// Set default expiration time if not provided
 	expTime := time.Now().Add(24 * time.Hour) // Default: 24 hours
 	if expiresAt != nil {
 		expTime = *expiresAt
 	}
 
-	// Create claims
-	claims := &JWTClaims{
+	return &JWTClaims{
 		UserID:    userID,
 		IssuedAt:  time.Now(),
 		ExpiresAt: expTime,
@@ -36,20 +60,54 @@ func GenerateJWT(secretKey []byte, userID uuid.UUID, expiresAt *time.Time) (*JWT
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
+}
 
-	// Create token
+// SignToken signs arbitrary claims with HS256, the signing method ParseToken accepts.
+func SignToken(secretKey []byte, claims jwt.Claims) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	// Sign token with secret key
 	tokenString, err := token.SignedString(secretKey)
 	if err != nil {
-		return nil, "", fmt.Errorf("failed to sign token: %w", err)
+		return "", fmt.Errorf("failed to sign token: %w", err)
 	}
+	return tokenString, nil
+}
 
-	return claims, tokenString, nil
+// DecodeToken returns the header and claims of a token without verifying its signature or validity.
+// It must only be used for inspection, never for authentication.
+func DecodeToken(tokenString string) (map[string]any, jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, claims)
+	if err != nil {
+		return nil, nil, err
+	}
+	return token.Header, claims, nil
 }
 
+// ParseToken verifies a token signed with secret and returns its claims.
+// Encrypted tokens are decrypted first with the key configured by SetDecryptionKey.
 func ParseToken(secret []byte, tokenString string) (*JWTClaims, error) {
+	return ParseTokenWithOptions(secret, tokenString, nil)
+}
+
+// ParseTokenWithOptions is ParseToken with its own decryption key and the option to accept
+// encrypted tokens only; nil options behave like ParseToken.
+func ParseTokenWithOptions(secret []byte, tokenString string, opts *ParseOptions) (*JWTClaims, error) {
+	if IsEncryptedToken(tokenString) {
+		key := opts.decryptionKey()
+		if key == nil {
+			log.Printf("Token parsing error: %v\n", ErrEncryptedToken)
+			return nil, ErrEncryptedToken
+		}
+		decrypted, err := DecryptToken(key, tokenString)
+		if err != nil {
+			log.Printf("Token parsing error: %v\n", err)
+			return nil, err
+		}
+		tokenString = decrypted
+	} else if opts != nil && opts.RequireEncryption {
+		log.Printf("Token parsing error: %v\n", ErrPlainToken)
+		return nil, ErrPlainToken
+	}
 	claims := &JWTClaims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
@@ -172,4 +172,71 @@ func TestParseToken(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+// TestSignAndDecodeToken tests signing arbitrary claims and decoding them without verification.
+func TestSignAndDecodeToken(t *testing.T) {
+	secret := []byte("test-secret-key")
+	claims := NewClaims(uuid.New(), nil)
+	claims.TenantID = "acme"
+
+	token, err := SignToken(secret, claims)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+
+	// The signed token is accepted by ParseToken
+	parsed, err := ParseToken(secret, token)
+	if err != nil {
+		t.Fatalf("Failed to parse token: %v", err)
+	}
+	if parsed.TenantID != "acme" {
+		t.Errorf("Expected TenantID acme, got %q", parsed.TenantID)
+	}
+
+	// DecodeToken ignores the signature
+	header, decoded, err := DecodeToken(token)
+	if err != nil {
+		t.Fatalf("Failed to decode token: %v", err)
+	}
+	if header["alg"] != "HS256" {
+		t.Errorf("Expected alg HS256, got %v", header["alg"])
+	}
+	if decoded["user_id"] != claims.UserID.String() {
+		t.Errorf("Expected user_id %v, got %v", claims.UserID, decoded["user_id"])
+	}
+
+	if _, _, err := DecodeToken("invalid-token"); err == nil {
+		t.Error("Expected error for malformed token, got nil")
+	}
+}
+
+// TestHasRole tests that roles survive signing and are matched exactly.
+func TestHasRole(t *testing.T) {
+	secret := []byte("test-secret-key")
+	claims := NewClaims(uuid.New(), nil)
+	claims.Roles = []string{"admin", "support"}
+	token, err := SignToken(secret, claims)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	parsed, err := ParseToken(secret, token)
+	if err != nil {
+		t.Fatalf("Failed to parse token: %v", err)
+	}
+
+	tests := []struct {
+		role     string
+		expected bool
+	}{
+		{role: "admin", expected: true},
+		{role: "support", expected: true},
+		{role: "Admin", expected: false},
+		{role: "", expected: false},
+	}
+	for _, tc := range tests {
+		if got := parsed.HasRole(tc.role); got != tc.expected {
+			t.Errorf("HasRole(%q): expected %t, got %t", tc.role, tc.expected, got)
+		}
+	}
+}
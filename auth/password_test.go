@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestHashPassword tests hashing and verifying passwords with argon2id and bcrypt.
+func TestHashPassword(t *testing.T) {
+	argon, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	if !strings.HasPrefix(argon, "$argon2id$v=19$m=65536,t=3,p=2$") {
+		t.Errorf("Unexpected argon2id encoding %q", argon)
+	}
+	weak, err := HashPasswordArgon2("correct horse", Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 8, KeyLength: 16})
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	bcryptHash, err := HashPasswordBcrypt("correct horse")
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+
+	// Test cases
+	tests := []struct {
+		name         string
+		hash         string
+		password     string
+		expectOK     bool
+		expectRehash bool
+		expectError  error
+	}{
+		{name: "Argon2id match", hash: argon, password: "correct horse", expectOK: true},
+		{name: "Argon2id mismatch", hash: argon, password: "battery staple"},
+		{name: "Argon2id outdated parameters", hash: weak, password: "correct horse", expectOK: true, expectRehash: true},
+		{name: "Bcrypt match", hash: bcryptHash, password: "correct horse", expectOK: true, expectRehash: true},
+		{name: "Bcrypt mismatch", hash: bcryptHash, password: "battery staple"},
+		{name: "Unknown format", hash: "plaintext", password: "plaintext", expectError: ErrUnknownHashFormat},
+		{name: "Corrupt argon2id", hash: "$argon2id$v=19$m=x$salt$hash", password: "x", expectError: ErrUnknownHashFormat},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ok, rehash, err := VerifyPassword(tc.hash, tc.password)
+			if !errors.Is(err, tc.expectError) {
+				t.Errorf("Expected error %v, got %v", tc.expectError, err)
+			}
+			if ok != tc.expectOK {
+				t.Errorf("Expected ok %v, got %v", tc.expectOK, ok)
+			}
+			if rehash != tc.expectRehash {
+				t.Errorf("Expected needsRehash %v, got %v", tc.expectRehash, rehash)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// TOTPNoSkew is the Skew accepting only the current time step.
+	TOTPNoSkew = -1
+)
+
+var (
+	ErrInvalidTOTPSecret = errors.New("invalid TOTP secret")
+	ErrInvalidTOTPConfig = errors.New("invalid TOTP config")
+)
+
+// TOTPConfig holds the RFC 6238 parameters. The defaults are the ones authenticator apps assume.
+type TOTPConfig struct {
+	Digits int           `mapstructure:"digits,omitempty"` // default 6, at most 9
+	Period time.Duration `mapstructure:"period,omitempty"` // default 30s, at least 1s
+	// Skew is the number of accepted steps before and after the current one, default 1;
+	// TOTPNoSkew accepts the current step only.
+	Skew int `mapstructure:"skew,omitempty"`
+}
+
+var defaultTOTPConfig = TOTPConfig{
+	Digits: 6,
+	Period: 30 * time.Second,
+	Skew:   1,
+}
+
+func (config TOTPConfig) withDefaults() TOTPConfig {
+	if config.Digits == 0 {
+		config.Digits = defaultTOTPConfig.Digits
+	}
+	if config.Period == 0 {
+		config.Period = defaultTOTPConfig.Period
+	}
+	if config.Skew == 0 {
+		config.Skew = defaultTOTPConfig.Skew
+	}
+	if config.Skew < 0 {
+		config.Skew = 0
+	}
+	return config
+}
+
+// validate rejects parameters that codes cannot be computed with.
+func (config TOTPConfig) validate() error {
+	if config.Period < time.Second || config.Digits < 1 || config.Digits > 9 {
+		return ErrInvalidTOTPConfig
+	}
+	return nil
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a random 160 bit secret in unpadded base32, as authenticator apps expect.
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPURI returns the otpauth:// URI to show as a QR code when enrolling an authenticator app.
+func TOTPURI(config TOTPConfig, secret, issuer, account string) string {
+	config = config.withDefaults()
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(config.Digits))
+	query.Set("period", fmt.Sprint(int(config.Period.Seconds())))
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: query.Encode(),
+	}).String()
+}
+
+// TOTPCode returns the code for the time step containing t.
+func TOTPCode(config TOTPConfig, secret string, t time.Time) (string, error) {
+	config = config.withDefaults()
+	if err := config.validate(); err != nil {
+		return "", err
+	}
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, totpStep(config, t), config.Digits), nil
+}
+
+// ValidateTOTP checks a code against the time steps within the skew window around t.
+// To prevent replays, steps up to and including lastStep are rejected; on success the matched
+// step is returned and must be stored as the new lastStep for the user. Invalid configurations
+// reject every code.
+func ValidateTOTP(config TOTPConfig, secret, code string, t time.Time, lastStep int64) (int64, bool) {
+	config = config.withDefaults()
+	if config.validate() != nil {
+		return 0, false
+	}
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(code) != config.Digits {
+		return 0, false
+	}
+	current := totpStep(config, t)
+	matched := int64(-1)
+	// Check every step in the window so timing does not reveal which one matched
+	for step := current - int64(config.Skew); step <= current+int64(config.Skew); step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(key, step, config.Digits)), []byte(code)) == 1 {
+			matched = step
+		}
+	}
+	return matched, matched >= 0
+}
+
+func totpStep(config TOTPConfig, t time.Time) int64 {
+	return t.Unix() / int64(config.Period.Seconds())
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(strings.ReplaceAll(secret, " ", ""), "=")))
+	if err != nil || len(key) == 0 {
+		return nil, ErrInvalidTOTPSecret
+	}
+	return key, nil
+}
+
+// hotp implements RFC 4226 with HMAC-SHA1 and dynamic truncation.
+func hotp(key []byte, counter int64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// GenerateRecoveryCodes returns n single-use recovery codes formatted as "xxxx-xxxx-xxxx-xxxx" for
+// the user, and their hashes for storage. Each code has 80 random bits, too many to guess from a
+// leaked hash even with a fast hash, so unlike passwords they need no salt or slow hash.
+func GenerateRecoveryCodes(n int) (codes []string, hashes []string, err error) {
+	for i := 0; i < n; i++ {
+		raw := make([]byte, 10)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(raw))
+		code = code[:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:]
+		codes = append(codes, code)
+		hashes = append(hashes, HashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode hashes a recovery code, ignoring case, spaces and dashes.
+func HashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyRecoveryCode returns the index of the hash matching code, or -1.
+// The caller must remove the matched hash so the code cannot be used again.
+func VerifyRecoveryCode(hashes []string, code string) int {
+	hash := []byte(HashRecoveryCode(code))
+	index := -1
+	for i, h := range hashes {
+		if subtle.ConstantTimeCompare([]byte(h), hash) == 1 {
+			index = i
+		}
+	}
+	return index
+}
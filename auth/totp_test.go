@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA1 seed of the RFC 6238 test vectors, "12345678901234567890", in base32.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestTOTPCode tests TOTP code generation against the RFC 6238 test vectors.
+func TestTOTPCode(t *testing.T) {
+	config := TOTPConfig{Digits: 8}
+
+	// Test cases
+	tests := []struct {
+		unix     int64
+		expected string
+	}{
+		{unix: 59, expected: "94287082"},
+		{unix: 1111111109, expected: "07081804"},
+		{unix: 1111111111, expected: "14050471"},
+		{unix: 1234567890, expected: "89005924"},
+		{unix: 2000000000, expected: "69279037"},
+		{unix: 20000000000, expected: "65353130"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.expected, func(t *testing.T) {
+			code, err := TOTPCode(config, rfc6238Secret, time.Unix(tc.unix, 0))
+			if err != nil {
+				t.Fatalf("Failed to generate code: %v", err)
+			}
+			if code != tc.expected {
+				t.Errorf("Expected code %s, got %s", tc.expected, code)
+			}
+		})
+	}
+
+	if _, err := TOTPCode(config, "not base32!", time.Now()); err != ErrInvalidTOTPSecret {
+		t.Errorf("Expected ErrInvalidTOTPSecret, got %v", err)
+	}
+	if _, err := TOTPCode(TOTPConfig{Period: time.Millisecond}, rfc6238Secret, time.Now()); err != ErrInvalidTOTPConfig {
+		t.Errorf("Expected ErrInvalidTOTPConfig, got %v", err)
+	}
+}
+
+// TestValidateTOTP tests the drift window and replay prevention of ValidateTOTP.
+func TestValidateTOTP(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+	config := TOTPConfig{}
+	now := time.Unix(1700000000, 0)
+	codeAt := func(offset time.Duration) string {
+		code, _ := TOTPCode(config, secret, now.Add(offset))
+		return code
+	}
+	current := now.Unix() / 30
+
+	// Test cases
+	tests := []struct {
+		name         string
+		config       TOTPConfig
+		code         string
+		lastStep     int64
+		expectOK     bool
+		expectedStep int64
+	}{
+		{name: "Current step", code: codeAt(0), expectOK: true, expectedStep: current},
+		{name: "Current step without skew", config: TOTPConfig{Skew: TOTPNoSkew}, code: codeAt(0), expectOK: true, expectedStep: current},
+		{name: "Previous step without skew", config: TOTPConfig{Skew: TOTPNoSkew}, code: codeAt(-30 * time.Second)},
+		{name: "Period below a second", config: TOTPConfig{Period: time.Millisecond}, code: codeAt(0)},
+		{name: "Previous step within drift", code: codeAt(-30 * time.Second), expectOK: true, expectedStep: current - 1},
+		{name: "Next step within drift", code: codeAt(30 * time.Second), expectOK: true, expectedStep: current + 1},
+		{name: "Outside drift window", code: codeAt(-90 * time.Second)},
+		{name: "Replayed step", code: codeAt(0), lastStep: current},
+		{name: "Wrong length", code: "12345"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			step, ok := ValidateTOTP(tc.config, secret, tc.code, now, tc.lastStep)
+			if ok != tc.expectOK {
+				t.Fatalf("Expected ok %v, got %v", tc.expectOK, ok)
+			}
+			if ok && step != tc.expectedStep {
+				t.Errorf("Expected step %d, got %d", tc.expectedStep, step)
+			}
+		})
+	}
+}
+
+// TestTOTPURI tests the otpauth URI used to enroll authenticator apps.
+func TestTOTPURI(t *testing.T) {
+	uri := TOTPURI(TOTPConfig{}, rfc6238Secret, "Possum", "alice@example.com")
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatalf("Failed to parse URI: %v", err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Possum:alice@example.com" {
+		t.Errorf("Unexpected URI %q", uri)
+	}
+	query := u.Query()
+	expected := map[string]string{"secret": rfc6238Secret, "issuer": "Possum", "digits": "6", "period": "30", "algorithm": "SHA1"}
+	for key, value := range expected {
+		if query.Get(key) != value {
+			t.Errorf("Expected %s=%s, got %q", key, value, query.Get(key))
+		}
+	}
+}
+
+// TestRecoveryCodes tests generating and verifying recovery codes.
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := GenerateRecoveryCodes(8)
+	if err != nil {
+		t.Fatalf("Failed to generate recovery codes: %v", err)
+	}
+	if len(codes) != 8 || len(hashes) != 8 {
+		t.Fatalf("Expected 8 codes and hashes, got %d and %d", len(codes), len(hashes))
+	}
+	if len(strings.ReplaceAll(codes[0], "-", "")) != 16 {
+		t.Errorf("Expected 16 base32 characters (80 bits), got %q", codes[0])
+	}
+	for i, code := range codes {
+		if VerifyRecoveryCode(hashes, code) != i {
+			t.Errorf("Expected code %q to match index %d", code, i)
+		}
+	}
+
+	// Codes are matched regardless of case and separators
+	if VerifyRecoveryCode(hashes, strings.ToUpper(strings.ReplaceAll(codes[3], "-", " "))) != 3 {
+		t.Error("Expected normalized code to match")
+	}
+	if VerifyRecoveryCode(hashes, "aaaa-aaaa-aaaa-aaaa") != -1 {
+		t.Error("Expected unknown code not to match")
+	}
+}
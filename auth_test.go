@@ -96,14 +96,14 @@ func TestWebSocketAuth(t *testing.T) {
 
 	// Create a mock WebSocket handler (for reference only)
 	// This handler is not used directly in the test anymore
-	_ = func(conn *websocket.Conn, r *http.Request) {
+	_ = func(conn *WebSocketConn, r *http.Request) {
 		// Check if claims are in context
 		_, ok := r.Context().Value(ClaimsKey).(*auth.JWTClaims)
 		if !ok {
 			t.Error("Claims not found in request context")
 		}
 		// Write a success message
-		conn.WriteMessage(websocket.TextMessage, []byte("success"))
+		conn.Send(websocket.TextMessage, []byte("success"))
 	}
 
 	// Create a valid token for testing
@@ -245,4 +245,183 @@ func (m *mockWebSocketConn) WriteJSON(v interface{}) error {
 
 func (m *mockWebSocketConn) ReadJSON(v interface{}) error {
 	return nil
-}
\ No newline at end of file
+}
+
+// TestHTTPAuthEncryptedToken tests that HTTPAuth accepts encrypted tokens once a decryption key is configured.
+func TestHTTPAuthEncryptedToken(t *testing.T) {
+	secret := []byte("test-secret")
+	encryptionKey := []byte("0123456789abcdef0123456789abcdef")
+	_, token, err := auth.GenerateEncryptedJWT(secret, encryptionKey, auth.KeyAlgorithmDirect, uuid.New(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create test token: %v", err)
+	}
+
+	handler := HTTPAuth(secret, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	request := func() int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr.Code
+	}
+
+	if code := request(); code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d without decryption key, got %d", http.StatusUnauthorized, code)
+	}
+
+	auth.SetDecryptionKey(encryptionKey)
+	defer auth.SetDecryptionKey(nil)
+	if code := request(); code != http.StatusOK {
+		t.Errorf("Expected status %d with decryption key, got %d", http.StatusOK, code)
+	}
+}
+
+// TestHTTPAuthWithConfig tests the decryption key of the configuration and rejecting plain tokens.
+func TestHTTPAuthWithConfig(t *testing.T) {
+	secret := []byte("test-secret")
+	encryptionKey := []byte("0123456789abcdef0123456789abcdef")
+	_, encrypted, err := auth.GenerateEncryptedJWT(secret, encryptionKey, auth.KeyAlgorithmDirect, uuid.New(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create test token: %v", err)
+	}
+	_, plain, _ := auth.GenerateJWT(secret, uuid.New(), nil)
+
+	tests := []struct {
+		name     string
+		config   *AuthConfig
+		token    string
+		expected int
+	}{
+		{
+			name:     "Encrypted token",
+			config:   &AuthConfig{Secret: secret, DecryptionKey: encryptionKey},
+			token:    encrypted,
+			expected: http.StatusOK,
+		},
+		{
+			name:     "Plain token",
+			config:   &AuthConfig{Secret: secret, DecryptionKey: encryptionKey},
+			token:    plain,
+			expected: http.StatusOK,
+		},
+		{
+			name:     "Plain token with encryption required",
+			config:   &AuthConfig{Secret: secret, DecryptionKey: encryptionKey, RequireEncryption: true},
+			token:    plain,
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "Encrypted token with encryption required",
+			config:   &AuthConfig{Secret: secret, DecryptionKey: encryptionKey, RequireEncryption: true},
+			token:    encrypted,
+			expected: http.StatusOK,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := HTTPAuthWithConfig(tc.config, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+			if rr.Code != tc.expected {
+				t.Errorf("Expected status %d, got %d", tc.expected, rr.Code)
+			}
+		})
+	}
+}
+
+// TestWebSocketAuthConn tests that WebSocketAuth closes unauthenticated connections with a
+// policy violation and exposes claims on the connection context.
+func TestWebSocketAuthConn(t *testing.T) {
+	secret := []byte("test-secret")
+	userID := uuid.New()
+	_, token, err := auth.GenerateJWT(secret, userID, nil)
+	if err != nil {
+		t.Fatalf("Failed to create test token: %v", err)
+	}
+	handler := WebSocketAuth(secret, func(conn *WebSocketConn, r *http.Request) {
+		claims, ok := conn.Context().Value(ClaimsKey).(*auth.JWTClaims)
+		if !ok {
+			conn.Close(websocket.CloseInternalServerErr, "no claims")
+			return
+		}
+		conn.Send(websocket.TextMessage, []byte(claims.UserID.String()))
+	})
+	server := httptest.NewServer(WebSocketUpgradeWithConfig(&WebSocketConfig{CORS: &CORSConfig{AllowOrigin: "*"}}, handler))
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		token     string
+		expectMsg string
+		closeCode int
+	}{
+		{name: "Valid token", token: token, expectMsg: userID.String(), closeCode: websocket.CloseNormalClosure},
+		{name: "Invalid token", token: "invalid-token", closeCode: websocket.ClosePolicyViolation},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ws, _, err := websocket.DefaultDialer.Dial("ws"+server.URL[len("http"):]+"/?token="+tc.token, nil)
+			if err != nil {
+				t.Fatalf("Failed to dial: %v", err)
+			}
+			defer ws.Close()
+			if tc.expectMsg != "" {
+				_, msg, err := ws.ReadMessage()
+				if err != nil || string(msg) != tc.expectMsg {
+					t.Fatalf("Expected message %q, got %q (%v)", tc.expectMsg, msg, err)
+				}
+			}
+			_, _, err = ws.ReadMessage()
+			if !websocket.IsCloseError(err, tc.closeCode) {
+				t.Errorf("Expected close code %d, got %v", tc.closeCode, err)
+			}
+		})
+	}
+}
+
+// TestRequireRole tests that RequireRole only lets requests whose claims have the role through.
+func TestRequireRole(t *testing.T) {
+	secret := []byte("test-secret")
+	token := func(roles ...string) string {
+		claims := auth.NewClaims(uuid.New(), nil)
+		claims.Roles = roles
+		token, err := auth.SignToken(secret, claims)
+		if err != nil {
+			t.Fatalf("Failed to create test token: %v", err)
+		}
+		return token
+	}
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		token    string
+		expected int
+	}{
+		{name: "Role", handler: HTTPAuth(secret, RequireRole("admin", ok)), token: token("support", "admin"), expected: http.StatusOK},
+		{name: "Other roles", handler: HTTPAuth(secret, RequireRole("admin", ok)), token: token("support"), expected: http.StatusForbidden},
+		{name: "No roles", handler: HTTPAuth(secret, RequireRole("admin", ok)), token: token(), expected: http.StatusForbidden},
+		{name: "Without HTTPAuth", handler: RequireRole("admin", ok), token: token("admin"), expected: http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+			w := httptest.NewRecorder()
+			tc.handler(w, req)
+			if w.Code != tc.expected {
+				t.Errorf("Expected %d, got %d", tc.expected, w.Code)
+			}
+		})
+	}
+}
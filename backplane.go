@@ -0,0 +1,406 @@
+package possum
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mikespook/possum/log"
+)
+
+const (
+	// Broadcast targets of a BackplaneMessage
+	BroadcastAll  = "all"
+	BroadcastRoom = "room"
+	BroadcastUser = "user"
+
+	// tcpBackplaneDialTimeout bounds connecting and writing to a peer.
+	tcpBackplaneDialTimeout = 5 * time.Second
+	// tcpBackplaneRetryDelay is the time an unreachable peer is not dialled again.
+	tcpBackplaneRetryDelay = time.Second
+)
+
+var (
+	ErrBackplaneClosed     = errors.New("backplane closed")
+	ErrBackplanePeerBehind = errors.New("backplane peer queue full")
+)
+
+// BackplaneMessage is a hub broadcast relayed to the hubs of other nodes.
+type BackplaneMessage struct {
+	Origin      string `json:"origin"`        // ID of the publishing hub
+	Target      string `json:"target"`        // BroadcastAll, BroadcastRoom or BroadcastUser
+	Key         string `json:"key,omitempty"` // room name or user ID
+	MessageType int    `json:"message_type"`
+	Data        []byte `json:"data"`
+}
+
+// Backplane is the cross-node pub/sub used by Hub. Publish must deliver the message to the
+// handlers subscribed on every node, including the publishing one; hubs ignore their own messages.
+// A Redis or NATS client can satisfy it by publishing JSON encoded messages to a shared channel.
+type Backplane interface {
+	Publish(msg *BackplaneMessage) error
+	// Subscribe registers handler for every published message and returns a function removing it.
+	Subscribe(handler func(msg *BackplaneMessage)) (unsubscribe func(), err error)
+}
+
+// subscribers is the handler registry shared by the backplane implementations and Presence.
+type subscribers[T any] struct {
+	mu       sync.RWMutex
+	next     int
+	handlers map[int]func(T)
+}
+
+func (s *subscribers[T]) add(handler func(T)) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.handlers == nil {
+		s.handlers = make(map[int]func(T))
+	}
+	id := s.next
+	s.next++
+	s.handlers[id] = handler
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.handlers, id)
+	}
+}
+
+func (s *subscribers[T]) dispatch(v T) {
+	s.mu.RLock()
+	handlers := make([]func(T), 0, len(s.handlers))
+	for _, handler := range s.handlers {
+		handlers = append(handlers, handler)
+	}
+	s.mu.RUnlock()
+	for _, handler := range handlers {
+		handler(v)
+	}
+}
+
+// MemoryBackplane connects hubs within one process, e.g. for tests or one hub per endpoint.
+type MemoryBackplane struct {
+	subscribers[*BackplaneMessage]
+}
+
+// NewMemoryBackplane creates an in-process backplane.
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{}
+}
+
+// Publish delivers msg to every subscriber synchronously.
+func (b *MemoryBackplane) Publish(msg *BackplaneMessage) error {
+	b.dispatch(msg)
+	return nil
+}
+
+// Subscribe registers handler for every published message.
+func (b *MemoryBackplane) Subscribe(handler func(msg *BackplaneMessage)) (func(), error) {
+	return b.add(handler), nil
+}
+
+// TCPBackplaneConfig configures a TCPBackplane node.
+type TCPBackplaneConfig struct {
+	Addr  string   `mapstructure:"addr"`            // listening address, e.g. ":7946"
+	Peers []string `mapstructure:"peers,omitempty"` // addresses of the other nodes
+	// Secret is shared by the nodes: peers connecting without proving that they know it are
+	// disconnected before sending anything. Nil accepts every client that reaches Addr.
+	Secret []byte `mapstructure:"secret,omitempty"`
+	// QueueSize is the number of messages buffered for each peer, default 1024.
+	QueueSize int `mapstructure:"queue_size,omitempty"`
+}
+
+var defaultTCPBackplaneConfig = &TCPBackplaneConfig{
+	QueueSize: 1024,
+}
+
+// TCPBackplane is a reference backplane connecting possum nodes in a full mesh over TCP.
+// Every node listens for its peers and dials each of them to publish newline-delimited JSON.
+// Each peer has its own queue and writer goroutine, so Publish never waits for the network.
+// Delivery is at most once: messages published while a peer is unreachable or behind are lost
+// for it, and the connection is dialled again for the next message.
+type TCPBackplane struct {
+	subscribers[*BackplaneMessage]
+
+	config   *TCPBackplaneConfig
+	listener net.Listener
+	mu       sync.Mutex
+	peers    map[string]*tcpPeer
+	inbound  map[net.Conn]struct{}
+	closed   bool
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// tcpPeer is the outbound connection of a node to a peer, owned by its writer goroutine.
+type tcpPeer struct {
+	addr  string
+	queue chan []byte
+
+	mu     sync.Mutex
+	conn   net.Conn
+	closed bool
+}
+
+// NewTCPBackplane listens on addr, e.g. ":7946", and publishes to the given peer addresses.
+func NewTCPBackplane(addr string, peers ...string) (*TCPBackplane, error) {
+	return NewTCPBackplaneWithConfig(&TCPBackplaneConfig{Addr: addr, Peers: peers})
+}
+
+// NewTCPBackplaneWithConfig starts a node with its own configuration; zero values fall back to
+// the defaults.
+func NewTCPBackplaneWithConfig(config *TCPBackplaneConfig) (*TCPBackplane, error) {
+	cfg := *config
+	if cfg.QueueSize == 0 {
+		cfg.QueueSize = defaultTCPBackplaneConfig.QueueSize
+	}
+	listener, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	b := &TCPBackplane{
+		config:   &cfg,
+		listener: listener,
+		peers:    make(map[string]*tcpPeer),
+		inbound:  make(map[net.Conn]struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, peer := range cfg.Peers {
+		b.AddPeer(peer)
+	}
+	b.wg.Add(1)
+	go b.accept()
+	return b, nil
+}
+
+// Addr returns the listening address of the node.
+func (b *TCPBackplane) Addr() net.Addr {
+	return b.listener.Addr()
+}
+
+// AddPeer adds a node to publish to.
+func (b *TCPBackplane) AddPeer(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.peers[addr]; ok || b.closed {
+		return
+	}
+	p := &tcpPeer{addr: addr, queue: make(chan []byte, b.config.QueueSize)}
+	b.peers[addr] = p
+	b.wg.Add(1)
+	go b.send(p)
+}
+
+// Publish delivers msg to the local subscribers and queues it for every peer. It returns
+// ErrBackplanePeerBehind for the peers whose queue is full, which miss the message.
+func (b *TCPBackplane) Publish(msg *BackplaneMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrBackplaneClosed
+	}
+	var errs []error
+	for addr, p := range b.peers {
+		select {
+		case p.queue <- data:
+		default:
+			errs = append(errs, fmt.Errorf("%w: %s", ErrBackplanePeerBehind, addr))
+		}
+	}
+	b.mu.Unlock()
+
+	b.dispatch(msg)
+	return errors.Join(errs...)
+}
+
+// Subscribe registers handler for messages published by this node or its peers.
+func (b *TCPBackplane) Subscribe(handler func(msg *BackplaneMessage)) (func(), error) {
+	return b.add(handler), nil
+}
+
+// Close stops listening and closes every connection.
+func (b *TCPBackplane) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	err := b.listener.Close()
+	for _, p := range b.peers {
+		p.close()
+	}
+	for conn := range b.inbound {
+		conn.Close()
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+	return err
+}
+
+// send writes the messages queued for p until the node is closed. A peer that cannot be reached
+// is dialled again after tcpBackplaneRetryDelay; the messages queued meanwhile are dropped.
+func (b *TCPBackplane) send(p *tcpPeer) {
+	defer b.wg.Done()
+	var conn net.Conn
+	var retryAt time.Time
+	for {
+		var data []byte
+		select {
+		case <-b.done:
+			return
+		case data = <-p.queue:
+		}
+		if conn == nil {
+			if time.Now().Before(retryAt) {
+				continue
+			}
+			var err error
+			if conn, err = b.dial(p.addr); err != nil {
+				log.Error().Err(err).Str("peer", p.addr).Msg("backplane peer unreachable")
+				retryAt = time.Now().Add(tcpBackplaneRetryDelay)
+				continue
+			}
+			if !p.setConn(conn) {
+				conn.Close()
+				return
+			}
+		}
+		conn.SetWriteDeadline(time.Now().Add(tcpBackplaneDialTimeout))
+		if _, err := conn.Write(data); err != nil {
+			log.Error().Err(err).Str("peer", p.addr).Msg("backplane publish failed")
+			p.setConn(nil)
+			conn = nil
+		}
+	}
+}
+
+// dial connects to a peer and, with a secret, answers its challenge.
+func (b *TCPBackplane) dial(addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, tcpBackplaneDialTimeout)
+	if err != nil || b.config.Secret == nil {
+		return conn, err
+	}
+	conn.SetDeadline(time.Now().Add(tcpBackplaneDialTimeout))
+	challenge, err := bufio.NewReader(conn).ReadString('\n')
+	if err == nil {
+		_, err = conn.Write(append(backplaneMAC(b.config.Secret, challenge), '\n'))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// setConn replaces the connection of the peer, closing the previous one. It returns false once
+// the peer is closed.
+func (p *tcpPeer) setConn(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.conn = conn
+	return !p.closed
+}
+
+// close closes the connection, interrupting a blocked write.
+func (p *tcpPeer) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.conn != nil {
+		p.conn.Close()
+	}
+}
+
+func (b *TCPBackplane) accept() {
+	defer b.wg.Done()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			conn.Close()
+			return
+		}
+		b.inbound[conn] = struct{}{}
+		b.wg.Add(1)
+		b.mu.Unlock()
+		go b.receive(conn)
+	}
+}
+
+// receive dispatches the messages sent by a peer until it disconnects. With a secret, the peer
+// must first answer a random challenge with its HMAC.
+func (b *TCPBackplane) receive(conn net.Conn) {
+	defer func() {
+		b.mu.Lock()
+		delete(b.inbound, conn)
+		b.mu.Unlock()
+		conn.Close()
+		b.wg.Done()
+	}()
+	reader := bufio.NewReader(conn)
+	if b.config.Secret != nil && !b.challenge(conn, reader) {
+		log.Error().Str("peer", conn.RemoteAddr().String()).Msg("backplane peer failed authentication")
+		return
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var msg BackplaneMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			log.Error().Err(err).Str("peer", conn.RemoteAddr().String()).Msg("invalid backplane message")
+			continue
+		}
+		b.dispatch(&msg)
+	}
+}
+
+// challenge sends a random nonce to a connecting peer and checks its answer.
+func (b *TCPBackplane) challenge(conn net.Conn, reader *bufio.Reader) bool {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return false
+	}
+	challenge := hex.EncodeToString(nonce) + "\n"
+	conn.SetDeadline(time.Now().Add(tcpBackplaneDialTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write([]byte(challenge)); err != nil {
+		return false
+	}
+	answer, err := reader.ReadString('\n')
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(strings.TrimSuffix(answer, "\n")), backplaneMAC(b.config.Secret, challenge))
+}
+
+// backplaneMAC is the hex encoded HMAC-SHA256 of a challenge line.
+func backplaneMAC(secret []byte, challenge string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.TrimSuffix(challenge, "\n")))
+	return []byte(hex.EncodeToString(mac.Sum(nil)))
+}
@@ -0,0 +1,256 @@
+package possum
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"github.com/mikespook/possum/auth"
+)
+
+// newBackplaneConn creates an unstarted connection of userID whose queued messages are read directly.
+func newBackplaneConn(hub *Hub, userID uuid.UUID, rooms ...string) *WebSocketConn {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), ClaimsKey, &auth.JWTClaims{UserID: userID}))
+	conn := newWebSocketConn(nil, defaultWebSocketConfig.withDefaults(), r)
+	hub.Register(conn)
+	for _, room := range rooms {
+		hub.Join(conn, room)
+	}
+	return conn
+}
+
+// received returns the next queued message of conn, or "" if none arrives in time.
+func received(conn *WebSocketConn, timeout time.Duration) string {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		if msg, ok := conn.queue.pop(); ok {
+			return string(msg.data)
+		}
+		select {
+		case <-conn.queue.notify:
+		case <-timer.C:
+			return ""
+		}
+	}
+}
+
+// TestBackplane tests that broadcasts reach connections of other hubs through each backplane.
+func TestBackplane(t *testing.T) {
+	tests := []struct {
+		name       string
+		backplanes func(t *testing.T, n int) []Backplane
+	}{
+		{
+			name: "Memory",
+			backplanes: func(t *testing.T, n int) []Backplane {
+				bp := NewMemoryBackplane()
+				backplanes := make([]Backplane, n)
+				for i := range backplanes {
+					backplanes[i] = bp
+				}
+				return backplanes
+			},
+		},
+		{
+			name: "TCP",
+			backplanes: func(t *testing.T, n int) []Backplane {
+				nodes := make([]*TCPBackplane, n)
+				for i := range nodes {
+					node, err := NewTCPBackplane("127.0.0.1:0")
+					if err != nil {
+						t.Fatalf("Failed to listen: %v", err)
+					}
+					t.Cleanup(func() { node.Close() })
+					nodes[i] = node
+				}
+				backplanes := make([]Backplane, n)
+				for i, node := range nodes {
+					for j, peer := range nodes {
+						if i != j {
+							node.AddPeer(peer.Addr().String())
+						}
+					}
+					backplanes[i] = node
+				}
+				return backplanes
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			backplanes := tc.backplanes(t, 3)
+			hubs := make([]*Hub, len(backplanes))
+			for i, bp := range backplanes {
+				hubs[i] = NewHub()
+				if err := hubs[i].UseBackplane(bp); err != nil {
+					t.Fatalf("Failed to use backplane: %v", err)
+				}
+			}
+
+			alice, bob := uuid.New(), uuid.New()
+			aliceA := newBackplaneConn(hubs[0], alice, "lobby")
+			aliceB := newBackplaneConn(hubs[1], alice)
+			bobC := newBackplaneConn(hubs[2], bob, "lobby")
+			conns := []*WebSocketConn{aliceA, aliceB, bobC}
+
+			steps := []struct {
+				broadcast func()
+				message   string
+				expected  []*WebSocketConn
+			}{
+				{
+					broadcast: func() { hubs[1].BroadcastRoom("lobby", websocket.TextMessage, []byte("room")) },
+					message:   "room",
+					expected:  []*WebSocketConn{aliceA, bobC},
+				},
+				{
+					broadcast: func() { hubs[2].BroadcastUser(alice, websocket.TextMessage, []byte("user")) },
+					message:   "user",
+					expected:  []*WebSocketConn{aliceA, aliceB},
+				},
+				{
+					broadcast: func() { hubs[0].Broadcast(websocket.TextMessage, []byte("all")) },
+					message:   "all",
+					expected:  conns,
+				},
+			}
+			for _, step := range steps {
+				step.broadcast()
+				for _, conn := range step.expected {
+					if msg := received(conn, 5*time.Second); msg != step.message {
+						t.Errorf("Expected %q, got %q", step.message, msg)
+					}
+				}
+			}
+			// Nothing is delivered twice or to connections outside the target
+			for i, conn := range conns {
+				if msg := received(conn, 50*time.Millisecond); msg != "" {
+					t.Errorf("Expected no more messages on connection %d, got %q", i, msg)
+				}
+			}
+
+			// A detached hub no longer receives broadcasts of other nodes
+			hubs[2].UseBackplane(nil)
+			hubs[0].Broadcast(websocket.TextMessage, []byte("detached"))
+			if msg := received(aliceB, 5*time.Second); msg != "detached" {
+				t.Errorf("Expected detached, got %q", msg)
+			}
+			if msg := received(bobC, 50*time.Millisecond); msg != "" {
+				t.Errorf("Expected no message on the detached hub, got %q", msg)
+			}
+		})
+	}
+}
+
+// TestTCPBackplaneClose tests that a closed node rejects publishing.
+func TestTCPBackplaneClose(t *testing.T) {
+	node, err := NewTCPBackplane("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	if err := node.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	if err := node.Publish(&BackplaneMessage{Target: BroadcastAll}); err != ErrBackplaneClosed {
+		t.Errorf("Expected ErrBackplaneClosed, got %v", err)
+	}
+}
+
+// TestTCPBackplaneSecret tests that nodes with a secret only accept messages from peers knowing it.
+func TestTCPBackplaneSecret(t *testing.T) {
+	secret := []byte("backplane-secret")
+	node, err := NewTCPBackplaneWithConfig(&TCPBackplaneConfig{Addr: "127.0.0.1:0", Secret: secret})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer node.Close()
+	received := make(chan string, 4)
+	node.Subscribe(func(msg *BackplaneMessage) { received <- string(msg.Data) })
+
+	// A client that does not answer the challenge
+	raw, err := net.Dial("tcp", node.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer raw.Close()
+	data, _ := json.Marshal(&BackplaneMessage{Target: BroadcastAll, Data: []byte("injected")})
+	raw.Write(append(data, '\n'))
+
+	tests := []struct {
+		name     string
+		secret   []byte
+		expected string
+	}{
+		{name: "Wrong secret", secret: []byte("other-secret")},
+		{name: "Shared secret", secret: secret, expected: "shared"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			peer, err := NewTCPBackplaneWithConfig(&TCPBackplaneConfig{Addr: "127.0.0.1:0", Peers: []string{node.Addr().String()}, Secret: tc.secret})
+			if err != nil {
+				t.Fatalf("Failed to listen: %v", err)
+			}
+			defer peer.Close()
+			peer.Publish(&BackplaneMessage{Target: BroadcastAll, Data: []byte(tc.name)})
+			select {
+			case msg := <-received:
+				if tc.expected == "" {
+					t.Errorf("Expected no message, got %q", msg)
+				} else if msg != tc.name {
+					t.Errorf("Expected %q, got %q", tc.name, msg)
+				}
+			case <-time.After(200 * time.Millisecond):
+				if tc.expected != "" {
+					t.Error("Expected the message of the peer")
+				}
+			}
+		})
+	}
+}
+
+// TestTCPBackplaneUnreachablePeer tests that publishing does not wait for unreachable peers.
+func TestTCPBackplaneUnreachablePeer(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	closed.Close()
+	receiver, err := NewTCPBackplane("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer receiver.Close()
+	received := make(chan string, 1)
+	receiver.Subscribe(func(msg *BackplaneMessage) { received <- string(msg.Data) })
+	node, err := NewTCPBackplane("127.0.0.1:0", closed.Addr().String(), receiver.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer node.Close()
+
+	start := time.Now()
+	if err := node.Publish(&BackplaneMessage{Target: BroadcastAll, Data: []byte("hello")}); err != nil {
+		t.Errorf("Expected the message to be queued, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("Expected Publish to return at once, took %v", elapsed)
+	}
+	select {
+	case msg := <-received:
+		if msg != "hello" {
+			t.Errorf("Expected hello, got %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the reachable peer to receive the message")
+	}
+}
@@ -11,3 +11,14 @@ func Chain(handler http.HandlerFunc, middlewares ...HandlerFunc) http.HandlerFun
 	}
 	return handler
 }
+
+// WebsocketMiddleware wraps a WebsocketHandlerFunc with connection-level behaviour.
+type WebsocketMiddleware func(WebsocketHandlerFunc) WebsocketHandlerFunc
+
+// ChainWebSocket composes multiple WebSocket middlewares into a single handler, applying them in reverse order.
+func ChainWebSocket(handler WebsocketHandlerFunc, middlewares ...WebsocketMiddleware) WebsocketHandlerFunc {
+	for i := range middlewares {
+		handler = middlewares[len(middlewares)-1-i](handler)
+	}
+	return handler
+}
@@ -3,7 +3,13 @@ package possum
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"github.com/mikespook/possum/auth"
 )
 
 // TestChain tests the Chain function for composing multiple middleware handlers in the correct order.
@@ -115,4 +121,79 @@ func TestChain(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+// TestChainWebSocket tests composing WebSocket middlewares, including the adapters of existing features.
+func TestChainWebSocket(t *testing.T) {
+	secret := []byte("test-secret")
+	hub := NewHub()
+	var executionOrder []string
+	trace := func(name string) WebsocketMiddleware {
+		return func(next WebsocketHandlerFunc) WebsocketHandlerFunc {
+			return func(conn *WebSocketConn, r *http.Request) {
+				executionOrder = append(executionOrder, name+"-before")
+				next(conn, r)
+				executionOrder = append(executionOrder, name+"-after")
+			}
+		}
+	}
+	baseHandler := func(conn *WebSocketConn, r *http.Request) {
+		executionOrder = append(executionOrder, "base")
+		claims := conn.Context().Value(ClaimsKey).(*auth.JWTClaims)
+		hub.BroadcastUser(claims.UserID, websocket.TextMessage, []byte("registered"))
+	}
+	done := make(chan struct{}, 1)
+	handler := ChainWebSocket(baseHandler, trace("middleware1"), WebSocketAuthMiddleware(secret), hub.Handler, trace("middleware2"))
+	server := httptest.NewServer(WebSocketUpgradeWithConfig(&WebSocketConfig{CORS: &CORSConfig{AllowOrigin: "*"}}, func(conn *WebSocketConn, r *http.Request) {
+		handler(conn, r)
+		done <- struct{}{}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name          string
+		valid         bool
+		expectedOrder []string
+	}{
+		{
+			name:  "Authenticated",
+			valid: true,
+			expectedOrder: []string{
+				"middleware1-before",
+				"middleware2-before",
+				"base",
+				"middleware2-after",
+				"middleware1-after",
+			},
+		},
+		{
+			name:          "Rejected by auth",
+			valid:         false,
+			expectedOrder: []string{"middleware1-before", "middleware1-after"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			executionOrder = []string{}
+			token := "invalid-token"
+			if tc.valid {
+				_, token, _ = auth.GenerateJWT(secret, uuid.New(), nil)
+			}
+			ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/?token="+token, nil)
+			if err != nil {
+				t.Fatalf("Failed to dial: %v", err)
+			}
+			defer ws.Close()
+			if tc.valid {
+				if _, msg, err := ws.ReadMessage(); err != nil || string(msg) != "registered" {
+					t.Errorf("Expected registered, got %q (%v)", msg, err)
+				}
+			}
+			<-done
+			if strings.Join(executionOrder, ",") != strings.Join(tc.expectedOrder, ",") {
+				t.Errorf("Expected order %v, got %v", tc.expectedOrder, executionOrder)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+// Command possum is a development and incident response tool for possum services.
+//
+// Usage:
+//
+//	possum token mint   [-secret s | -key-file f] [-user id] [-exp d] [-tenant t] [-claim k=v ...]
+//	                    [-encrypt alg -encryption-key-file f]
+//	possum token decode [-decryption-key-file f] [token]
+//	possum token verify [-secret s | -key-file f | -keys f] [-decryption-key-file f] [token]
+//
+// Tokens are read from standard input when not given as an argument.
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+func main() {
+	// auth.ParseToken logs every failure; the verify command reports them itself.
+	log.SetOutput(io.Discard)
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run dispatches a command line and returns the process exit code.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return 2
+	}
+	switch args[0] {
+	case "token":
+		return runToken(args[1:], stdin, stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		usage(stdout)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "possum: unknown command %q\n", args[0])
+		usage(stderr)
+		return 2
+	}
+}
+
+func usage(w io.Writer) {
+	fmt.Fprint(w, `Usage: possum <command> [arguments]
+
+Commands:
+  token mint     mint a signed token
+  token decode   print the header and claims of a token without verifying it
+  token verify   verify a token and print its claims or the reason it is invalid
+
+Run "possum token <command> -h" for the flags of a command.
+`)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+
+	"github.com/mikespook/possum/auth"
+)
+
+// runToken dispatches the token subcommands.
+func runToken(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return 2
+	}
+	var err error
+	switch args[0] {
+	case "mint":
+		err = tokenMint(args[1:], stdout, stderr)
+	case "decode":
+		err = tokenDecode(args[1:], stdin, stdout, stderr)
+	case "verify":
+		err = tokenVerify(args[1:], stdin, stdout, stderr)
+	default:
+		fmt.Fprintf(stderr, "possum: unknown token command %q\n", args[0])
+		usage(stderr)
+		return 2
+	}
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.Is(err, errUsage):
+		return 2
+	default:
+		fmt.Fprintf(stderr, "possum: %v\n", err)
+		return 1
+	}
+}
+
+// errUsage is returned for invalid flags, which the flag package has already reported.
+var errUsage = errors.New("usage")
+
+// claimFlags collects repeated -claim key=value flags.
+type claimFlags map[string]any
+
+func (c claimFlags) String() string {
+	return fmt.Sprint(map[string]any(c))
+}
+
+// Set parses key=value, decoding the value as JSON when possible and as a string otherwise.
+func (c claimFlags) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("claim %q is not key=value", s)
+	}
+	var v any
+	if err := json.Unmarshal([]byte(value), &v); err != nil {
+		v = value
+	}
+	c[key] = v
+	return nil
+}
+
+// keyFlags holds the flags selecting the verification or signing keys.
+type keyFlags struct {
+	secret  string
+	keyFile string
+	keySet  string
+}
+
+func (k *keyFlags) register(fs *flag.FlagSet, keySet bool) {
+	fs.StringVar(&k.secret, "secret", "", "HMAC secret")
+	fs.StringVar(&k.keyFile, "key-file", "", "file containing the HMAC secret")
+	if keySet {
+		fs.StringVar(&k.keySet, "keys", "", "file containing one HMAC secret per line, all of which are tried")
+	}
+}
+
+// load returns the configured keys. Trailing line breaks are stripped from key files.
+func (k *keyFlags) load() ([][]byte, error) {
+	var keys [][]byte
+	if k.secret != "" {
+		keys = append(keys, []byte(k.secret))
+	}
+	if k.keyFile != "" {
+		key, err := readKeyFile(k.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if k.keySet != "" {
+		data, err := os.ReadFile(k.keySet)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			keys = append(keys, []byte(line))
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no key given, use -secret, -key-file or -keys")
+	}
+	return keys, nil
+}
+
+// readKeyFile reads a raw key, stripping trailing line breaks.
+func readKeyFile(name string) ([]byte, error) {
+	if name == "" {
+		return nil, errors.New("no key file given")
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(data, "\r\n"), nil
+}
+
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("possum token "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	return fs
+}
+
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	return nil
+}
+
+// readToken takes the token from the first argument or, if there is none, from stdin.
+func readToken(args []string, stdin io.Reader) (string, error) {
+	if len(args) > 0 {
+		return strings.TrimSpace(args[0]), nil
+	}
+	data, err := io.ReadAll(stdin)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", errors.New("no token given")
+	}
+	return token, nil
+}
+
+func printJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// tokenMint signs a token the way auth.GenerateJWT does, with optional tenant and custom claims.
+func tokenMint(args []string, stdout, stderr io.Writer) error {
+	fs := newFlagSet("mint", stderr)
+	var keys keyFlags
+	keys.register(fs, false)
+	user := fs.String("user", "", "user ID (default: a random UUID)")
+	exp := fs.Duration("exp", 24*time.Hour, "lifetime of the token")
+	tenant := fs.String("tenant", "", "tenant ID")
+	encrypt := fs.String("encrypt", "", "nest the token in a JWE using this key algorithm (dir, A128KW, A192KW, A256KW)")
+	encryptionKeyFile := fs.String("encryption-key-file", "", "file containing the raw JWE key")
+	custom := claimFlags{}
+	fs.Var(custom, "claim", "custom claim as key=value, the value is decoded as JSON if possible (repeatable)")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	secrets, err := keys.load()
+	if err != nil {
+		return err
+	}
+	userID := uuid.New()
+	if *user != "" {
+		if userID, err = uuid.Parse(*user); err != nil {
+			return fmt.Errorf("invalid user ID: %w", err)
+		}
+	}
+	expiresAt := time.Now().Add(*exp)
+	claims := auth.NewClaims(userID, &expiresAt)
+	claims.TenantID = *tenant
+
+	var signed jwt.Claims = claims
+	if len(custom) > 0 {
+		mapClaims, err := toMapClaims(claims)
+		if err != nil {
+			return err
+		}
+		for key, value := range custom {
+			mapClaims[key] = value
+		}
+		signed = mapClaims
+	}
+
+	token, err := auth.SignToken(secrets[0], signed)
+	if err != nil {
+		return err
+	}
+	if *encrypt != "" {
+		key, err := readKeyFile(*encryptionKeyFile)
+		if err != nil {
+			return err
+		}
+		if token, err = auth.EncryptToken(key, *encrypt, token); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintln(stdout, token)
+	return err
+}
+
+// toMapClaims converts claims to their JSON object form so custom claims can be added.
+func toMapClaims(claims jwt.Claims) (jwt.MapClaims, error) {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+	mapClaims := jwt.MapClaims{}
+	if err := json.Unmarshal(data, &mapClaims); err != nil {
+		return nil, err
+	}
+	return mapClaims, nil
+}
+
+// tokenDecode prints the header and claims of a token without verifying it.
+func tokenDecode(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := newFlagSet("decode", stderr)
+	decryptionKey := fs.String("decryption-key-file", "", "file containing the raw JWE key for encrypted tokens")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	token, err := readToken(fs.Args(), stdin)
+	if err != nil {
+		return err
+	}
+	if auth.IsEncryptedToken(token) {
+		key, err := readKeyFile(*decryptionKey)
+		if err != nil {
+			return fmt.Errorf("encrypted token: %w", err)
+		}
+		if token, err = auth.DecryptToken(key, token); err != nil {
+			return err
+		}
+	}
+	header, claims, err := auth.DecodeToken(token)
+	if err != nil {
+		return err
+	}
+	return printJSON(stdout, map[string]any{
+		"header": header,
+		"claims": claims,
+	})
+}
+
+// tokenVerify verifies a token with auth.ParseToken against every key and explains why it is invalid.
+func tokenVerify(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs := newFlagSet("verify", stderr)
+	var keys keyFlags
+	keys.register(fs, true)
+	decryptionKey := fs.String("decryption-key-file", "", "file containing the raw JWE key for encrypted tokens")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *decryptionKey != "" {
+		key, err := readKeyFile(*decryptionKey)
+		if err != nil {
+			return err
+		}
+		auth.SetDecryptionKey(key)
+	}
+	secrets, err := keys.load()
+	if err != nil {
+		return err
+	}
+	token, err := readToken(fs.Args(), stdin)
+	if err != nil {
+		return err
+	}
+
+	for i, secret := range secrets {
+		claims, err := auth.ParseToken(secret, token)
+		if err == nil {
+			fmt.Fprintf(stdout, "valid (key %d of %d)\n", i+1, len(secrets))
+			return printJSON(stdout, claims)
+		}
+		// Any failure other than a signature mismatch means the key was right
+		// but the token is not acceptable, so there is no point in trying others.
+		if !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+			return fmt.Errorf("invalid: %s", failureReason(token, err))
+		}
+	}
+	return fmt.Errorf("invalid: signature does not match any of %d key(s)", len(secrets))
+}
+
+// failureReason turns a verification error into a precise, human readable reason.
+func failureReason(token string, err error) string {
+	_, claims, _ := auth.DecodeToken(token)
+	switch {
+	case errors.Is(err, auth.ErrEncryptedToken):
+		return "token is encrypted, use -decryption-key-file"
+	case errors.Is(err, auth.ErrTokenDecryption), errors.Is(err, auth.ErrInvalidKeySize), errors.Is(err, auth.ErrUnsupportedAlgorithm):
+		return fmt.Sprintf("cannot decrypt token (%v)", err)
+	}
+	at := func(get func() (*jwt.NumericDate, error)) string {
+		if claims == nil {
+			return ""
+		}
+		date, err := get()
+		if err != nil || date == nil {
+			return ""
+		}
+		return " " + date.UTC().Format(time.RFC3339)
+	}
+	switch {
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return fmt.Sprintf("malformed token (%v)", err)
+	case errors.Is(err, jwt.ErrTokenUnverifiable):
+		return fmt.Sprintf("unverifiable token (%v)", err)
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return "token expired at" + at(claims.GetExpirationTime)
+	case errors.Is(err, jwt.ErrTokenNotValidYet):
+		return "token not valid before" + at(claims.GetNotBefore)
+	case errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return "token used before it was issued at" + at(claims.GetIssuedAt)
+	default:
+		return err.Error()
+	}
+}
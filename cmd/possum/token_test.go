@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runCLI runs the command line and returns its exit code and outputs.
+func runCLI(stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+// TestTokenMintDecode tests minting a token with custom claims and decoding it.
+func TestTokenMintDecode(t *testing.T) {
+	userID := "6f1c1d2e-7c1f-4f77-9d6e-0c5f4a3f2b1a"
+	code, out, errOut := runCLI("", "token", "mint", "-secret", "s3cret", "-user", userID,
+		"-tenant", "acme", "-claim", "role=admin", "-claim", "level=3")
+	if code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, errOut)
+	}
+	token := strings.TrimSpace(out)
+
+	// Decode reads the token from stdin
+	code, out, errOut = runCLI(token, "token", "decode")
+	if code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, errOut)
+	}
+	var decoded struct {
+		Header map[string]any `json:"header"`
+		Claims map[string]any `json:"claims"`
+	}
+	if err := json.Unmarshal([]byte(out), &decoded); err != nil {
+		t.Fatalf("Failed to parse decode output: %v", err)
+	}
+	if decoded.Header["alg"] != "HS256" {
+		t.Errorf("Expected alg HS256, got %v", decoded.Header["alg"])
+	}
+	expected := map[string]any{"user_id": userID, "tenant_id": "acme", "role": "admin", "level": float64(3)}
+	for key, value := range expected {
+		if decoded.Claims[key] != value {
+			t.Errorf("Expected claim %s=%v, got %v", key, value, decoded.Claims[key])
+		}
+	}
+}
+
+// TestTokenVerify tests verifying tokens against secrets, key files and key sets.
+func TestTokenVerify(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyFile, []byte("file-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keySet := filepath.Join(dir, "keys")
+	if err := os.WriteFile(keySet, []byte("# rotated keys\nold-secret\nfile-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mint := func(args ...string) string {
+		code, out, errOut := runCLI("", append([]string{"token", "mint"}, args...)...)
+		if code != 0 {
+			t.Fatalf("Failed to mint token: %s", errOut)
+		}
+		return strings.TrimSpace(out)
+	}
+	valid := mint("-key-file", keyFile)
+	expired := mint("-key-file", keyFile, "-exp", "-1h")
+
+	// Test cases
+	tests := []struct {
+		name         string
+		args         []string
+		expectedCode int
+		expected     string
+	}{
+		{
+			name:         "Valid with secret",
+			args:         []string{"-secret", "file-secret", valid},
+			expectedCode: 0,
+			expected:     "valid (key 1 of 1)",
+		},
+		{
+			name:         "Valid with key set",
+			args:         []string{"-keys", keySet, valid},
+			expectedCode: 0,
+			expected:     "valid (key 2 of 2)",
+		},
+		{
+			name:         "Wrong secret",
+			args:         []string{"-secret", "wrong", valid},
+			expectedCode: 1,
+			expected:     "signature does not match any of 1 key(s)",
+		},
+		{
+			name:         "Expired",
+			args:         []string{"-keys", keySet, expired},
+			expectedCode: 1,
+			expected:     "token expired at",
+		},
+		{
+			name:         "Malformed",
+			args:         []string{"-secret", "file-secret", "not-a-token"},
+			expectedCode: 1,
+			expected:     "malformed token",
+		},
+		{
+			name:         "No key",
+			args:         []string{valid},
+			expectedCode: 1,
+			expected:     "no key given",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			code, out, errOut := runCLI("", append([]string{"token", "verify"}, tc.args...)...)
+			if code != tc.expectedCode {
+				t.Errorf("Expected exit code %d, got %d", tc.expectedCode, code)
+			}
+			if !strings.Contains(out+errOut, tc.expected) {
+				t.Errorf("Expected output to contain %q, got %q", tc.expected, out+errOut)
+			}
+		})
+	}
+}
+
+// TestRunUsage tests the exit codes of invalid command lines.
+func TestRunUsage(t *testing.T) {
+	// Test cases
+	tests := []struct {
+		name         string
+		args         []string
+		expectedCode int
+	}{
+		{name: "No command", args: nil, expectedCode: 2},
+		{name: "Unknown command", args: []string{"foo"}, expectedCode: 2},
+		{name: "Unknown token command", args: []string{"token", "foo"}, expectedCode: 2},
+		{name: "Invalid flag", args: []string{"token", "mint", "-bogus"}, expectedCode: 2},
+		{name: "Invalid claim", args: []string{"token", "mint", "-claim", "novalue"}, expectedCode: 2},
+		{name: "Help", args: []string{"help"}, expectedCode: 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if code, _, _ := runCLI("", tc.args...); code != tc.expectedCode {
+				t.Errorf("Expected exit code %d, got %d", tc.expectedCode, code)
+			}
+		})
+	}
+}
+
+// TestTokenEncrypted tests minting, decoding and verifying encrypted tokens.
+func TestTokenEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	jweKey := filepath.Join(dir, "jwe.key")
+	if err := os.WriteFile(jweKey, bytes.Repeat([]byte("k"), 32), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	code, out, errOut := runCLI("", "token", "mint", "-secret", "s3cret", "-tenant", "acme",
+		"-encrypt", "A256KW", "-encryption-key-file", jweKey)
+	if code != 0 {
+		t.Fatalf("Expected exit code 0, got %d: %s", code, errOut)
+	}
+	token := strings.TrimSpace(out)
+	if strings.Count(token, ".") != 4 {
+		t.Fatalf("Expected a JWE compact serialization, got %q", token)
+	}
+
+	// Decoding needs the decryption key
+	if code, _, _ := runCLI(token, "token", "decode"); code != 1 {
+		t.Errorf("Expected exit code 1 without key, got %d", code)
+	}
+	code, out, errOut = runCLI(token, "token", "decode", "-decryption-key-file", jweKey)
+	if code != 0 || !strings.Contains(out, `"tenant_id": "acme"`) {
+		t.Errorf("Expected decoded claims, got %d: %s%s", code, out, errOut)
+	}
+
+	// Verification reports missing keys precisely
+	code, out, errOut = runCLI("", "token", "verify", "-secret", "s3cret", token)
+	if code != 1 || !strings.Contains(errOut, "token is encrypted") {
+		t.Errorf("Expected encrypted token failure, got %d: %s%s", code, out, errOut)
+	}
+	code, out, errOut = runCLI("", "token", "verify", "-secret", "s3cret", "-decryption-key-file", jweKey, token)
+	if code != 0 || !strings.Contains(out, "valid") {
+		t.Errorf("Expected valid token, got %d: %s%s", code, out, errOut)
+	}
+}
@@ -0,0 +1,127 @@
+package possum
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes the messages of a WebSocket connection. Its name is the subprotocol clients
+// offer to select it, see WebSocketConfig.Codecs. Envelopes are encoded by the codec as well
+// so that their payload is embedded in the codec's own format rather than as opaque bytes.
+type Codec interface {
+	Name() string
+	// MessageType is websocket.TextMessage or websocket.BinaryMessage.
+	MessageType() int
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+	EncodeEnvelope(envelope *Envelope) ([]byte, error)
+	DecodeEnvelope(data []byte) (*Envelope, error)
+}
+
+var (
+	// Predefined codecs; struct fields are named after their json tags in every format.
+	JSONCodec    Codec = jsonCodec{}
+	MsgpackCodec Codec = msgpackCodec{}
+	CBORCodec    Codec = cborCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                       { return "json" }
+func (jsonCodec) MessageType() int                   { return websocket.TextMessage }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+func (jsonCodec) EncodeEnvelope(envelope *Envelope) ([]byte, error) {
+	return json.Marshal(envelope)
+}
+
+func (jsonCodec) DecodeEnvelope(data []byte) (*Envelope, error) {
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	return &envelope, nil
+}
+
+type msgpackCodec struct{}
+
+// msgpackEnvelope embeds the payload as MessagePack.
+type msgpackEnvelope struct {
+	Type    string             `json:"type"`
+	ID      string             `json:"id,omitempty"`
+	Payload msgpack.RawMessage `json:"payload,omitempty"`
+	Error   *Error             `json:"error,omitempty"`
+}
+
+func (msgpackCodec) Name() string     { return "msgpack" }
+func (msgpackCodec) MessageType() int { return websocket.BinaryMessage }
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+func (c msgpackCodec) EncodeEnvelope(envelope *Envelope) ([]byte, error) {
+	return c.Marshal(&msgpackEnvelope{
+		Type:    envelope.Type,
+		ID:      envelope.ID,
+		Payload: msgpack.RawMessage(envelope.Payload),
+		Error:   envelope.Error,
+	})
+}
+
+func (c msgpackCodec) DecodeEnvelope(data []byte) (*Envelope, error) {
+	var envelope msgpackEnvelope
+	if err := c.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	return &Envelope{Type: envelope.Type, ID: envelope.ID, Payload: []byte(envelope.Payload), Error: envelope.Error}, nil
+}
+
+type cborCodec struct{}
+
+// cborEnvelope embeds the payload as CBOR.
+type cborEnvelope struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload cbor.RawMessage `json:"payload,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+func (cborCodec) Name() string                       { return "cbor" }
+func (cborCodec) MessageType() int                   { return websocket.BinaryMessage }
+func (cborCodec) Marshal(v any) ([]byte, error)      { return cbor.Marshal(v) }
+func (cborCodec) Unmarshal(data []byte, v any) error { return cbor.Unmarshal(data, v) }
+
+func (cborCodec) EncodeEnvelope(envelope *Envelope) ([]byte, error) {
+	return cbor.Marshal(&cborEnvelope{
+		Type:    envelope.Type,
+		ID:      envelope.ID,
+		Payload: cbor.RawMessage(envelope.Payload),
+		Error:   envelope.Error,
+	})
+}
+
+func (cborCodec) DecodeEnvelope(data []byte) (*Envelope, error) {
+	var envelope cborEnvelope
+	if err := cbor.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	return &Envelope{Type: envelope.Type, ID: envelope.ID, Payload: []byte(envelope.Payload), Error: envelope.Error}, nil
+}
@@ -0,0 +1,167 @@
+package possum
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+type codecSample struct {
+	Name   string   `json:"name"`
+	Count  int      `json:"count,omitempty"`
+	Values []uint16 `json:"values"`
+}
+
+// TestCodec tests that every codec round-trips values and envelopes using json field names.
+func TestCodec(t *testing.T) {
+	sample := codecSample{Name: "sensor", Values: []uint16{1, 2, 3}}
+
+	tests := []struct {
+		codec       Codec
+		messageType int
+	}{
+		{codec: JSONCodec, messageType: websocket.TextMessage},
+		{codec: MsgpackCodec, messageType: websocket.BinaryMessage},
+		{codec: CBORCodec, messageType: websocket.BinaryMessage},
+	}
+	for _, tc := range tests {
+		t.Run(tc.codec.Name(), func(t *testing.T) {
+			if tc.codec.MessageType() != tc.messageType {
+				t.Errorf("Expected message type %d, got %d", tc.messageType, tc.codec.MessageType())
+			}
+			data, err := tc.codec.Marshal(&sample)
+			if err != nil {
+				t.Fatalf("Failed to marshal: %v", err)
+			}
+			var decoded codecSample
+			if err := tc.codec.Unmarshal(data, &decoded); err != nil || !reflect.DeepEqual(decoded, sample) {
+				t.Errorf("Expected %+v, got %+v (%v)", sample, decoded, err)
+			}
+			var fields map[string]any
+			tc.codec.Unmarshal(data, &fields)
+			if _, ok := fields["count"]; ok || fields["name"] != "sensor" {
+				t.Errorf("Expected json field names, got %v", fields)
+			}
+
+			envelope := &Envelope{Type: "reading", ID: "1", Payload: data, Error: &Error{Code: 400, Message: "Bad"}}
+			encoded, err := tc.codec.EncodeEnvelope(envelope)
+			if err != nil {
+				t.Fatalf("Failed to encode envelope: %v", err)
+			}
+			got, err := tc.codec.DecodeEnvelope(encoded)
+			if err != nil {
+				t.Fatalf("Failed to decode envelope: %v", err)
+			}
+			if got.Type != "reading" || got.ID != "1" || got.Error.Code != 400 || got.Error.Message != "Bad" {
+				t.Errorf("Unexpected envelope %+v", got)
+			}
+			decoded = codecSample{}
+			if err := tc.codec.Unmarshal(got.Payload, &decoded); err != nil || !reflect.DeepEqual(decoded, sample) {
+				t.Errorf("Expected payload %+v, got %+v (%v)", sample, decoded, err)
+			}
+			if _, err := tc.codec.DecodeEnvelope([]byte{0xc1}); err == nil {
+				t.Error("Expected an error for invalid data")
+			}
+		})
+	}
+}
+
+// TestRouterCodec tests that the same typed handlers serve clients negotiating each codec.
+func TestRouterCodec(t *testing.T) {
+	router := NewRouter()
+	HandleMessage(router, "sum", func(msg *Message, sample codecSample) (any, error) {
+		total := 0
+		for _, v := range sample.Values {
+			total += int(v)
+		}
+		return &codecSample{Name: sample.Name, Count: total}, nil
+	})
+	server := httptest.NewServer(WebSocketUpgradeWithConfig(&WebSocketConfig{
+		CORS:   &CORSConfig{AllowOrigin: "*"},
+		Codecs: []Codec{MsgpackCodec, CBORCodec},
+	}, router.ServeWebSocket))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		offered  []string
+		expected Codec
+	}{
+		{name: "Default", expected: JSONCodec},
+		{name: "MessagePack", offered: []string{"msgpack"}, expected: MsgpackCodec},
+		{name: "CBOR", offered: []string{"cbor"}, expected: CBORCodec},
+		{name: "Server preference", offered: []string{"cbor", "msgpack"}, expected: MsgpackCodec},
+		{name: "Unsupported", offered: []string{"protobuf"}, expected: JSONCodec},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dialer := websocket.Dialer{Subprotocols: tc.offered}
+			ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			if err != nil {
+				t.Fatalf("Failed to dial: %v", err)
+			}
+			defer ws.Close()
+
+			codec := tc.expected
+			payload, _ := codec.Marshal(&codecSample{Name: "a", Values: []uint16{2, 3}})
+			request, _ := codec.EncodeEnvelope(&Envelope{Type: "sum", ID: "1", Payload: payload})
+			if err := ws.WriteMessage(codec.MessageType(), request); err != nil {
+				t.Fatalf("Failed to write: %v", err)
+			}
+			messageType, data, err := ws.ReadMessage()
+			if err != nil {
+				t.Fatalf("Failed to read: %v", err)
+			}
+			if messageType != codec.MessageType() {
+				t.Errorf("Expected message type %d, got %d", codec.MessageType(), messageType)
+			}
+			response, err := codec.DecodeEnvelope(data)
+			if err != nil || response.ID != "1" || response.Error != nil {
+				t.Fatalf("Unexpected response %+v (%v)", response, err)
+			}
+			var result codecSample
+			codec.Unmarshal(response.Payload, &result)
+			if result.Name != "a" || result.Count != 5 {
+				t.Errorf("Unexpected result %+v", result)
+			}
+		})
+	}
+}
+
+// TestWebSocketConnValue tests SendValue and ReadValue with a negotiated codec.
+func TestWebSocketConnValue(t *testing.T) {
+	server := httptest.NewServer(WebSocketUpgradeWithConfig(&WebSocketConfig{
+		CORS:   &CORSConfig{AllowOrigin: "*"},
+		Codecs: []Codec{CBORCodec},
+	}, func(conn *WebSocketConn, r *http.Request) {
+		var sample codecSample
+		if err := conn.ReadValue(&sample); err != nil {
+			t.Errorf("Failed to read: %v", err)
+			return
+		}
+		sample.Count = len(sample.Values)
+		conn.SendValue(&sample)
+	}))
+	defer server.Close()
+	dialer := websocket.Dialer{Subprotocols: []string{"cbor"}}
+	ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer ws.Close()
+
+	data, _ := CBORCodec.Marshal(&codecSample{Name: "b", Values: []uint16{7}})
+	ws.WriteMessage(websocket.BinaryMessage, data)
+	messageType, data, err := ws.ReadMessage()
+	if err != nil || messageType != websocket.BinaryMessage {
+		t.Fatalf("Expected a binary message, got %d (%v)", messageType, err)
+	}
+	var sample codecSample
+	if err := CBORCodec.Unmarshal(data, &sample); err != nil || sample.Count != 1 {
+		t.Errorf("Unexpected value %+v (%v)", sample, err)
+	}
+}
@@ -2,26 +2,128 @@ package possum
 
 import (
 	"net/http"
+	"regexp"
 	"strconv"
+	"strings"
+
+	"github.com/mikespook/possum/log"
 )
 
+// CORSConfig is the CORS policy of Cors and the origin policy of WebSocket upgrades. Origins are
+// allowed by AllowOrigin, any entry of AllowOrigins or AllowOriginFunc. An entry is "*" for any
+// origin, an exact origin such as "https://example.com", a subdomain wildcard such as
+// "https://*.example.com" or, starting with "^", a regular expression that must match the whole
+// origin, as if it ended with "$".
 type CORSConfig struct {
 	AllowOrigin      string   `mapstructure:"allow_origin,omitempty"`
+	AllowOrigins     []string `mapstructure:"allow_origins,omitempty"`
 	AllowMethods     string   `mapstructure:"allow_methods,omitempty"`
 	AllowHeaders     string   `mapstructure:"allow_headers,omitempty"`
 	AllowCredentials bool     `mapstructure:"allow_credentials,omitempty"`
 	ExposeHeaders    string   `mapstructure:"expose_headers,omitempty"`
 	MaxAge           int      `mapstructure:"max_age,omitempty"`
-	ExemptMethods    []string `mapstructure:"exempt_methods,omitempty"`
+	// Deprecated: ExemptMethods is no longer used by Cors, which detects preflight requests
+	// from their headers.
+	ExemptMethods []string `mapstructure:"exempt_methods,omitempty"`
+	// AllowOriginFunc allows the origins it returns true for, in addition to the others.
+	AllowOriginFunc func(origin string) bool `mapstructure:"-"`
 
 	cachedMethods map[string]struct{}
+	origins       *originMatcher
 }
 
+// Init caches the exempt methods and compiles the allowed origins; call it again after changing
+// the configuration. Cors, the WebSocket upgrades and SetDefaultCORSConfig compile the origins of
+// their configuration once if Init was not called; otherwise origins are compiled for every request.
 func (config *CORSConfig) Init() {
 	config.cachedMethods = make(map[string]struct{})
 	for _, method := range config.ExemptMethods {
 		config.cachedMethods[method] = struct{}{}
 	}
+	config.origins = newOriginMatcher(config)
+}
+
+// AllowsOrigin reports whether the policy allows origin. An empty origin is only allowed by "*".
+func (config *CORSConfig) AllowsOrigin(origin string) bool {
+	return config.matcher().match(origin)
+}
+
+// compile compiles the allowed origins unless Init already has. It must not be called while
+// the configuration is in use.
+func (config *CORSConfig) compile() {
+	if config.origins == nil {
+		config.origins = newOriginMatcher(config)
+	}
+}
+
+func (config *CORSConfig) matcher() *originMatcher {
+	if config.origins != nil {
+		return config.origins
+	}
+	return newOriginMatcher(config)
+}
+
+// originMatcher matches origins against the allowed origins of a CORSConfig.
+type originMatcher struct {
+	any       bool
+	exact     map[string]struct{}
+	wildcards [][2]string // prefix and suffix around "*"
+	patterns  []*regexp.Regexp
+	fn        func(origin string) bool
+}
+
+func newOriginMatcher(config *CORSConfig) *originMatcher {
+	m := &originMatcher{exact: make(map[string]struct{}), fn: config.AllowOriginFunc}
+	entries := config.AllowOrigins
+	if config.AllowOrigin != "" {
+		entries = append([]string{config.AllowOrigin}, entries...)
+	}
+	for _, entry := range entries {
+		switch {
+		case entry == "*":
+			m.any = true
+		case strings.HasPrefix(entry, "^"):
+			pattern, err := regexp.Compile("^(?:" + entry + ")$")
+			if err != nil {
+				log.Error().Err(err).Str("pattern", entry).Msg("invalid CORS origin pattern")
+				continue
+			}
+			m.patterns = append(m.patterns, pattern)
+		case strings.Count(entry, "*") == 1:
+			prefix, suffix, _ := strings.Cut(strings.ToLower(entry), "*")
+			m.wildcards = append(m.wildcards, [2]string{prefix, suffix})
+		default:
+			m.exact[strings.ToLower(entry)] = struct{}{}
+		}
+	}
+	return m
+}
+
+func (m *originMatcher) match(origin string) bool {
+	if m.any {
+		return true
+	}
+	if origin == "" {
+		return false
+	}
+	lower := strings.ToLower(origin)
+	if _, ok := m.exact[lower]; ok {
+		return true
+	}
+	for _, w := range m.wildcards {
+		// The wildcard stands for one or more subdomain labels, never for a port or a path
+		if len(lower) > len(w[0])+len(w[1]) && strings.HasPrefix(lower, w[0]) && strings.HasSuffix(lower, w[1]) {
+			if label := lower[len(w[0]) : len(lower)-len(w[1])]; !strings.ContainsAny(label, ":/@") {
+				return true
+			}
+		}
+	}
+	for _, pattern := range m.patterns {
+		if pattern.MatchString(origin) {
+			return true
+		}
+	}
+	return m.fn != nil && m.fn(origin)
 }
 
 func (config *CORSConfig) SkipMethod(method string) bool {
@@ -44,6 +146,7 @@ func init() {
 }
 
 func SetDefaultCORSConfig(config *CORSConfig) {
+	config.compile()
 	defaultCORSConfig = config
 }
 
@@ -53,6 +156,7 @@ func Cors(config *CORSConfig) HandlerFunc {
 	if config == nil {
 		config = defaultCORSConfig
 	}
+	config.compile()
 	return func(next http.HandlerFunc) http.HandlerFunc {
 		return corsHandler(config, next)
 	}
@@ -65,63 +169,156 @@ func CorsHandler(next http.HandlerFunc) http.HandlerFunc {
 }
 
 // corsHandler is the actual CORS middleware implementation.
-func corsHandler(config *CORSConfig, next http.HandlerFunc) http.HandlerFunc {
+// A resolved tenant's CORS configuration takes precedence over config.
+func corsHandler(defaultConfig *CORSConfig, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Set CORS headers
-		if config.AllowOrigin != "" {
-			origin := r.Header.Get("Origin")
-			// When allowing credentials, we must set the specific origin rather than "*" if origin is provided
-			if config.AllowCredentials && config.AllowOrigin == "*" && origin != "" {
-				w.Header().Set("Access-Control-Allow-Origin", origin)
-			} else {
-				w.Header().Set("Access-Control-Allow-Origin", config.AllowOrigin)
-			}
-			// Add Vary header when we have a specific origin pattern
-			if config.AllowOrigin != "*" {
-				w.Header().Set("Vary", "Origin")
-			}
-		} else {
-			w.Header().Set("Access-Control-Allow-Origin", "null")
+		config := defaultConfig
+		if tenant, ok := TenantFromContext(r.Context()); ok && tenant.CORS != nil {
+			config = tenant.CORS
 		}
-
-		// Handle credentials
-		if config.AllowCredentials {
-			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		// Handle preflight requests
+		if isPreflight(r) {
+			config.preflight(w, r)
+			return
 		}
 
-		// Handle methods
-		if config.AllowMethods != "" {
-			w.Header().Set("Access-Control-Allow-Methods", config.AllowMethods)
+		if allowOrigin := config.allowOrigin(w, r); allowOrigin != "" {
+			config.setHeaders(w, r, allowOrigin)
 		}
+		next(w, r)
+	}
+}
 
-		// Handle headers
-		if config.AllowHeaders != "" {
-			w.Header().Set("Access-Control-Allow-Headers", config.AllowHeaders)
-		}
+// allowOrigin returns the Access-Control-Allow-Origin value for the request, or "" if its origin
+// is not allowed. Only the matched origin is echoed, and Vary tells caches that the response
+// depends on it. With credentials "*" is not honored, so the origin itself is echoed then.
+func (config *CORSConfig) allowOrigin(w http.ResponseWriter, r *http.Request) string {
+	origins := config.matcher()
+	if origins.any && !config.AllowCredentials {
+		return "*"
+	}
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" || !origins.match(origin) {
+		return ""
+	}
+	return origin
+}
 
-		// Handle exposed headers
-		if config.ExposeHeaders != "" {
-			w.Header().Set("Access-Control-Expose-Headers", config.ExposeHeaders)
-		}
+// setHeaders sets the CORS headers of a request from an allowed origin.
+func (config *CORSConfig) setHeaders(w http.ResponseWriter, r *http.Request, allowOrigin string) {
+	w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+
+	// Handle credentials
+	if config.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	// Handle methods
+	if config.AllowMethods != "" {
+		w.Header().Set("Access-Control-Allow-Methods", config.AllowMethods)
+	}
+
+	// Handle headers
+	if config.AllowHeaders != "" {
+		w.Header().Set("Access-Control-Allow-Headers", config.AllowHeaders)
+	}
+
+	// Handle exposed headers
+	if config.ExposeHeaders != "" {
+		w.Header().Set("Access-Control-Expose-Headers", config.ExposeHeaders)
+	}
+
+	// Handle max age
+	if config.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(config.MaxAge))
+	}
+
+	// Handle WebSocket upgrade requests
+	if r.Header.Get("Upgrade") == "websocket" {
+		// Ensure WebSocket requests allow necessary WebSocket headers
+		w.Header().Set("Access-Control-Allow-Headers",
+			config.AllowHeaders+", Sec-WebSocket-Key, Sec-WebSocket-Protocol, Sec-WebSocket-Version")
+	}
+}
+
+// isPreflight reports whether r is a CORS preflight request rather than a plain OPTIONS request.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
 
-		// Handle max age
-		if config.MaxAge > 0 {
-			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(config.MaxAge))
+// preflight answers a preflight request with 204 if its origin, method and headers are allowed,
+// and with ForbiddenResponse otherwise. AllowMethods and AllowHeaders of "*" reflect the requested
+// method and headers, because browsers do not honor "*" with credentials, nor for Authorization.
+func (config *CORSConfig) preflight(w http.ResponseWriter, r *http.Request) {
+	allowOrigin := config.allowOrigin(w, r)
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+	method := r.Header.Get("Access-Control-Request-Method")
+	headers := splitHeaderList(r.Header.Values("Access-Control-Request-Headers"))
+	if allowOrigin == "" || !config.allowsMethod(method) || !config.allowsHeaders(headers) {
+		ForbiddenResponse.Write(w)
+		return
+	}
+
+	config.setHeaders(w, r, allowOrigin)
+	if config.AllowMethods == "*" {
+		w.Header().Set("Access-Control-Allow-Methods", method)
+	}
+	if config.AllowHeaders == "*" {
+		if len(headers) > 0 {
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+		} else {
+			w.Header().Del("Access-Control-Allow-Headers")
 		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-		// Handle WebSocket upgrade requests
-		if r.Header.Get("Upgrade") == "websocket" {
-			// Ensure WebSocket requests allow necessary WebSocket headers
-			w.Header().Set("Access-Control-Allow-Headers",
-				config.AllowHeaders+", Sec-WebSocket-Key, Sec-WebSocket-Protocol, Sec-WebSocket-Version")
+// allowsMethod reports whether AllowMethods allows method. The CORS-safelisted methods GET, HEAD
+// and POST are always allowed.
+func (config *CORSConfig) allowsMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost:
+		return true
+	}
+	for _, allowed := range splitHeaderList([]string{config.AllowMethods}) {
+		if allowed == "*" || allowed == method {
+			return true
 		}
+	}
+	return false
+}
 
-		// Handle preflight requests
-		if config.SkipMethod(r.Method) {
-			w.WriteHeader(http.StatusOK)
-			return
+// allowsHeaders reports whether AllowHeaders allows every header of a preflight request.
+func (config *CORSConfig) allowsHeaders(headers []string) bool {
+	allowed := splitHeaderList([]string{config.AllowHeaders})
+	for _, header := range headers {
+		ok := false
+		for _, a := range allowed {
+			if a == "*" || strings.EqualFold(a, header) {
+				ok = true
+				break
+			}
 		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
 
-		next(w, r)
+// splitHeaderList splits comma-separated header values, dropping empty elements.
+func splitHeaderList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			if element = strings.TrimSpace(element); element != "" {
+				list = append(list, element)
+			}
+		}
 	}
+	return list
 }
@@ -3,6 +3,7 @@ package possum
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -204,3 +205,295 @@ func TestCors(t *testing.T) {
 		})
 	}
 }
+
+// TestCORSAllowsOrigin tests exact, wildcard, regex and predicate origin matching.
+func TestCORSAllowsOrigin(t *testing.T) {
+	config := CORSConfig{
+		AllowOrigin:     "https://example.com",
+		AllowOrigins:    []string{"https://*.example.com", "http://localhost:3000", `^https://(app|admin)\.example\.org$`, `^https://[a-z]+\.example\.net`, "^(invalid"},
+		AllowOriginFunc: func(origin string) bool { return strings.HasSuffix(origin, ".trusted.net") },
+	}
+
+	tests := []struct {
+		origin   string
+		expected bool
+	}{
+		{origin: "https://example.com", expected: true},
+		{origin: "HTTPS://Example.com", expected: true},
+		{origin: "https://example.com.evil.net", expected: false},
+		{origin: "https://evilexample.com", expected: false},
+		{origin: "http://example.com", expected: false},
+		{origin: "https://api.example.com", expected: true},
+		{origin: "https://a.b.example.com", expected: true},
+		{origin: "https://.example.com", expected: false},
+		{origin: "http://api.example.com", expected: false},
+		{origin: "https://api.example.com:8443", expected: false},
+		{origin: "https://evil.net:1@x.example.com", expected: false},
+		{origin: "http://localhost:3000", expected: true},
+		{origin: "http://localhost:3001", expected: false},
+		{origin: "https://admin.example.org", expected: true},
+		{origin: "https://admin.example.org.evil.net", expected: false},
+		{origin: "https://app.example.net", expected: true},
+		{origin: "https://app.example.net.evil.com", expected: false},
+		{origin: "https://ci.trusted.net", expected: true},
+		{origin: "", expected: false},
+		{origin: "null", expected: false},
+	}
+	for _, initialized := range []bool{false, true} {
+		if initialized {
+			config.Init()
+		}
+		for _, tc := range tests {
+			if got := config.AllowsOrigin(tc.origin); got != tc.expected {
+				t.Errorf("AllowsOrigin(%q) with Init=%t: expected %t, got %t", tc.origin, initialized, tc.expected, got)
+			}
+		}
+	}
+
+	anyOrigin := CORSConfig{AllowOrigins: []string{"https://example.com", "*"}}
+	if !anyOrigin.AllowsOrigin("https://other.com") || !anyOrigin.AllowsOrigin("") {
+		t.Error("Expected * to allow every origin")
+	}
+	if (&CORSConfig{}).AllowsOrigin("https://example.com") {
+		t.Error("Expected an empty policy to allow no origin")
+	}
+}
+
+// TestCORSCompileOnce tests that middlewares compile the origins of configurations without Init once.
+func TestCORSCompileOnce(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(config *CORSConfig)
+	}{
+		{
+			name:  "Cors",
+			setup: func(config *CORSConfig) { Cors(config) },
+		},
+		{
+			name:  "WebSocket upgrade",
+			setup: func(config *CORSConfig) { WebSocketUpgrade(config, func(*WebSocketConn, *http.Request) {}) },
+		},
+		{
+			name: "Tenant",
+			setup: func(config *CORSConfig) {
+				Tenant(TenantMap{"acme": {ID: "acme", CORS: config}}, TenantFromHeader("X-Tenant-ID"))
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := &CORSConfig{AllowOrigins: []string{`^https://[a-z]+\.example\.com`}}
+			tc.setup(config)
+			compiled := config.origins
+			if compiled == nil {
+				t.Fatal("Expected the origins to be compiled")
+			}
+			if !config.AllowsOrigin("https://app.example.com") || config.origins != compiled {
+				t.Error("Expected requests to use the compiled origins")
+			}
+		})
+	}
+}
+
+// TestCorsOrigin tests that only the matched origin is echoed, with Vary: Origin.
+func TestCorsOrigin(t *testing.T) {
+	tests := []struct {
+		name           string
+		config         *CORSConfig
+		origin         string
+		expectedOrigin string
+		expectedVary   string
+	}{
+		{
+			name:           "Listed origin",
+			config:         &CORSConfig{AllowOrigins: []string{"https://a.com", "https://*.b.com"}},
+			origin:         "https://x.b.com",
+			expectedOrigin: "https://x.b.com",
+			expectedVary:   "Origin",
+		},
+		{
+			name:         "Unlisted origin",
+			config:       &CORSConfig{AllowOrigins: []string{"https://a.com"}},
+			origin:       "https://a.com.evil.net",
+			expectedVary: "Origin",
+		},
+		{
+			name:           "Any origin",
+			config:         &CORSConfig{AllowOrigins: []string{"*"}},
+			origin:         "https://a.com",
+			expectedOrigin: "*",
+		},
+		{
+			name:           "Any origin with credentials",
+			config:         &CORSConfig{AllowOrigins: []string{"*"}, AllowCredentials: true},
+			origin:         "https://a.com",
+			expectedOrigin: "https://a.com",
+			expectedVary:   "Origin",
+		},
+		{
+			name:         "No origin",
+			config:       &CORSConfig{AllowOrigins: []string{"*"}, AllowCredentials: true},
+			expectedVary: "Origin",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.config.Init()
+			called := false
+			handler := Cors(tc.config)(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			})
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.origin != "" {
+				req.Header.Set("Origin", tc.origin)
+			}
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+
+			if got := rr.Header().Get("Access-Control-Allow-Origin"); got != tc.expectedOrigin {
+				t.Errorf("Expected origin %q, got %q", tc.expectedOrigin, got)
+			}
+			if got := rr.Header().Get("Vary"); got != tc.expectedVary {
+				t.Errorf("Expected Vary %q, got %q", tc.expectedVary, got)
+			}
+			if tc.expectedOrigin == "" && rr.Header().Get("Access-Control-Allow-Credentials") != "" {
+				t.Error("Expected no CORS headers for a disallowed origin")
+			}
+			if !called {
+				t.Error("Expected the request to reach the handler")
+			}
+		})
+	}
+}
+
+// TestCorsPreflight tests preflight detection and the validation of the requested method and headers.
+func TestCorsPreflight(t *testing.T) {
+	listed := &CORSConfig{
+		AllowOrigins:  []string{"https://a.com"},
+		AllowMethods:  "PUT, DELETE",
+		AllowHeaders:  "Content-Type, X-Request-ID",
+		ExposeHeaders: "X-Request-ID",
+		MaxAge:        600,
+	}
+	wildcard := &CORSConfig{
+		AllowOrigins:     []string{"https://a.com"},
+		AllowMethods:     "*",
+		AllowHeaders:     "*",
+		AllowCredentials: true,
+	}
+
+	tests := []struct {
+		name            string
+		config          *CORSConfig
+		origin          string
+		method          string
+		headers         []string
+		expectedStatus  int
+		expectedHeaders map[string]string
+	}{
+		{
+			name:           "Allowed",
+			config:         listed,
+			origin:         "https://a.com",
+			method:         "PUT",
+			headers:        []string{"x-request-id, content-type"},
+			expectedStatus: http.StatusNoContent,
+			expectedHeaders: map[string]string{
+				"Access-Control-Allow-Origin":  "https://a.com",
+				"Access-Control-Allow-Methods": "PUT, DELETE",
+				"Access-Control-Allow-Headers": "Content-Type, X-Request-ID",
+				"Access-Control-Max-Age":       "600",
+			},
+		},
+		{
+			name:           "Safelisted method",
+			config:         listed,
+			origin:         "https://a.com",
+			method:         "POST",
+			headers:        []string{"Content-Type"},
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "Method not allowed",
+			config:         listed,
+			origin:         "https://a.com",
+			method:         "PATCH",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Header not allowed",
+			config:         listed,
+			origin:         "https://a.com",
+			method:         "PUT",
+			headers:        []string{"Content-Type", "X-Secret"},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Origin not allowed",
+			config:         listed,
+			origin:         "https://b.com",
+			method:         "PUT",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Wildcards with credentials reflect the request",
+			config:         wildcard,
+			origin:         "https://a.com",
+			method:         "PATCH",
+			headers:        []string{"Authorization,X-Trace"},
+			expectedStatus: http.StatusNoContent,
+			expectedHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "https://a.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Allow-Methods":     "PATCH",
+				"Access-Control-Allow-Headers":     "Authorization, X-Trace",
+			},
+		},
+		{
+			name:           "Plain OPTIONS",
+			config:         listed,
+			origin:         "https://a.com",
+			expectedStatus: http.StatusOK,
+			expectedHeaders: map[string]string{
+				"Access-Control-Allow-Origin": "https://a.com",
+				"Allow":                       "GET, OPTIONS",
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.config.Init()
+			handler := Cors(tc.config)(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Allow", "GET, OPTIONS")
+				w.WriteHeader(http.StatusOK)
+			})
+			req := httptest.NewRequest(http.MethodOptions, "/", nil)
+			req.Header.Set("Origin", tc.origin)
+			if tc.method != "" {
+				req.Header.Set("Access-Control-Request-Method", tc.method)
+			}
+			for _, h := range tc.headers {
+				req.Header.Add("Access-Control-Request-Headers", h)
+			}
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d", tc.expectedStatus, rr.Code)
+			}
+			for key, expected := range tc.expectedHeaders {
+				if got := rr.Header().Get(key); got != expected {
+					t.Errorf("Expected header %s to be %q, got %q", key, expected, got)
+				}
+			}
+			if tc.expectedStatus == http.StatusForbidden && rr.Header().Get("Access-Control-Allow-Origin") != "" {
+				t.Error("Expected no CORS headers for a rejected preflight")
+			}
+			if tc.method != "" {
+				if vary := strings.Join(rr.Header().Values("Vary"), ", "); vary != "Origin, Access-Control-Request-Method, Access-Control-Request-Headers" {
+					t.Errorf("Unexpected Vary %q", vary)
+				}
+			}
+		})
+	}
+}
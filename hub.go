@@ -0,0 +1,341 @@
+package possum
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"github.com/mikespook/possum/auth"
+	"github.com/mikespook/possum/log"
+)
+
+var (
+	ErrNotRegistered = errors.New("websocket connection not registered")
+)
+
+// hubClient is the hub's bookkeeping for one connection.
+type hubClient struct {
+	userID uuid.UUID
+	rooms  map[string]struct{}
+	stop   func() bool
+}
+
+// Hub tracks WebSocket connections, their users and the rooms they joined, and broadcasts
+// messages to them. Connections leave the hub and all of their rooms when they disconnect.
+// All methods are safe for concurrent use.
+type Hub struct {
+	id      string
+	mu      sync.RWMutex
+	clients map[*WebSocketConn]*hubClient
+	ids     map[string]*WebSocketConn
+	rooms   map[string]map[*WebSocketConn]struct{}
+	users   map[uuid.UUID]map[*WebSocketConn]struct{}
+
+	backplane   Backplane
+	unsubscribe func()
+	presence    *Presence
+}
+
+// NewHub creates an empty hub.
+func NewHub() *Hub {
+	return &Hub{
+		id:      uuid.NewString(),
+		clients: make(map[*WebSocketConn]*hubClient),
+		ids:     make(map[string]*WebSocketConn),
+		rooms:   make(map[string]map[*WebSocketConn]struct{}),
+		users:   make(map[uuid.UUID]map[*WebSocketConn]struct{}),
+	}
+}
+
+// Handler is a WebsocketMiddleware registering each connection with the hub before calling next.
+// It must run after WebSocketAuth for connections to be associated with their user.
+func (h *Hub) Handler(next WebsocketHandlerFunc) WebsocketHandlerFunc {
+	return func(conn *WebSocketConn, r *http.Request) {
+		h.Register(conn)
+		defer h.Unregister(conn)
+		next(conn, r)
+	}
+}
+
+// Register adds a connection to the hub. The connection is associated with the user of the
+// claims in its context, if any, and is unregistered automatically when it disconnects.
+func (h *Hub) Register(conn *WebSocketConn) {
+	ctx := conn.Context()
+	client := &hubClient{rooms: make(map[string]struct{})}
+	if claims, ok := ctx.Value(ClaimsKey).(*auth.JWTClaims); ok {
+		client.userID = claims.UserID
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.clients[conn]; ok {
+		return
+	}
+	h.clients[conn] = client
+	h.ids[conn.ID()] = conn
+	if client.userID != uuid.Nil {
+		addMember(h.users, client.userID, conn)
+		if h.presence != nil {
+			h.presence.enter(client.userID, "")
+		}
+	}
+	// AfterFunc runs in its own goroutine, so it waits for the lock to be released
+	client.stop = context.AfterFunc(ctx, func() {
+		h.Unregister(conn)
+	})
+}
+
+// Unregister removes a connection from the hub and all of its rooms.
+func (h *Hub) Unregister(conn *WebSocketConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	client, ok := h.clients[conn]
+	if !ok {
+		return
+	}
+	client.stop()
+	for room := range client.rooms {
+		removeMember(h.rooms, room, conn)
+	}
+	if client.userID != uuid.Nil {
+		removeMember(h.users, client.userID, conn)
+		if h.presence != nil {
+			for room := range client.rooms {
+				h.presence.exit(client.userID, room)
+			}
+			h.presence.exit(client.userID, "")
+		}
+	}
+	delete(h.clients, conn)
+	delete(h.ids, conn.ID())
+}
+
+// Join adds a registered connection to a room.
+func (h *Hub) Join(conn *WebSocketConn, room string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	client, ok := h.clients[conn]
+	if !ok {
+		return ErrNotRegistered
+	}
+	if _, ok := client.rooms[room]; ok {
+		return nil
+	}
+	client.rooms[room] = struct{}{}
+	addMember(h.rooms, room, conn)
+	if client.userID != uuid.Nil && h.presence != nil {
+		h.presence.enter(client.userID, room)
+	}
+	return nil
+}
+
+// Leave removes a connection from a room.
+func (h *Hub) Leave(conn *WebSocketConn, room string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	client, ok := h.clients[conn]
+	if !ok {
+		return
+	}
+	if _, joined := client.rooms[room]; !joined {
+		return
+	}
+	delete(client.rooms, room)
+	removeMember(h.rooms, room, conn)
+	if client.userID != uuid.Nil && h.presence != nil {
+		h.presence.exit(client.userID, room)
+	}
+}
+
+// Rooms returns the rooms a connection has joined.
+func (h *Hub) Rooms(conn *WebSocketConn) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	client, ok := h.clients[conn]
+	if !ok {
+		return nil
+	}
+	rooms := make([]string, 0, len(client.rooms))
+	for room := range client.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// Conn returns the registered connection with the given ID.
+func (h *Hub) Conn(id string) (*WebSocketConn, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	conn, ok := h.ids[id]
+	return conn, ok
+}
+
+// Len returns the number of registered connections.
+func (h *Hub) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients)
+}
+
+// RoomLen returns the number of connections in a room.
+func (h *Hub) RoomLen(room string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.rooms[room])
+}
+
+// setPresence replaces the presence tracking the hub, entering the connections already
+// registered, and returns the previous one.
+func (h *Hub) setPresence(p *Presence) *Presence {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	previous := h.presence
+	h.presence = p
+	for _, client := range h.clients {
+		if client.userID == uuid.Nil {
+			continue
+		}
+		p.enter(client.userID, "")
+		for room := range client.rooms {
+			p.enter(client.userID, room)
+		}
+	}
+	return previous
+}
+
+// removePresence stops the hub from updating p, unless another presence replaced it.
+func (h *Hub) removePresence(p *Presence) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.presence == p {
+		h.presence = nil
+	}
+}
+
+// UseBackplane relays the broadcasts of the hub to the hubs of other nodes through bp and
+// delivers theirs locally. It replaces the previous backplane; nil detaches the hub.
+func (h *Hub) UseBackplane(bp Backplane) error {
+	var unsubscribe func()
+	if bp != nil {
+		var err error
+		if unsubscribe, err = bp.Subscribe(h.receive); err != nil {
+			return err
+		}
+	}
+	h.mu.Lock()
+	previous := h.unsubscribe
+	h.backplane, h.unsubscribe = bp, unsubscribe
+	h.mu.Unlock()
+	if previous != nil {
+		previous()
+	}
+	return nil
+}
+
+// Broadcast sends a message to every registered connection and returns the number of local
+// connections it was queued for. Connections with a full send queue are skipped.
+func (h *Hub) Broadcast(messageType int, data []byte) int {
+	return h.publish(&BackplaneMessage{Target: BroadcastAll, MessageType: messageType, Data: data})
+}
+
+// BroadcastRoom sends a message to every connection in a room.
+func (h *Hub) BroadcastRoom(room string, messageType int, data []byte) int {
+	return h.publish(&BackplaneMessage{Target: BroadcastRoom, Key: room, MessageType: messageType, Data: data})
+}
+
+// BroadcastUser sends a message to every connection of a user.
+func (h *Hub) BroadcastUser(userID uuid.UUID, messageType int, data []byte) int {
+	return h.publish(&BackplaneMessage{Target: BroadcastUser, Key: userID.String(), MessageType: messageType, Data: data})
+}
+
+// BroadcastJSON encodes v as JSON and sends it as a text message to every registered connection.
+func (h *Hub) BroadcastJSON(v any) (int, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	return h.Broadcast(websocket.TextMessage, data), nil
+}
+
+// publish delivers msg locally and relays it through the backplane.
+func (h *Hub) publish(msg *BackplaneMessage) int {
+	msg.Origin = h.id
+	sent := h.deliver(msg)
+	h.mu.RLock()
+	bp := h.backplane
+	h.mu.RUnlock()
+	if bp != nil {
+		if err := bp.Publish(msg); err != nil {
+			log.Error().Err(err).Str("target", msg.Target).Str("key", msg.Key).Msg("backplane publish failed")
+		}
+	}
+	return sent
+}
+
+// receive delivers the broadcasts of other hubs.
+func (h *Hub) receive(msg *BackplaneMessage) {
+	if msg.Origin == h.id {
+		return
+	}
+	h.deliver(msg)
+}
+
+// deliver queues msg for the local connections it targets.
+func (h *Hub) deliver(msg *BackplaneMessage) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	switch msg.Target {
+	case BroadcastAll:
+		sent := 0
+		for conn := range h.clients {
+			if conn.Send(msg.MessageType, msg.Data) == nil {
+				sent++
+			}
+		}
+		return sent
+	case BroadcastRoom:
+		return sendAll(h.rooms[msg.Key], msg.MessageType, msg.Data)
+	case BroadcastUser:
+		userID, err := uuid.Parse(msg.Key)
+		if err != nil {
+			return 0
+		}
+		return sendAll(h.users[userID], msg.MessageType, msg.Data)
+	}
+	return 0
+}
+
+func sendAll(conns map[*WebSocketConn]struct{}, messageType int, data []byte) int {
+	sent := 0
+	for conn := range conns {
+		if conn.Send(messageType, data) == nil {
+			sent++
+		}
+	}
+	return sent
+}
+
+func addMember[K comparable](groups map[K]map[*WebSocketConn]struct{}, key K, conn *WebSocketConn) {
+	members, ok := groups[key]
+	if !ok {
+		members = make(map[*WebSocketConn]struct{})
+		groups[key] = members
+	}
+	members[conn] = struct{}{}
+}
+
+func removeMember[K comparable](groups map[K]map[*WebSocketConn]struct{}, key K, conn *WebSocketConn) {
+	members, ok := groups[key]
+	if !ok {
+		return
+	}
+	delete(members, conn)
+	if len(members) == 0 {
+		delete(groups, key)
+	}
+}
@@ -0,0 +1,250 @@
+package possum
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"github.com/mikespook/possum/auth"
+)
+
+// newHubServer starts a server registering connections with hub. Clients join the rooms listed in
+// the room query parameter and receive "ready" once they have been registered.
+func newHubServer(t *testing.T, secret []byte, hub *Hub) *httptest.Server {
+	t.Helper()
+	handler := WebSocketAuth(secret, hub.Handler(func(conn *WebSocketConn, r *http.Request) {
+		for _, room := range r.URL.Query()["room"] {
+			if err := hub.Join(conn, room); err != nil {
+				t.Errorf("Failed to join %s: %v", room, err)
+			}
+		}
+		conn.Send(websocket.TextMessage, []byte("ready"))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	server := httptest.NewServer(WebSocketUpgradeWithConfig(&WebSocketConfig{CORS: &CORSConfig{AllowOrigin: "*"}}, handler))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// dialHub connects a client of userID joining rooms and waits until it is registered.
+func dialHub(t *testing.T, server *httptest.Server, secret []byte, userID uuid.UUID, rooms ...string) *websocket.Conn {
+	t.Helper()
+	_, token, err := auth.GenerateJWT(secret, userID, nil)
+	if err != nil {
+		t.Fatalf("Failed to create test token: %v", err)
+	}
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/?token=" + token
+	for _, room := range rooms {
+		url += "&room=" + room
+	}
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	if _, msg, err := ws.ReadMessage(); err != nil || string(msg) != "ready" {
+		t.Fatalf("Expected ready, got %q (%v)", msg, err)
+	}
+	return ws
+}
+
+// readUntil reads messages until marker and returns the ones before it. A read deadline would
+// break the connection, so a marker broadcast to everyone delimits the messages of a test case.
+func readUntil(t *testing.T, ws *websocket.Conn, marker string) []string {
+	t.Helper()
+	var messages []string
+	for {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if string(msg) == marker {
+			return messages
+		}
+		messages = append(messages, string(msg))
+	}
+}
+
+// TestHubBroadcast tests broadcasting to rooms, users and everyone.
+func TestHubBroadcast(t *testing.T) {
+	secret := []byte("test-secret")
+	hub := NewHub()
+	server := newHubServer(t, secret, hub)
+
+	alice, bob := uuid.New(), uuid.New()
+	aliceLobby := dialHub(t, server, secret, alice, "lobby")
+	aliceGames := dialHub(t, server, secret, alice, "games")
+	bobLobby := dialHub(t, server, secret, bob, "lobby", "games")
+
+	tests := []struct {
+		name      string
+		broadcast func() int
+		expected  map[*websocket.Conn]bool
+	}{
+		{
+			name:      "Room",
+			broadcast: func() int { return hub.BroadcastRoom("lobby", websocket.TextMessage, []byte("Room")) },
+			expected:  map[*websocket.Conn]bool{aliceLobby: true, bobLobby: true},
+		},
+		{
+			name:      "User",
+			broadcast: func() int { return hub.BroadcastUser(alice, websocket.TextMessage, []byte("User")) },
+			expected:  map[*websocket.Conn]bool{aliceLobby: true, aliceGames: true},
+		},
+		{
+			name:      "Everyone",
+			broadcast: func() int { return hub.Broadcast(websocket.TextMessage, []byte("Everyone")) },
+			expected:  map[*websocket.Conn]bool{aliceLobby: true, aliceGames: true, bobLobby: true},
+		},
+		{
+			name:      "Unknown room",
+			broadcast: func() int { return hub.BroadcastRoom("nowhere", websocket.TextMessage, []byte("Unknown room")) },
+			expected:  map[*websocket.Conn]bool{},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if sent := tc.broadcast(); sent != len(tc.expected) {
+				t.Errorf("Expected %d deliveries, got %d", len(tc.expected), sent)
+			}
+			hub.Broadcast(websocket.TextMessage, []byte("end"))
+			for _, ws := range []*websocket.Conn{aliceLobby, aliceGames, bobLobby} {
+				messages := readUntil(t, ws, "end")
+				if received := len(messages) == 1 && messages[0] == tc.name; received != tc.expected[ws] {
+					t.Errorf("Expected delivery %v, got %v", tc.expected[ws], messages)
+				}
+			}
+		})
+	}
+}
+
+// TestHubDisconnectCleanup tests that disconnected connections leave the hub and their rooms.
+func TestHubDisconnectCleanup(t *testing.T) {
+	secret := []byte("test-secret")
+	hub := NewHub()
+	server := newHubServer(t, secret, hub)
+
+	user := uuid.New()
+	first := dialHub(t, server, secret, user, "lobby")
+	dialHub(t, server, secret, user, "lobby")
+	if hub.Len() != 2 || hub.RoomLen("lobby") != 2 {
+		t.Fatalf("Expected 2 connections in lobby, got %d/%d", hub.Len(), hub.RoomLen("lobby"))
+	}
+
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for hub.Len() != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if hub.Len() != 1 || hub.RoomLen("lobby") != 1 {
+		t.Errorf("Expected 1 connection in lobby after disconnect, got %d/%d", hub.Len(), hub.RoomLen("lobby"))
+	}
+	if sent := hub.BroadcastUser(user, websocket.TextMessage, []byte("hi")); sent != 1 {
+		t.Errorf("Expected 1 delivery to the remaining connection, got %d", sent)
+	}
+}
+
+// TestHubJoinLeave tests room membership of a connection.
+func TestHubJoinLeave(t *testing.T) {
+	hub := NewHub()
+	conn := newWebSocketConn(nil, defaultWebSocketConfig.withDefaults(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if err := hub.Join(conn, "lobby"); err != ErrNotRegistered {
+		t.Errorf("Expected ErrNotRegistered, got %v", err)
+	}
+	hub.Register(conn)
+	hub.Join(conn, "lobby")
+	hub.Join(conn, "games")
+	hub.Leave(conn, "lobby")
+	if rooms := hub.Rooms(conn); len(rooms) != 1 || rooms[0] != "games" {
+		t.Errorf("Expected [games], got %v", rooms)
+	}
+	if hub.RoomLen("lobby") != 0 {
+		t.Errorf("Expected empty lobby, got %d", hub.RoomLen("lobby"))
+	}
+
+	// Cancelling the connection context unregisters it
+	conn.cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for hub.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if hub.Len() != 0 || hub.RoomLen("games") != 0 {
+		t.Errorf("Expected empty hub, got %d/%d", hub.Len(), hub.RoomLen("games"))
+	}
+}
+
+// benchmarkHub registers n connections whose send queues are drained without a network.
+func benchmarkHub(b *testing.B, n int) (*Hub, func()) {
+	b.Helper()
+	hub := NewHub()
+	cfg := (&WebSocketConfig{SendQueueSize: 1024}).withDefaults()
+	conns := make([]*WebSocketConn, n)
+	for i := range conns {
+		conn := newWebSocketConn(nil, cfg, httptest.NewRequest(http.MethodGet, "/", nil))
+		hub.Register(conn)
+		hub.Join(conn, fmt.Sprintf("room-%d", i%10))
+		go func() {
+			for {
+				select {
+				case <-conn.queue.notify:
+					for _, ok := conn.queue.pop(); ok; _, ok = conn.queue.pop() {
+					}
+				case <-conn.done:
+					return
+				}
+			}
+		}()
+		conns[i] = conn
+	}
+	return hub, func() {
+		for _, conn := range conns {
+			conn.cancel()
+		}
+	}
+}
+
+// BenchmarkHubBroadcast measures fan-out to every connection.
+func BenchmarkHubBroadcast(b *testing.B) {
+	data := []byte(`{"type":"tick"}`)
+	for _, n := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("conns=%d", n), func(b *testing.B) {
+			hub, stop := benchmarkHub(b, n)
+			defer stop()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				hub.Broadcast(websocket.TextMessage, data)
+			}
+			b.ReportMetric(float64(n*b.N)/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
+
+// BenchmarkHubBroadcastRoom measures fan-out to one room holding a tenth of the connections.
+func BenchmarkHubBroadcastRoom(b *testing.B) {
+	data := []byte(`{"type":"tick"}`)
+	for _, n := range []int{1000, 10000} {
+		b.Run(fmt.Sprintf("conns=%d", n), func(b *testing.B) {
+			hub, stop := benchmarkHub(b, n)
+			defer stop()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				hub.BroadcastRoom("room-0", websocket.TextMessage, data)
+			}
+			b.ReportMetric(float64(n/10*b.N)/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/mikespook/possum"
+	"github.com/mikespook/possum/config"
+)
+
+const (
+	Version = "2.0"
+
+	// Error codes defined by the JSON-RPC 2.0 specification
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+
+	// DefaultMaxBodySize is the default limit of HTTP request bodies
+	DefaultMaxBodySize = 1 << 20
+)
+
+var (
+	ErrNotificationUnsupported = errors.New("server notifications require a WebSocket connection")
+
+	// null is the ID of responses to requests whose ID could not be determined
+	null = json.RawMessage("null")
+)
+
+// Error is a JSON-RPC error object. Handlers may return one to control the code sent to the client.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Request is a JSON-RPC request. A request without an ID is a notification.
+type Request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+// Response is a JSON-RPC response.
+type Response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// HandlerFunc handles a method call with its raw params.
+type HandlerFunc func(ctx context.Context, params json.RawMessage) (any, error)
+
+// Server dispatches JSON-RPC 2.0 requests, single or batched, to registered methods.
+// It is mounted as http.Handler with ServeHTTP or as possum.WebsocketHandlerFunc with ServeWebSocket.
+type Server struct {
+	// MaxBodySize limits the body of HTTP requests; larger bodies are answered with 400 Bad Request.
+	MaxBodySize int64
+
+	mu      sync.RWMutex
+	methods map[string]HandlerFunc
+}
+
+// NewServer creates a server without methods.
+func NewServer() *Server {
+	return &Server{MaxBodySize: DefaultMaxBodySize, methods: make(map[string]HandlerFunc)}
+}
+
+// Handle registers the handler of a method.
+func (s *Server) Handle(method string, handler HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.methods[method] = handler
+}
+
+// Register registers a method whose params are decoded into P. Params that do not decode are
+// answered with CodeInvalidParams.
+func Register[P, R any](s *Server, method string, fn func(ctx context.Context, params P) (R, error)) {
+	s.Handle(method, func(ctx context.Context, raw json.RawMessage) (any, error) {
+		var params P
+		if len(raw) > 0 {
+			if err := json.Unmarshal(raw, &params); err != nil {
+				return nil, &Error{Code: CodeInvalidParams, Message: "Invalid params", Data: err.Error()}
+			}
+		}
+		return fn(ctx, params)
+	})
+}
+
+// ServeHTTP handles a POST request with a single or batch request as body. When every request
+// is a notification the response is 204 No Content.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		possum.MethodNotAllowedResponse.Write(w)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.MaxBodySize))
+	if err != nil {
+		possum.BadRequestResponse.Write(w)
+		return
+	}
+	reply := s.process(r.Context(), body)
+	if reply == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(reply)
+}
+
+// ServeWebSocket handles the requests received on a connection in order until it is closed.
+// Handlers can send notifications to the client with Notify.
+func (s *Server) ServeWebSocket(conn *possum.WebSocketConn, r *http.Request) {
+	ctx := context.WithValue(conn.Context(), connKey, conn)
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if reply := s.process(ctx, data); reply != nil {
+			conn.Send(websocket.TextMessage, reply)
+		}
+	}
+}
+
+// process handles a single or batch request and returns the encoded reply, or nil if there is none.
+func (s *Server) process(ctx context.Context, data []byte) []byte {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(data, &batch); err != nil {
+			return encode(errorResponse(null, CodeParseError, "Parse error"))
+		}
+		if len(batch) == 0 {
+			return encode(errorResponse(null, CodeInvalidRequest, "Invalid Request"))
+		}
+		responses := make([]*Response, 0, len(batch))
+		for _, raw := range batch {
+			if resp := s.call(ctx, raw); resp != nil {
+				responses = append(responses, resp)
+			}
+		}
+		if len(responses) == 0 {
+			return nil
+		}
+		return encode(responses)
+	}
+	if !json.Valid(data) {
+		return encode(errorResponse(null, CodeParseError, "Parse error"))
+	}
+	if resp := s.call(ctx, data); resp != nil {
+		return encode(resp)
+	}
+	return nil
+}
+
+// call runs a single request and returns its response, or nil for notifications.
+func (s *Server) call(ctx context.Context, raw json.RawMessage) *Response {
+	var req Request
+	if err := json.Unmarshal(raw, &req); err != nil || req.JSONRPC != Version || req.Method == "" || !validID(req.ID) {
+		id := null
+		if err == nil && req.ID != nil && validID(req.ID) {
+			id = req.ID
+		}
+		return errorResponse(id, CodeInvalidRequest, "Invalid Request")
+	}
+
+	s.mu.RLock()
+	handler, ok := s.methods[req.Method]
+	s.mu.RUnlock()
+
+	var result any
+	var err error
+	if ok {
+		result, err = handler(ctx, req.Params)
+	} else {
+		err = &Error{Code: CodeMethodNotFound, Message: "Method not found"}
+	}
+	if req.ID == nil {
+		return nil
+	}
+	if err != nil {
+		var e *Error
+		if !errors.As(err, &e) {
+			e = &Error{Code: CodeInternalError, Message: "Internal error"}
+			// The error may reveal internals, so it is only sent in debug mode
+			if config.IsDebug() {
+				e.Data = err.Error()
+			}
+		}
+		return &Response{JSONRPC: Version, Error: e, ID: req.ID}
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(req.ID, CodeInternalError, "Internal error")
+	}
+	return &Response{JSONRPC: Version, Result: data, ID: req.ID}
+}
+
+// validID reports whether an ID is absent, a string, a number or null, as the specification requires.
+func validID(id json.RawMessage) bool {
+	if id == nil {
+		return true
+	}
+	switch id[0] {
+	case '{', '[', 't', 'f':
+		return false
+	}
+	return true
+}
+
+func errorResponse(id json.RawMessage, code int, message string) *Response {
+	return &Response{JSONRPC: Version, Error: &Error{Code: code, Message: message}, ID: id}
+}
+
+func encode(v any) []byte {
+	data, _ := json.Marshal(v)
+	return data
+}
+
+type contextKey string
+
+const connKey = contextKey("conn")
+
+// Notify sends a server-to-client notification on the WebSocket connection the request of ctx
+// arrived on. It returns ErrNotificationUnsupported for HTTP requests.
+func Notify(ctx context.Context, method string, params any) error {
+	conn, ok := ctx.Value(connKey).(*possum.WebSocketConn)
+	if !ok {
+		return ErrNotificationUnsupported
+	}
+	return NotifyConn(conn, method, params)
+}
+
+// NotifyConn sends a notification to a connection served by ServeWebSocket, e.g. from a hub.
+func NotifyConn(conn *possum.WebSocketConn, method string, params any) error {
+	req := &Request{JSONRPC: Version, Method: method}
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		req.Params = data
+	}
+	return conn.SendJSON(req)
+}
@@ -0,0 +1,267 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/mikespook/possum"
+	"github.com/mikespook/possum/config"
+)
+
+// newTestServer creates a server with the methods of the specification examples.
+func newTestServer() *Server {
+	s := NewServer()
+	Register(s, "subtract", func(ctx context.Context, params []int) (int, error) {
+		if len(params) != 2 {
+			return 0, &Error{Code: CodeInvalidParams, Message: "Invalid params"}
+		}
+		return params[0] - params[1], nil
+	})
+	Register(s, "sum", func(ctx context.Context, params []int) (int, error) {
+		sum := 0
+		for _, n := range params {
+			sum += n
+		}
+		return sum, nil
+	})
+	Register(s, "notify_hello", func(ctx context.Context, params []int) (any, error) {
+		return nil, nil
+	})
+	Register(s, "fail", func(ctx context.Context, params any) (any, error) {
+		return nil, errors.New("boom")
+	})
+	return s
+}
+
+// TestServeHTTP tests the examples of the JSON-RPC 2.0 specification over HTTP.
+func TestServeHTTP(t *testing.T) {
+	s := newTestServer()
+
+	tests := []struct {
+		name           string
+		method         string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Positional parameters",
+			body:           `{"jsonrpc": "2.0", "method": "subtract", "params": [42, 23], "id": 1}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"jsonrpc":"2.0","result":19,"id":1}`,
+		},
+		{
+			name:           "Null result",
+			body:           `{"jsonrpc": "2.0", "method": "notify_hello", "params": [7], "id": "a"}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"jsonrpc":"2.0","result":null,"id":"a"}`,
+		},
+		{
+			name:           "Notification",
+			body:           `{"jsonrpc": "2.0", "method": "notify_hello", "params": [7]}`,
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "Method not found",
+			body:           `{"jsonrpc": "2.0", "method": "foobar", "id": "1"}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found"},"id":"1"}`,
+		},
+		{
+			name:           "Invalid params",
+			body:           `{"jsonrpc": "2.0", "method": "subtract", "params": {"a": 1}, "id": 2}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"jsonrpc":"2.0","error":{"code":-32602,"message":"Invalid params"},"id":2}`,
+		},
+		{
+			name:           "Internal error",
+			body:           `{"jsonrpc": "2.0", "method": "fail", "id": 3}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"jsonrpc":"2.0","error":{"code":-32603,"message":"Internal error"},"id":3}`,
+		},
+		{
+			name:           "Parse error",
+			body:           `{"jsonrpc": "2.0", "method": "foobar, "params": "bar", "baz]`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"jsonrpc":"2.0","error":{"code":-32700,"message":"Parse error"},"id":null}`,
+		},
+		{
+			name:           "Invalid request",
+			body:           `{"jsonrpc": "2.0", "method": 1, "params": "bar"}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`,
+		},
+		{
+			name:           "Empty batch",
+			body:           `[]`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`,
+		},
+		{
+			name:           "Invalid batch",
+			body:           `[1,2]`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `[{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null},{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}]`,
+		},
+		{
+			name: "Batch",
+			body: `[
+				{"jsonrpc": "2.0", "method": "sum", "params": [1,2,4], "id": "1"},
+				{"jsonrpc": "2.0", "method": "notify_hello", "params": [7]},
+				{"jsonrpc": "2.0", "method": "subtract", "params": [42,23], "id": "2"},
+				{"foo": "boo"},
+				{"jsonrpc": "2.0", "method": "foo.get", "params": {"name": "myself"}, "id": "5"}
+			]`,
+			expectedStatus: http.StatusOK,
+			expectedBody: `[{"jsonrpc":"2.0","result":7,"id":"1"},{"jsonrpc":"2.0","result":19,"id":"2"},` +
+				`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null},` +
+				`{"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found"},"id":"5"}]`,
+		},
+		{
+			name:           "Batch of notifications",
+			body:           `[{"jsonrpc": "2.0", "method": "notify_hello", "params": [1]}, {"jsonrpc": "2.0", "method": "notify_hello", "params": [2]}]`,
+			expectedStatus: http.StatusNoContent,
+		},
+		{
+			name:           "Method not allowed",
+			method:         http.MethodGet,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:           "Body too large",
+			body:           `[` + strings.Repeat(" ", DefaultMaxBodySize) + `]`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			method := tc.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			req := httptest.NewRequest(method, "/rpc", strings.NewReader(tc.body))
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, req)
+
+			if w.Code != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tc.expectedStatus, w.Code)
+			}
+			if tc.expectedBody != "" {
+				body := w.Body.String()
+				if tc.name == "Invalid params" || tc.name == "Internal error" {
+					// Drop the error details, checked by TestInternalErrorData
+					var resp Response
+					json.Unmarshal(w.Body.Bytes(), &resp)
+					resp.Error.Data = nil
+					data, _ := json.Marshal(&resp)
+					body = string(data)
+				}
+				if body != tc.expectedBody {
+					t.Errorf("Expected body %s, got %s", tc.expectedBody, body)
+				}
+			}
+		})
+	}
+}
+
+// TestInternalErrorData tests that the messages of handler errors are only sent in debug mode.
+func TestInternalErrorData(t *testing.T) {
+	resp := newTestServer().call(context.Background(), json.RawMessage(`{"jsonrpc": "2.0", "method": "fail", "id": 1}`))
+	if config.IsDebug() {
+		if resp.Error.Data != "boom" {
+			t.Errorf("Expected the error message in debug mode, got %v", resp.Error.Data)
+		}
+	} else if resp.Error.Data != nil {
+		t.Errorf("Expected no error details, got %v", resp.Error.Data)
+	}
+}
+
+// TestServeHTTPChain tests that the server composes with possum middlewares.
+func TestServeHTTPChain(t *testing.T) {
+	handler := possum.Chain(newTestServer().ServeHTTP, possum.Log, possum.AllowMethods(http.MethodPost))
+	req := httptest.NewRequest(http.MethodPost, "/rpc", strings.NewReader(`{"jsonrpc":"2.0","method":"sum","params":[1,2],"id":1}`))
+	w := httptest.NewRecorder()
+	handler(w, req)
+	if w.Body.String() != `{"jsonrpc":"2.0","result":3,"id":1}` {
+		t.Errorf("Unexpected body %s", w.Body.String())
+	}
+}
+
+// TestServeWebSocket tests calls and server-to-client notifications over WebSocket.
+func TestServeWebSocket(t *testing.T) {
+	s := newTestServer()
+	Register(s, "subscribe", func(ctx context.Context, params []string) (bool, error) {
+		for _, topic := range params {
+			if err := Notify(ctx, "update", map[string]string{"topic": topic}); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+	server := httptest.NewServer(possum.WebSocketUpgradeWithConfig(&possum.WebSocketConfig{
+		CORS: &possum.CORSConfig{AllowOrigin: "*"},
+	}, s.ServeWebSocket))
+	defer server.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer ws.Close()
+
+	tests := []struct {
+		name     string
+		request  string
+		expected []string
+	}{
+		{
+			name:     "Call",
+			request:  `{"jsonrpc":"2.0","method":"subtract","params":[5,3],"id":1}`,
+			expected: []string{`{"jsonrpc":"2.0","result":2,"id":1}`},
+		},
+		{
+			name:    "Notifications before the response",
+			request: `{"jsonrpc":"2.0","method":"subscribe","params":["a","b"],"id":2}`,
+			expected: []string{
+				`{"jsonrpc":"2.0","method":"update","params":{"topic":"a"}}`,
+				`{"jsonrpc":"2.0","method":"update","params":{"topic":"b"}}`,
+				`{"jsonrpc":"2.0","result":true,"id":2}`,
+			},
+		},
+		{
+			name:     "Batch",
+			request:  `[{"jsonrpc":"2.0","method":"sum","params":[1,1],"id":3},{"jsonrpc":"2.0","method":"notify_hello"}]`,
+			expected: []string{`[{"jsonrpc":"2.0","result":2,"id":3}]`},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := ws.WriteMessage(websocket.TextMessage, []byte(tc.request)); err != nil {
+				t.Fatalf("Failed to write: %v", err)
+			}
+			for _, expected := range tc.expected {
+				_, data, err := ws.ReadMessage()
+				if err != nil {
+					t.Fatalf("Failed to read: %v", err)
+				}
+				if string(data) != expected {
+					t.Errorf("Expected %s, got %s", expected, data)
+				}
+			}
+		})
+	}
+}
+
+// TestNotifyHTTP tests that notifications are rejected outside WebSocket connections.
+func TestNotifyHTTP(t *testing.T) {
+	if err := Notify(context.Background(), "update", nil); err != ErrNotificationUnsupported {
+		t.Errorf("Expected ErrNotificationUnsupported, got %v", err)
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"time"
 
+	"github.com/mikespook/possum/auth"
 	"github.com/mikespook/possum/log"
 )
 
@@ -39,6 +41,36 @@ func Log(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// WebSocketLog is a WebsocketMiddleware logging the start and end of every session. The upgrade
+// itself is only logged as a 101 by Log. When next returns it closes the connection normally,
+// like the upgrade would, and logs the close code, duration, message and byte counts and, when
+// WebSocketAuth has run, the user ID.
+func WebSocketLog(next WebsocketHandlerFunc) WebsocketHandlerFunc {
+	return func(conn *WebSocketConn, r *http.Request) {
+		log.Info().
+			Str("remote_addr", r.RemoteAddr).
+			Str("url", r.URL.String()).
+			Msg("websocket connect")
+		next(conn, r)
+		conn.finish()
+
+		stats := conn.Stats()
+		event := log.Info().
+			Str("remote_addr", r.RemoteAddr).
+			Str("url", r.URL.String()).
+			Int("close_code", stats.CloseCode).
+			Dur("duration", time.Since(stats.ConnectedAt)).
+			Int64("messages_in", stats.MessagesIn).
+			Int64("messages_out", stats.MessagesOut).
+			Int64("bytes_in", stats.BytesIn).
+			Int64("bytes_out", stats.BytesOut)
+		if claims, ok := conn.Context().Value(ClaimsKey).(*auth.JWTClaims); ok {
+			event = event.Str("user_id", claims.UserID.String())
+		}
+		event.Msg("websocket disconnect")
+	}
+}
+
 type logResponseWriter struct {
 	writer http.ResponseWriter
 	err    error
@@ -2,11 +2,21 @@ package possum
 
 import (
 	"bufio"
+	"encoding/json"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"github.com/mikespook/possum/auth"
+	"github.com/mikespook/possum/log"
 )
 
 // TestLog tests the Log middleware function for request/response logging.
@@ -186,4 +196,85 @@ func (m *mockConn) SetWriteDeadline(t time.Time) error { return nil }
 type mockAddr struct{}
 
 func (m *mockAddr) Network() string { return "mock" }
-func (m *mockAddr) String() string  { return "mock-address" }
\ No newline at end of file
+func (m *mockAddr) String() string  { return "mock-address" }
+// TestWebSocketLog tests the session log written when a client disconnects.
+func TestWebSocketLog(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "possum.log")
+	log.Init(&log.Config{Filename: logFile})
+	defer log.Init(&log.Config{})
+
+	secret := []byte("test-secret")
+	userID := uuid.New()
+	_, token, _ := auth.GenerateJWT(secret, userID, nil)
+	metrics := NewWebSocketMetrics()
+	done := make(chan struct{})
+	echo := func(conn *WebSocketConn, r *http.Request) {
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.Send(messageType, data)
+		}
+	}
+	handler := ChainWebSocket(echo, WebSocketLog, WebSocketAuthMiddleware(secret))
+	server := httptest.NewServer(WebSocketUpgradeWithConfig(&WebSocketConfig{
+		CORS:    &CORSConfig{AllowOrigin: "*"},
+		Metrics: metrics,
+	}, func(conn *WebSocketConn, r *http.Request) {
+		handler(conn, r)
+		close(done)
+	}))
+	defer server.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/?token="+token, nil)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	for _, message := range []string{"hi", "there"} {
+		ws.WriteMessage(websocket.TextMessage, []byte(message))
+		if _, _, err := ws.ReadMessage(); err != nil {
+			t.Fatalf("Failed to read echo: %v", err)
+		}
+	}
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	ws.Close()
+	<-done
+
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	var entry map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e map[string]any
+		if json.Unmarshal([]byte(line), &e) == nil && e["message"] == "websocket disconnect" {
+			entry = e
+		}
+	}
+	if entry == nil {
+		t.Fatalf("Expected a disconnect entry, got %s", data)
+	}
+
+	tests := []struct {
+		field    string
+		expected any
+	}{
+		{field: "close_code", expected: float64(websocket.CloseGoingAway)},
+		{field: "messages_in", expected: float64(2)},
+		{field: "messages_out", expected: float64(2)},
+		{field: "bytes_in", expected: float64(7)},
+		{field: "bytes_out", expected: float64(7)},
+		{field: "user_id", expected: userID.String()},
+	}
+	for _, tc := range tests {
+		t.Run(tc.field, func(t *testing.T) {
+			if entry[tc.field] != tc.expected {
+				t.Errorf("Expected %s %v, got %v", tc.field, tc.expected, entry[tc.field])
+			}
+		})
+	}
+	if _, ok := entry["duration"]; !ok {
+		t.Error("Expected duration in the disconnect entry")
+	}
+}
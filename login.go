@@ -0,0 +1,349 @@
+package possum
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mikespook/possum/auth"
+	"github.com/mikespook/possum/log"
+)
+
+const (
+	// maxLoginBodySize bounds the JSON bodies of Login and MFAVerify.
+	maxLoginBodySize = 64 * 1024
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+)
+
+// User is the account information a UserStore returns for a login name.
+type User struct {
+	ID           uuid.UUID
+	PasswordHash string // argon2id or bcrypt, see auth.HashPassword
+	MFAEnabled   bool   // the user must complete MFAVerify after the password
+}
+
+// UserStore looks up accounts for the login handler.
+// FindUser must return ErrUserNotFound for unknown login names.
+// The request context is passed through, so stores can scope lookups to the resolved tenant.
+type UserStore interface {
+	FindUser(ctx context.Context, username string) (*User, error)
+	UpdatePasswordHash(ctx context.Context, userID uuid.UUID, hash string) error
+}
+
+type LoginConfig struct {
+	Secret              []byte          `mapstructure:"secret,omitempty"`
+	TokenTTL            time.Duration   `mapstructure:"token_ttl,omitempty"`
+	MaxFailures         int             `mapstructure:"max_failures,omitempty"`
+	LockoutDuration     time.Duration   `mapstructure:"lockout_duration,omitempty"`
+	EncryptionKey       []byte          `mapstructure:"encryption_key,omitempty"`
+	EncryptionAlgorithm string          `mapstructure:"encryption_algorithm,omitempty"`
+	MFATokenTTL         time.Duration   `mapstructure:"mfa_token_ttl,omitempty"`
+	TOTP                auth.TOTPConfig `mapstructure:"totp,omitempty"`
+	// LockoutCapacity bounds the login names tracked for the lockout, default 100000.
+	LockoutCapacity int `mapstructure:"lockout_capacity,omitempty"`
+
+	Store    UserStore `mapstructure:"-"`
+	MFAStore MFAStore  `mapstructure:"-"`
+}
+
+var defaultLoginConfig = LoginConfig{
+	TokenTTL:        24 * time.Hour,
+	MaxFailures:     5,
+	LockoutDuration: 15 * time.Minute,
+	MFATokenTTL:     5 * time.Minute,
+	LockoutCapacity: 100000,
+}
+
+// withDefaults returns a copy of config with zero values replaced by defaults.
+func (config *LoginConfig) withDefaults() *LoginConfig {
+	cfg := *config
+	if cfg.TokenTTL == 0 {
+		cfg.TokenTTL = defaultLoginConfig.TokenTTL
+	}
+	if cfg.MaxFailures == 0 {
+		cfg.MaxFailures = defaultLoginConfig.MaxFailures
+	}
+	if cfg.LockoutDuration == 0 {
+		cfg.LockoutDuration = defaultLoginConfig.LockoutDuration
+	}
+	if cfg.MFATokenTTL == 0 {
+		cfg.MFATokenTTL = defaultLoginConfig.MFATokenTTL
+	}
+	if cfg.LockoutCapacity == 0 {
+		cfg.LockoutCapacity = defaultLoginConfig.LockoutCapacity
+	}
+	return &cfg
+}
+
+// LoginRequest is the JSON body accepted by the login handler.
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// LoginResult is the data of the Response returned by a successful login.
+type LoginResult struct {
+	Token       string    `json:"token"`
+	UserID      uuid.UUID `json:"user_id"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	MFARequired bool      `json:"mfa_required,omitempty"`
+}
+
+// Login returns a handler that authenticates a LoginRequest against the user store and responds with a
+// LoginResult. Unknown users and wrong passwords take the same time and get the same 401 response.
+// After MaxFailures consecutive failures a login name is locked for LockoutDuration and gets 429 with Retry-After.
+// Hashes that need upgrading are transparently rehashed with auth.HashPassword on success.
+// Tokens are signed with the resolved tenant's JWTSecret and scoped to it, if there is one.
+// Users with MFAEnabled get a short-lived token marked MFAPending instead, which must be upgraded with MFAVerify.
+func Login(config *LoginConfig) http.HandlerFunc {
+	cfg := config.withDefaults()
+	lockout := newLoginLockout(cfg.LockoutCapacity)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			MethodNotAllowedResponse.Write(w)
+			return
+		}
+		var req LoginRequest
+		body := http.MaxBytesReader(w, r.Body, maxLoginBodySize)
+		if err := json.NewDecoder(body).Decode(&req); err != nil || req.Username == "" {
+			BadRequestResponse.Write(w)
+			return
+		}
+
+		tenant, hasTenant := TenantFromContext(r.Context())
+		key := req.Username
+		if hasTenant {
+			key = tenant.ID + "/" + req.Username
+		}
+		if wait := lockout.reserve(key, cfg.MaxFailures, cfg.LockoutDuration, time.Now()); wait > 0 {
+			writeTooManyRequests(w, wait)
+			return
+		}
+
+		user, err := cfg.Store.FindUser(r.Context(), req.Username)
+		if err != nil && !errors.Is(err, ErrUserNotFound) {
+			lockout.release(key)
+			WriteResponse(w, InternalServerErrorResponse, err)
+			return
+		}
+		hash := dummyPasswordHash()
+		if user != nil {
+			hash = user.PasswordHash
+		}
+		ok, needsRehash, err := auth.VerifyPassword(hash, req.Password)
+		if err != nil {
+			log.Error().Err(err).Str("username", req.Username).Msg("password verification")
+		}
+		if !ok || user == nil {
+			lockout.fail(key, cfg.MaxFailures, cfg.LockoutDuration, time.Now())
+			UnauthorizedResponse.Write(w)
+			return
+		}
+		lockout.reset(key)
+
+		if needsRehash {
+			if rehashed, err := auth.HashPassword(req.Password); err != nil {
+				log.Error().Err(err).Msg("password rehash")
+			} else if err := cfg.Store.UpdatePasswordHash(r.Context(), user.ID, rehashed); err != nil {
+				log.Error().Err(err).Str("user_id", user.ID.String()).Msg("password rehash")
+			}
+		}
+
+		cfg.issueToken(w, r, user.ID, user.MFAEnabled)
+	}
+}
+
+// issueToken signs a token for the user, scoped to the resolved tenant, and writes it as a LoginResult.
+func (config *LoginConfig) issueToken(w http.ResponseWriter, r *http.Request, userID uuid.UUID, mfaPending bool) {
+	secret := config.Secret
+	ttl := config.TokenTTL
+	if mfaPending {
+		ttl = config.MFATokenTTL
+	}
+	expiresAt := time.Now().Add(ttl)
+	claims := auth.NewClaims(userID, &expiresAt)
+	claims.MFAPending = mfaPending
+	if tenant, ok := TenantFromContext(r.Context()); ok {
+		claims.TenantID = tenant.ID
+		if len(tenant.JWTSecret) > 0 {
+			secret = tenant.JWTSecret
+		}
+	}
+	token, err := auth.SignToken(secret, claims)
+	if err == nil && len(config.EncryptionKey) > 0 {
+		token, err = auth.EncryptToken(config.EncryptionKey, config.EncryptionAlgorithm, token)
+	}
+	if err != nil {
+		WriteResponse(w, InternalServerErrorResponse, err)
+		return
+	}
+
+	resp := NewResponse(r)
+	resp.SetData(LoginResult{
+		Token:       token,
+		UserID:      userID,
+		ExpiresAt:   expiresAt,
+		MFARequired: mfaPending,
+	})
+	resp.Write(w)
+}
+
+var (
+	dummyHash     string
+	dummyHashOnce sync.Once
+)
+
+// dummyPasswordHash is verified for unknown users so they cost as much as wrong passwords.
+func dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = auth.HashPassword(uuid.NewString())
+	})
+	return dummyHash
+}
+
+type loginAttempts struct {
+	failures    int
+	pending     int // attempts reserved but not verified yet
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// loginLockout counts consecutive failed logins per login name. Attempts are reserved before the
+// credentials are verified, so concurrent requests cannot get more than maxFailures verifications
+// past it. Stale entries are swept once per lockout duration, and at most capacity names are
+// tracked: when it is full, a name that is not locked is forgotten to make room, so locks are
+// never lifted early.
+type loginLockout struct {
+	sync.Mutex
+	attempts map[string]*loginAttempts
+	capacity int
+	swept    time.Time
+}
+
+func newLoginLockout(capacity int) *loginLockout {
+	return &loginLockout{attempts: make(map[string]*loginAttempts), capacity: capacity}
+}
+
+// reserve counts an attempt of the login name as pending, or returns how long the name is locked
+// for. Pending attempts count as failures until they are verified, so a name whose failures and
+// pending attempts reach maxFailures is refused for a second. Every reserved attempt must end
+// with fail, reset or release.
+func (lockout *loginLockout) reserve(key string, maxFailures int, duration time.Duration, now time.Time) time.Duration {
+	lockout.Lock()
+	defer lockout.Unlock()
+	attempts, ok := lockout.attempts[key]
+	if !ok {
+		if len(lockout.attempts) >= lockout.capacity && !lockout.evict(now) {
+			// Every tracked name is locked; this one cannot be tracked until a lock expires
+			return 0
+		}
+		attempts = &loginAttempts{}
+		lockout.attempts[key] = attempts
+	}
+	if !attempts.lockedUntil.IsZero() {
+		if wait := attempts.lockedUntil.Sub(now); wait > 0 {
+			return wait
+		}
+		// The lockout has expired, start counting again
+		attempts.failures = 0
+		attempts.lockedUntil = time.Time{}
+	}
+	failures := attempts.failures
+	if now.Sub(attempts.lastFailure) > duration {
+		failures = 0
+	}
+	if failures+attempts.pending >= maxFailures {
+		return time.Second
+	}
+	attempts.pending++
+	return 0
+}
+
+func (lockout *loginLockout) fail(key string, maxFailures int, duration time.Duration, now time.Time) {
+	lockout.Lock()
+	defer lockout.Unlock()
+	if now.Sub(lockout.swept) >= duration {
+		lockout.sweep(duration, now)
+	}
+	attempts, ok := lockout.attempts[key]
+	if !ok {
+		if len(lockout.attempts) >= lockout.capacity && !lockout.evict(now) {
+			// Every tracked name is locked; this one cannot be tracked until a lock expires
+			return
+		}
+		attempts = &loginAttempts{}
+		lockout.attempts[key] = attempts
+	}
+	if attempts.pending > 0 {
+		attempts.pending--
+	}
+	// Failures only count as consecutive within the lockout duration
+	if now.Sub(attempts.lastFailure) > duration {
+		attempts.failures = 0
+	}
+	attempts.failures++
+	attempts.lastFailure = now
+	if attempts.failures >= maxFailures {
+		attempts.lockedUntil = now.Add(duration)
+	}
+}
+
+// reset ends a reserved attempt that succeeded and forgets the failures of the login name.
+func (lockout *loginLockout) reset(key string) {
+	lockout.Lock()
+	defer lockout.Unlock()
+	attempts, ok := lockout.attempts[key]
+	if !ok {
+		return
+	}
+	if attempts.pending > 1 {
+		// Keep counting the attempts still being verified
+		attempts.pending--
+		attempts.failures = 0
+		attempts.lockedUntil = time.Time{}
+		return
+	}
+	delete(lockout.attempts, key)
+}
+
+// release ends a reserved attempt that could not be verified, e.g. because a store failed,
+// without counting it as a failure.
+func (lockout *loginLockout) release(key string) {
+	lockout.Lock()
+	defer lockout.Unlock()
+	if attempts, ok := lockout.attempts[key]; ok && attempts.pending > 0 {
+		attempts.pending--
+	}
+}
+
+// sweep removes the names whose failures no longer count and whose lock has expired; the lock
+// must be held.
+func (lockout *loginLockout) sweep(duration time.Duration, now time.Time) {
+	for key, attempts := range lockout.attempts {
+		if now.Sub(attempts.lastFailure) > duration && !now.Before(attempts.lockedUntil) && attempts.pending == 0 {
+			delete(lockout.attempts, key)
+		}
+	}
+	lockout.swept = now
+}
+
+// evict forgets a name that is neither locked nor being verified and reports whether there was
+// one; the lock must be held.
+func (lockout *loginLockout) evict(now time.Time) bool {
+	for key, attempts := range lockout.attempts {
+		if !now.Before(attempts.lockedUntil) && attempts.pending == 0 {
+			delete(lockout.attempts, key)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,304 @@
+package possum
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mikespook/possum/auth"
+)
+
+// memoryUserStore is an in-memory UserStore for testing.
+type memoryUserStore struct {
+	sync.Mutex
+	users map[string]*User
+}
+
+func (s *memoryUserStore) FindUser(_ context.Context, username string) (*User, error) {
+	s.Lock()
+	defer s.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (s *memoryUserStore) UpdatePasswordHash(_ context.Context, userID uuid.UUID, hash string) error {
+	s.Lock()
+	defer s.Unlock()
+	for _, user := range s.users {
+		if user.ID == userID {
+			user.PasswordHash = hash
+		}
+	}
+	return nil
+}
+
+// postLogin sends a login request to handler.
+func postLogin(handler http.HandlerFunc, username, password string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(LoginRequest{Username: username, Password: password})
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(string(body)))
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	return rr
+}
+
+// TestLogin tests the Login handler for successful and failed logins.
+func TestLogin(t *testing.T) {
+	secret := []byte("test-secret")
+	hash, err := auth.HashPassword("correct horse")
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+	userID := uuid.New()
+	store := &memoryUserStore{users: map[string]*User{
+		"alice": {ID: userID, PasswordHash: hash},
+	}}
+	handler := Login(&LoginConfig{Secret: secret, Store: store})
+
+	// Test cases
+	tests := []struct {
+		name           string
+		method         string
+		body           string
+		expectedStatus int
+	}{
+		{
+			name:           "Valid credentials",
+			method:         http.MethodPost,
+			body:           `{"username":"alice","password":"correct horse"}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Wrong password",
+			method:         http.MethodPost,
+			body:           `{"username":"alice","password":"battery staple"}`,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Unknown user",
+			method:         http.MethodPost,
+			body:           `{"username":"mallory","password":"correct horse"}`,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Invalid body",
+			method:         http.MethodPost,
+			body:           `not json`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Body too large",
+			method:         http.MethodPost,
+			body:           `{"username":"alice","password":"` + strings.Repeat("a", maxLoginBodySize) + `"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Wrong method",
+			method:         http.MethodGet,
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/login", strings.NewReader(tc.body))
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d", tc.expectedStatus, rr.Code)
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				Data LoginResult `json:"data"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			claims, err := auth.ParseToken(secret, resp.Data.Token)
+			if err != nil {
+				t.Fatalf("Failed to parse issued token: %v", err)
+			}
+			if claims.UserID != userID || resp.Data.UserID != userID {
+				t.Errorf("Expected user %v, got claims %v and data %v", userID, claims.UserID, resp.Data.UserID)
+			}
+		})
+	}
+}
+
+// TestLoginLockout tests that repeated failures lock the account, including for correct passwords.
+func TestLoginLockout(t *testing.T) {
+	hash, _ := auth.HashPassword("correct horse")
+	store := &memoryUserStore{users: map[string]*User{
+		"alice": {ID: uuid.New(), PasswordHash: hash},
+	}}
+	handler := Login(&LoginConfig{Secret: []byte("test-secret"), Store: store, MaxFailures: 2, LockoutDuration: time.Minute})
+
+	for i := 0; i < 2; i++ {
+		if rr := postLogin(handler, "alice", "wrong"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+	}
+	rr := postLogin(handler, "alice", "correct horse")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("Expected Retry-After header")
+	}
+
+	// Other accounts are not affected
+	if rr := postLogin(handler, "bob", "wrong"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+	}
+}
+
+// blockingUserStore is a UserStore counting lookups that wait until release is closed.
+type blockingUserStore struct {
+	memoryUserStore
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (s *blockingUserStore) FindUser(ctx context.Context, username string) (*User, error) {
+	s.calls.Add(1)
+	<-s.release
+	return s.memoryUserStore.FindUser(ctx, username)
+}
+
+// TestLoginLockoutConcurrent tests that concurrent failures cannot get more than MaxFailures
+// attempts past the lockout to the password check.
+func TestLoginLockoutConcurrent(t *testing.T) {
+	store := &blockingUserStore{release: make(chan struct{})}
+	handler := Login(&LoginConfig{Secret: []byte("test-secret"), Store: store, MaxFailures: 3, LockoutDuration: time.Minute})
+
+	const requests = 40
+	var wg sync.WaitGroup
+	var tooMany atomic.Int32
+	for range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rr := postLogin(handler, "alice", "wrong"); rr.Code == http.StatusTooManyRequests {
+				tooMany.Add(1)
+			}
+		}()
+	}
+	// Wait until every request is either refused or waiting in the store
+	deadline := time.Now().Add(time.Second)
+	for store.calls.Load()+tooMany.Load() < requests && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	close(store.release)
+	wg.Wait()
+
+	if calls := store.calls.Load(); calls != 3 {
+		t.Errorf("Expected 3 attempts to be verified, got %d", calls)
+	}
+	if rr := postLogin(handler, "alice", "wrong"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d after the failures, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+}
+
+// TestLoginLockoutCapacity tests that the lockout tracks a bounded number of names without
+// lifting locks early, and sweeps names whose failures have expired.
+func TestLoginLockoutCapacity(t *testing.T) {
+	lockout := newLoginLockout(2)
+	now := time.Now()
+	fail := func(key string, times int) {
+		for range times {
+			lockout.fail(key, 2, time.Minute, now)
+		}
+	}
+
+	steps := []struct {
+		name     string
+		key      string
+		failures int
+		at       time.Duration
+		expected []string // tracked names
+	}{
+		{name: "Below capacity", key: "alice", failures: 1, expected: []string{"alice"}},
+		{name: "Locked", key: "bob", failures: 2, expected: []string{"alice", "bob"}},
+		{name: "Unlocked name evicted", key: "carol", failures: 2, expected: []string{"bob", "carol"}},
+		{name: "Every name locked", key: "dave", failures: 1, expected: []string{"bob", "carol"}},
+		{name: "Expired names swept", key: "erin", failures: 1, at: 2 * time.Minute, expected: []string{"erin"}},
+	}
+	for _, step := range steps {
+		now = now.Add(step.at)
+		fail(step.key, step.failures)
+		var tracked []string
+		for _, key := range []string{"alice", "bob", "carol", "dave", "erin"} {
+			if _, ok := lockout.attempts[key]; ok {
+				tracked = append(tracked, key)
+			}
+		}
+		if strings.Join(tracked, ",") != strings.Join(step.expected, ",") {
+			t.Errorf("%s: expected %v tracked, got %v", step.name, step.expected, tracked)
+		}
+	}
+}
+
+// TestLoginRehash tests that bcrypt hashes are upgraded to argon2id on successful login.
+func TestLoginRehash(t *testing.T) {
+	hash, _ := auth.HashPasswordBcrypt("correct horse")
+	store := &memoryUserStore{users: map[string]*User{
+		"alice": {ID: uuid.New(), PasswordHash: hash},
+	}}
+	handler := Login(&LoginConfig{Secret: []byte("test-secret"), Store: store})
+
+	if rr := postLogin(handler, "alice", "correct horse"); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	user, _ := store.FindUser(context.Background(), "alice")
+	if !strings.HasPrefix(user.PasswordHash, "$argon2id$") {
+		t.Errorf("Expected argon2id hash after login, got %q", user.PasswordHash)
+	}
+	if rr := postLogin(handler, "alice", "correct horse"); rr.Code != http.StatusOK {
+		t.Errorf("Expected status %d with upgraded hash, got %d", http.StatusOK, rr.Code)
+	}
+}
+
+// TestLoginTenant tests that tokens are signed with and scoped to the resolved tenant.
+func TestLoginTenant(t *testing.T) {
+	tenantSecret := []byte("acme-secret")
+	hash, _ := auth.HashPassword("correct horse")
+	store := &memoryUserStore{users: map[string]*User{
+		"alice": {ID: uuid.New(), PasswordHash: hash},
+	}}
+	handler := Chain(Login(&LoginConfig{Secret: []byte("test-secret"), Store: store}),
+		Tenant(TenantMap{"acme": {ID: "acme", JWTSecret: tenantSecret}}, TenantFromHeader("X-Tenant-ID")))
+
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"alice","password":"correct horse"}`))
+	req.Header.Set("X-Tenant-ID", "acme")
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	var resp struct {
+		Data LoginResult `json:"data"`
+	}
+	json.NewDecoder(rr.Body).Decode(&resp)
+	claims, err := auth.ParseToken(tenantSecret, resp.Data.Token)
+	if err != nil {
+		t.Fatalf("Failed to parse token with tenant secret: %v", err)
+	}
+	if claims.TenantID != "acme" {
+		t.Errorf("Expected TenantID acme, got %q", claims.TenantID)
+	}
+}
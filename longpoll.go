@@ -0,0 +1,480 @@
+package possum
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"github.com/mikespook/possum/auth"
+	"github.com/mikespook/possum/log"
+)
+
+const (
+	// Transports of a WebSocketConn.
+	TransportWebSocket = "websocket"
+	TransportPolling   = "polling"
+
+	// Query parameters of the long-polling protocol.
+	PollSessionParam  = "sid"
+	PollAckParam      = "ack"
+	PollProtocolParam = "protocol"
+
+	// PollTokenHeader carries the token of a polling session, kept out of URLs and access logs.
+	PollTokenHeader = "X-Poll-Token"
+)
+
+// LongPollConfig configures the long-polling fallback of a WebSocket endpoint. A polling
+// session is closed abnormally when no request arrives within WebSocketConfig.PongWait, the
+// counterpart of a missed pong, so PollTimeout must be less than PongWait.
+type LongPollConfig struct {
+	PollTimeout time.Duration `mapstructure:"poll_timeout,omitempty"` // how long a poll waits for messages, default 25s
+	MaxBatch    int           `mapstructure:"max_batch,omitempty"`    // messages per poll response, default 64
+}
+
+var defaultLongPollConfig = &LongPollConfig{
+	PollTimeout: 25 * time.Second,
+	MaxBatch:    64,
+}
+
+// withDefaults returns a copy of config with zero values replaced by the defaults.
+func (config *LongPollConfig) withDefaults() *LongPollConfig {
+	cfg := *defaultLongPollConfig
+	if config.PollTimeout != 0 {
+		cfg.PollTimeout = config.PollTimeout
+	}
+	if config.MaxBatch != 0 {
+		cfg.MaxBatch = config.MaxBatch
+	}
+	return &cfg
+}
+
+// PollOpen is the data of the response opening a polling session. Token must be sent in the
+// PollTokenHeader of every later request of the session.
+type PollOpen struct {
+	SessionID string   `json:"sid"`
+	Token     string   `json:"token,omitempty"`
+	Protocol  string   `json:"protocol,omitempty"`
+	Upgrades  []string `json:"upgrades,omitempty"`
+}
+
+// PollMessage is a data message of the long-polling protocol. Binary data is base64 encoded.
+type PollMessage struct {
+	Binary bool   `json:"binary,omitempty"`
+	Data   string `json:"data"`
+}
+
+// PollClose is the close frame of the long-polling protocol.
+type PollClose struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// PollBatch is the data of a poll response. Seq numbers the batch: the client acknowledges it
+// with the ack parameter of its next poll, and an unacknowledged batch is sent again.
+type PollBatch struct {
+	Seq      uint64        `json:"seq"`
+	Messages []PollMessage `json:"messages"`
+	Close    *PollClose    `json:"close,omitempty"`
+}
+
+// longPoll serves the polling sessions of a WebSocket endpoint; see WebSocketConfig.LongPolling.
+type longPoll struct {
+	config       *WebSocketConfig
+	poll         *LongPollConfig
+	subprotocols []string
+	checkOrigin  func(r *http.Request) bool
+	next         WebsocketHandlerFunc
+
+	mu       sync.Mutex
+	sessions map[string]*pollSession
+}
+
+func newLongPoll(config *WebSocketConfig, upgrader *websocket.Upgrader, next WebsocketHandlerFunc) *longPoll {
+	return &longPoll{
+		config:       config,
+		poll:         config.LongPolling,
+		subprotocols: upgrader.Subprotocols,
+		checkOrigin:  upgrader.CheckOrigin,
+		next:         next,
+		sessions:     make(map[string]*pollSession),
+	}
+}
+
+// ServeHTTP serves the requests of the endpoint that are not WebSocket upgrades:
+//
+//	GET              lists the transports, for clients to negotiate
+//	POST             opens a session and runs the handler
+//	GET    ?sid=&ack= waits for the messages sent by the handler
+//	POST   ?sid=     delivers a JSON array of PollMessage to the handler
+//	DELETE ?sid=     closes the session, with optional code and reason parameters
+//
+// Only the request opening a session runs the handler and its middlewares, such as
+// WebSocketAuth; later requests are authenticated by the session token, and must come from the
+// same IP and carry the same user's claims, if the opening request had claims.
+func (lp *longPoll) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get(PollSessionParam)
+	if id == "" {
+		switch r.Method {
+		case http.MethodGet:
+			resp := NewResponse(r)
+			resp.SetData(&PollOpen{Upgrades: []string{TransportWebSocket, TransportPolling}})
+			resp.Write(w)
+		case http.MethodPost:
+			lp.open(w, r)
+		default:
+			MethodNotAllowedResponse.Write(w)
+		}
+		return
+	}
+	lp.mu.Lock()
+	s, ok := lp.sessions[id]
+	lp.mu.Unlock()
+	if !ok {
+		NotFoundResponse.Write(w)
+		return
+	}
+	if !s.authorize(r) {
+		ForbiddenResponse.Write(w)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.poll(w, r)
+	case http.MethodPost:
+		s.receive(w, r)
+	case http.MethodDelete:
+		code, err := strconv.Atoi(r.URL.Query().Get("code"))
+		if err != nil {
+			code = websocket.CloseNormalClosure
+		}
+		s.end(&websocket.CloseError{Code: code, Text: r.URL.Query().Get("reason")})
+		resp := NewResponse(r)
+		resp.WriteHeader(http.StatusNoContent)
+		resp.Write(w)
+	default:
+		MethodNotAllowedResponse.Write(w)
+	}
+}
+
+// open starts a session and its handler, which outlives the request opening it.
+func (lp *longPoll) open(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Origin") != "" && !lp.checkOrigin(r) {
+		ForbiddenResponse.Write(w)
+		return
+	}
+	var slot *connSlot
+	if lp.config.Limiter != nil {
+		var ok bool
+		if slot, ok = lp.config.Limiter.acquire(r); !ok {
+			lp.config.Limiter.reject(w)
+			return
+		}
+	}
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		slot.release()
+		WriteResponse(w, InternalServerErrorResponse, err)
+		return
+	}
+	r = r.WithContext(context.WithoutCancel(r.Context()))
+	conn := newWebSocketConn(nil, lp.config, r)
+	conn.slot = slot
+	s := &pollSession{
+		id:          uuid.NewString(),
+		token:       base64.RawURLEncoding.EncodeToString(token),
+		ip:          remoteIP(r),
+		lp:          lp,
+		conn:        conn,
+		addr:        pollAddr(r.RemoteAddr),
+		subprotocol: lp.selectSubprotocol(r),
+		ended:       make(chan struct{}),
+	}
+	if claims, ok := r.Context().Value(ClaimsKey).(*auth.JWTClaims); ok {
+		s.userID = claims.UserID
+	}
+	s.idle = time.AfterFunc(lp.config.PongWait, func() {
+		s.end(&websocket.CloseError{Code: websocket.CloseAbnormalClosure})
+	})
+	conn.poll = s
+	lp.mu.Lock()
+	lp.sessions[s.id] = s
+	lp.mu.Unlock()
+	conn.start()
+
+	go func() {
+		defer func() {
+			// net/http recovers the handlers of WebSocket connections, but not this goroutine
+			if err := recover(); err != nil {
+				log.Error().Interface("panic", err).Str("session", s.id).Str("stack", string(debug.Stack())).Msg("websocket handler panicked")
+				conn.Close(websocket.CloseInternalServerErr, "")
+			}
+			conn.finish()
+			lp.config.Metrics.disconnected()
+			slot.release()
+		}()
+		lp.next(conn, r.WithContext(conn.Context()))
+	}()
+
+	resp := NewResponse(r)
+	resp.SetData(&PollOpen{SessionID: s.id, Token: s.token, Protocol: s.subprotocol})
+	resp.Write(w)
+}
+
+// selectSubprotocol picks the first subprotocol of the endpoint offered by the client, as the
+// WebSocket handshake does.
+func (lp *longPoll) selectSubprotocol(r *http.Request) string {
+	offered := r.URL.Query()[PollProtocolParam]
+	for _, subprotocol := range lp.subprotocols {
+		for _, o := range offered {
+			if o == subprotocol {
+				return subprotocol
+			}
+		}
+	}
+	return ""
+}
+
+func (lp *longPoll) remove(id string) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	delete(lp.sessions, id)
+}
+
+// pollAddr is the remote address of a polling session.
+type pollAddr string
+
+func (a pollAddr) Network() string { return "tcp" }
+func (a pollAddr) String() string  { return string(a) }
+
+// pollSession carries a WebSocketConn over HTTP requests. Polls take the place of the writer
+// goroutine, draining the send queue, and send requests that of the reader goroutine.
+type pollSession struct {
+	id          string
+	token       string
+	ip          string
+	userID      uuid.UUID // of the claims of the opening request, if any
+	lp          *longPoll
+	conn        *WebSocketConn
+	addr        net.Addr
+	subprotocol string
+
+	// pollMu allows one poll at a time and guards the last batch
+	pollMu sync.Mutex
+	seq    uint64
+	batch  *PollBatch
+
+	// deliverMu keeps incoming open while messages are delivered
+	deliverMu sync.RWMutex
+	endOnce   sync.Once
+	ended     chan struct{}
+	idle      *time.Timer
+}
+
+// authorize reports whether r belongs to the client that opened the session.
+func (s *pollSession) authorize(r *http.Request) bool {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(PollTokenHeader)), []byte(s.token)) != 1 || remoteIP(r) != s.ip {
+		return false
+	}
+	if s.userID == uuid.Nil {
+		return true
+	}
+	claims, ok := r.Context().Value(ClaimsKey).(*auth.JWTClaims)
+	return ok && claims.UserID == s.userID
+}
+
+// run ends the session when the client does not collect the close frame of the handler in time.
+func (s *pollSession) run() {
+	select {
+	case <-s.conn.closing:
+		timer := time.NewTimer(s.lp.poll.PollTimeout + s.lp.config.WriteWait)
+		defer timer.Stop()
+		select {
+		case <-s.ended:
+		case <-timer.C:
+			s.end(&websocket.CloseError{Code: websocket.CloseAbnormalClosure})
+		}
+	case <-s.ended:
+	}
+}
+
+// touch postpones the idle timeout.
+func (s *pollSession) touch() {
+	s.idle.Reset(s.lp.config.PongWait)
+}
+
+// poll answers with the next batch of messages, waiting up to PollTimeout for one.
+func (s *pollSession) poll(w http.ResponseWriter, r *http.Request) {
+	if !s.pollMu.TryLock() {
+		ConflictResponse.Write(w)
+		return
+	}
+	defer s.pollMu.Unlock()
+	s.touch()
+	defer s.touch()
+
+	ack, _ := strconv.ParseUint(r.URL.Query().Get(PollAckParam), 10, 64)
+	if s.batch == nil || ack >= s.seq {
+		batch := s.collect(r.Context())
+		if batch == nil {
+			return // the client went away; its messages stay queued
+		}
+		s.seq++
+		batch.Seq = s.seq
+		s.batch = batch
+	}
+	resp := NewResponse(r)
+	resp.SetData(s.batch)
+	resp.Write(w)
+	if s.batch.Close != nil {
+		s.end(&websocket.CloseError{Code: s.batch.Close.Code, Text: s.batch.Close.Reason})
+	}
+}
+
+// collect waits for queued messages and takes up to MaxBatch of them. The close frame follows
+// the last message once the connection is closing. It returns nil if ctx is done first.
+func (s *pollSession) collect(ctx context.Context) *PollBatch {
+	c := s.conn
+	timer := time.NewTimer(s.lp.poll.PollTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-c.closing:
+			batch := &PollBatch{Messages: s.drain()}
+			if c.queue.len() == 0 {
+				batch.Close = s.closeFrame()
+			}
+			return batch
+		case <-s.ended:
+			return &PollBatch{Messages: []PollMessage{}, Close: s.closeFrame()}
+		default:
+		}
+		if messages := s.drain(); len(messages) > 0 {
+			return &PollBatch{Messages: messages}
+		}
+		select {
+		case <-c.queue.notify:
+		case <-c.closing:
+		case <-s.ended:
+		case <-timer.C:
+			return &PollBatch{Messages: []PollMessage{}}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// drain pops up to MaxBatch queued messages.
+func (s *pollSession) drain() []PollMessage {
+	c := s.conn
+	messages := []PollMessage{}
+	for len(messages) < s.lp.poll.MaxBatch {
+		msg, ok := c.queue.pop()
+		if !ok {
+			break
+		}
+		if msg.messageType == websocket.BinaryMessage {
+			messages = append(messages, PollMessage{Binary: true, Data: base64.StdEncoding.EncodeToString(msg.data)})
+		} else {
+			messages = append(messages, PollMessage{Data: string(msg.data)})
+		}
+		c.messagesOut.Add(1)
+		c.bytesOut.Add(int64(len(msg.data)))
+		c.config.Metrics.sent(len(msg.data))
+	}
+	return messages
+}
+
+// closeFrame returns the close frame of the handler, or the code the session ended with.
+func (s *pollSession) closeFrame() *PollClose {
+	c := s.conn
+	select {
+	case <-c.closing:
+		if len(c.closeMsg) >= 2 {
+			return &PollClose{Code: int(binary.BigEndian.Uint16(c.closeMsg)), Reason: string(c.closeMsg[2:])}
+		}
+		return &PollClose{Code: websocket.CloseNoStatusReceived}
+	default:
+		return &PollClose{Code: int(c.closeCode.Load())}
+	}
+}
+
+// receive delivers the messages of a send request to ReadMessage, waiting for the handler to
+// read them. The request body is limited to MaxMessageSize.
+func (s *pollSession) receive(w http.ResponseWriter, r *http.Request) {
+	s.touch()
+	c := s.conn
+	var messages []PollMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, c.config.MaxMessageSize)).Decode(&messages); err != nil {
+		BadRequestResponse.Write(w)
+		return
+	}
+	decoded := make([]wsMessage, len(messages))
+	for i, m := range messages {
+		decoded[i] = wsMessage{messageType: websocket.TextMessage, data: []byte(m.Data)}
+		if m.Binary {
+			data, err := base64.StdEncoding.DecodeString(m.Data)
+			if err != nil {
+				BadRequestResponse.Write(w)
+				return
+			}
+			decoded[i] = wsMessage{messageType: websocket.BinaryMessage, data: data}
+		}
+	}
+
+	s.deliverMu.RLock()
+	defer s.deliverMu.RUnlock()
+	select {
+	case <-s.ended:
+		NotFoundResponse.Write(w)
+		return
+	default:
+	}
+	for _, msg := range decoded {
+		c.messagesIn.Add(1)
+		c.bytesIn.Add(int64(len(msg.data)))
+		c.config.Metrics.received(len(msg.data))
+		if !c.allowMessage() {
+			continue
+		}
+		select {
+		case c.incoming <- msg:
+		case <-c.done:
+			// Closing: discard data as the reader of a WebSocket does
+		case <-r.Context().Done():
+			return
+		}
+	}
+	resp := NewResponse(r)
+	resp.WriteHeader(http.StatusNoContent)
+	resp.Write(w)
+}
+
+// end closes the session with err as the read error of the connection; the first call wins.
+func (s *pollSession) end(err *websocket.CloseError) {
+	s.endOnce.Do(func() {
+		c := s.conn
+		c.closeCode.CompareAndSwap(0, int64(err.Code))
+		c.cancel()
+		s.deliverMu.Lock()
+		c.readErr = err
+		close(s.ended)
+		close(c.incoming)
+		s.deliverMu.Unlock()
+		s.idle.Stop()
+		s.lp.remove(s.id)
+		close(c.readDone)
+		close(c.writeDone)
+	})
+}
@@ -0,0 +1,334 @@
+package possum
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"github.com/mikespook/possum/auth"
+)
+
+// newPollServer serves an authenticated echo handler over WebSocket and long-polling. The
+// handler greets with the user, transport and subprotocol, closes with 4000 on "bye" and
+// reports its read error to closed.
+func newPollServer(t *testing.T, secret []byte, cfg *WebSocketConfig, closed chan<- error) *httptest.Server {
+	t.Helper()
+	cfg.CORS = &CORSConfig{AllowOrigin: "*"}
+	handler := WebSocketAuth(secret, func(conn *WebSocketConn, r *http.Request) {
+		claims := conn.Context().Value(ClaimsKey).(*auth.JWTClaims)
+		conn.Send(websocket.TextMessage, []byte(fmt.Sprintf("%s %s %s", claims.UserID, conn.Transport(), conn.Subprotocol())))
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				closed <- err
+				return
+			}
+			if string(data) == "bye" {
+				conn.Close(4000, "bye")
+				closed <- nil
+				return
+			}
+			conn.Send(messageType, data)
+		}
+	})
+	server := httptest.NewServer(WebSocketUpgradeWithConfig(cfg, handler))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// pollClient speaks the long-polling protocol.
+type pollClient struct {
+	t     *testing.T
+	url   string
+	sid   string
+	token string
+	ack   uint64
+}
+
+// pollRequest sends a request with the session token, if any, and decodes the data of its
+// response into v, if any.
+func pollRequest(t *testing.T, method, u, token string, body []byte, v any) int {
+	t.Helper()
+	req, _ := http.NewRequest(method, u, bytes.NewReader(body))
+	if token != "" {
+		req.Header.Set(PollTokenHeader, token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to %s: %v", method, err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode == http.StatusOK {
+		var envelope struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+			t.Fatalf("Failed to decode: %v", err)
+		}
+		json.Unmarshal(envelope.Data, v)
+	}
+	return resp.StatusCode
+}
+
+func openPoll(t *testing.T, server *httptest.Server, query url.Values) (*pollClient, *PollOpen) {
+	t.Helper()
+	var open PollOpen
+	if code := pollRequest(t, http.MethodPost, server.URL+"?"+query.Encode(), "", nil, &open); code != http.StatusOK {
+		t.Fatalf("Failed to open a session: %d", code)
+	}
+	return &pollClient{t: t, url: server.URL + "?" + PollSessionParam + "=" + open.SessionID, sid: open.SessionID, token: open.Token}, &open
+}
+
+// poll fetches a batch, acknowledging the previous one, and formats its messages as
+// "text" or "binary:hex" followed by "close:code" if there is one.
+func (c *pollClient) poll() (*PollBatch, []string) {
+	c.t.Helper()
+	var batch PollBatch
+	if code := pollRequest(c.t, http.MethodGet, fmt.Sprintf("%s&%s=%d", c.url, PollAckParam, c.ack), c.token, nil, &batch); code != http.StatusOK {
+		c.t.Fatalf("Failed to poll: %d", code)
+	}
+	c.ack = batch.Seq
+	var got []string
+	for _, m := range batch.Messages {
+		if m.Binary {
+			data, _ := base64.StdEncoding.DecodeString(m.Data)
+			got = append(got, fmt.Sprintf("binary:%x", data))
+		} else {
+			got = append(got, m.Data)
+		}
+	}
+	if batch.Close != nil {
+		got = append(got, fmt.Sprintf("close:%d", batch.Close.Code))
+	}
+	return &batch, got
+}
+
+func (c *pollClient) send(messages ...PollMessage) {
+	c.t.Helper()
+	body, _ := json.Marshal(messages)
+	if code := pollRequest(c.t, http.MethodPost, c.url, c.token, body, nil); code != http.StatusNoContent {
+		c.t.Fatalf("Failed to send: %d", code)
+	}
+}
+
+// TestLongPoll tests that the same handler serves polling clients with auth, codecs, binary
+// messages and resent batches, and WebSocket clients on the same URL.
+func TestLongPoll(t *testing.T) {
+	secret := []byte("test-secret")
+	userID := uuid.New()
+	_, token, _ := auth.GenerateJWT(secret, userID, nil)
+	metrics := NewWebSocketMetrics()
+	closed := make(chan error, 2)
+	server := newPollServer(t, secret, &WebSocketConfig{
+		Codecs:      []Codec{MsgpackCodec},
+		Metrics:     metrics,
+		LongPolling: &LongPollConfig{PollTimeout: 50 * time.Millisecond},
+	}, closed)
+
+	var negotiation PollOpen
+	pollRequest(t, http.MethodGet, server.URL, "", nil, &negotiation)
+	if fmt.Sprint(negotiation.Upgrades) != "[websocket polling]" {
+		t.Errorf("Expected both transports, got %v", negotiation.Upgrades)
+	}
+
+	client, open := openPoll(t, server, url.Values{"token": {token}, PollProtocolParam: {"cbor", "msgpack"}})
+	if open.Protocol != "msgpack" {
+		t.Errorf("Expected msgpack, got %q", open.Protocol)
+	}
+	if _, got := client.poll(); fmt.Sprint(got) != fmt.Sprintf("[%s polling msgpack]", userID) {
+		t.Errorf("Unexpected greeting %q", got)
+	}
+
+	client.send(PollMessage{Data: "a"}, PollMessage{Binary: true, Data: base64.StdEncoding.EncodeToString([]byte{1, 2})})
+	var echoed []string
+	var last *PollBatch
+	for len(echoed) < 2 {
+		batch, got := client.poll()
+		echoed = append(echoed, got...)
+		if len(got) > 0 {
+			last = batch
+		}
+	}
+	if fmt.Sprint(echoed) != "[a binary:0102]" {
+		t.Errorf("Unexpected echo %q", echoed)
+	}
+
+	// A client that missed a response gets the same batch again
+	client.ack = last.Seq - 1
+	if batch, got := client.poll(); batch.Seq != last.Seq || len(got) != len(last.Messages) {
+		t.Errorf("Expected batch %d again, got %d %q", last.Seq, batch.Seq, got)
+	}
+	if batch, got := client.poll(); batch.Seq != last.Seq+1 || len(got) != 0 {
+		t.Errorf("Expected an empty batch %d, got %d %q", last.Seq+1, batch.Seq, got)
+	}
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?token="+token, nil)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer ws.Close()
+	if _, data, err := ws.ReadMessage(); err != nil || string(data) != fmt.Sprintf("%s websocket ", userID) {
+		t.Errorf("Unexpected greeting %q (%v)", data, err)
+	}
+	if stats := metrics.Snapshot(); stats.Active != 2 || stats.MessagesIn != 2 || stats.MessagesOut != 4 {
+		t.Errorf("Unexpected metrics %+v", stats)
+	}
+
+	client.send(PollMessage{Data: "bye"})
+	if err := <-closed; err != nil {
+		t.Errorf("Unexpected read error %v", err)
+	}
+	if _, got := client.poll(); fmt.Sprint(got) != "[close:4000]" {
+		t.Errorf("Expected close 4000, got %q", got)
+	}
+	if code := pollRequest(t, http.MethodGet, client.url, client.token, nil, nil); code != http.StatusNotFound {
+		t.Errorf("Expected 404 after close, got %d", code)
+	}
+}
+
+// TestLongPollClose tests how polling sessions end on either side.
+func TestLongPollClose(t *testing.T) {
+	secret := []byte("test-secret")
+	_, token, _ := auth.GenerateJWT(secret, uuid.New(), nil)
+	closed := make(chan error, 1)
+	server := newPollServer(t, secret, &WebSocketConfig{
+		PongWait:    200 * time.Millisecond,
+		LongPolling: &LongPollConfig{PollTimeout: 50 * time.Millisecond},
+	}, closed)
+
+	tests := []struct {
+		name      string
+		token     string
+		client    func(c *pollClient)
+		closeCode int // of the read error of the handler, 0 if it does not read
+		expected  []string
+	}{
+		{
+			name:     "Invalid token",
+			token:    "invalid-token",
+			expected: []string{"close:1008"},
+		},
+		{
+			name:  "Client closes",
+			token: token,
+			client: func(c *pollClient) {
+				pollRequest(t, http.MethodDelete, c.url+"&code=4001", c.token, nil, nil)
+			},
+			closeCode: 4001,
+		},
+		{
+			name:      "Client stops polling",
+			token:     token,
+			client:    func(c *pollClient) {},
+			closeCode: websocket.CloseAbnormalClosure,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, _ := openPoll(t, server, url.Values{"token": {tc.token}})
+			if tc.client == nil {
+				if _, got := c.poll(); fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+					t.Errorf("Expected %q, got %q", tc.expected, got)
+				}
+				return
+			}
+			c.poll() // greeting
+			tc.client(c)
+			var closeErr *websocket.CloseError
+			select {
+			case err := <-closed:
+				if !errors.As(err, &closeErr) || closeErr.Code != tc.closeCode {
+					t.Errorf("Expected close %d, got %v", tc.closeCode, err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Expected the handler to return")
+			}
+			if code := pollRequest(t, http.MethodGet, c.url, c.token, nil, nil); code != http.StatusNotFound {
+				t.Errorf("Expected 404 after close, got %d", code)
+			}
+		})
+	}
+}
+
+// TestLongPollPanic tests that a panicking handler closes its session rather than the process.
+func TestLongPollPanic(t *testing.T) {
+	server := httptest.NewServer(WebSocketUpgradeWithConfig(&WebSocketConfig{
+		CORS:        &CORSConfig{AllowOrigin: "*"},
+		LongPolling: &LongPollConfig{PollTimeout: 50 * time.Millisecond},
+	}, func(conn *WebSocketConn, r *http.Request) {
+		panic("boom")
+	}))
+	defer server.Close()
+
+	c, _ := openPoll(t, server, url.Values{})
+	if _, got := c.poll(); fmt.Sprint(got) != "[close:1011]" {
+		t.Errorf("Expected close:1011, got %q", got)
+	}
+}
+
+// TestLongPollSessionBinding tests that the requests of a session must come from the client
+// that opened it.
+func TestLongPollSessionBinding(t *testing.T) {
+	secret := []byte("test-secret")
+	_, token, _ := auth.GenerateJWT(secret, uuid.New(), nil)
+	server := newPollServer(t, secret, &WebSocketConfig{
+		LongPolling: &LongPollConfig{PollTimeout: 50 * time.Millisecond},
+	}, make(chan error, 1))
+	client, _ := openPoll(t, server, url.Values{"token": {token}})
+
+	tests := []struct {
+		name     string
+		token    string
+		addr     string
+		expected int
+	}{
+		{name: "Missing token", expected: http.StatusForbidden},
+		{name: "Wrong token", token: "guessed", expected: http.StatusForbidden},
+		{name: "Other IP", token: client.token, addr: "203.0.113.7:4321", expected: http.StatusForbidden},
+		{name: "Session token", token: client.token, expected: http.StatusOK},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, client.url, nil)
+			req.RemoteAddr = "127.0.0.1:1234"
+			if tc.addr != "" {
+				req.RemoteAddr = tc.addr
+			}
+			if tc.token != "" {
+				req.Header.Set(PollTokenHeader, tc.token)
+			}
+			rr := httptest.NewRecorder()
+			server.Config.Handler.ServeHTTP(rr, req)
+			if rr.Code != tc.expected {
+				t.Errorf("Expected status %d, got %d", tc.expected, rr.Code)
+			}
+		})
+	}
+
+	// Sessions opened with claims, e.g. behind HTTPAuth, also need the same user's claims
+	alice := uuid.New()
+	session := &pollSession{token: "token", ip: "127.0.0.1", userID: alice}
+	for _, userID := range []uuid.UUID{alice, uuid.New(), uuid.Nil} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set(PollTokenHeader, "token")
+		if userID != uuid.Nil {
+			req = req.WithContext(context.WithValue(req.Context(), ClaimsKey, &auth.JWTClaims{UserID: userID}))
+		}
+		if ok := session.authorize(req); ok != (userID == alice) {
+			t.Errorf("Expected authorized=%t for user %s", userID == alice, userID)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package possum
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mikespook/possum/auth"
+	"github.com/mikespook/possum/log"
+)
+
+var (
+	ErrTOTPReplayed     = errors.New("TOTP code already used")
+	ErrRecoveryCodeUsed = errors.New("recovery code already used")
+)
+
+// MFAFactors are the second factors enrolled for a user.
+type MFAFactors struct {
+	TOTPSecret    string
+	LastTOTPStep  int64    // the last accepted TOTP time step, see auth.ValidateTOTP
+	RecoveryCodes []string // hashes from auth.GenerateRecoveryCodes
+}
+
+// MFAStore persists second factors for MFAVerify.
+// UpdateTOTPStep must atomically reject steps not greater than the stored one with ErrTOTPReplayed,
+// and ConsumeRecoveryCode must atomically remove the hash and return ErrRecoveryCodeUsed if it
+// was already gone, so that neither can be used twice by concurrent requests.
+// FindMFA may return nil factors for users without any.
+type MFAStore interface {
+	FindMFA(ctx context.Context, userID uuid.UUID) (*MFAFactors, error)
+	UpdateTOTPStep(ctx context.Context, userID uuid.UUID, step int64) error
+	ConsumeRecoveryCode(ctx context.Context, userID uuid.UUID, hash string) error
+}
+
+// MFARequest is the JSON body accepted by MFAVerify. Either Code or RecoveryCode must be set.
+type MFARequest struct {
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+// MFAVerify returns the step-up handler upgrading a first-factor token issued by Login.
+// The request must carry the MFAPending token as bearer token and a TOTP or recovery code;
+// on success it responds with a LoginResult holding a full token. Failures count towards a
+// per-user lockout with the same limits as Login.
+func MFAVerify(config *LoginConfig) http.HandlerFunc {
+	cfg := config.withDefaults()
+	lockout := newLoginLockout(cfg.LockoutCapacity)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			MethodNotAllowedResponse.Write(w)
+			return
+		}
+		// Pending tokens are encrypted like the tokens Login issues
+		claims, errResp := authenticate(&AuthConfig{Secret: cfg.Secret, DecryptionKey: cfg.EncryptionKey}, r)
+		if errResp != nil {
+			errResp.Write(w)
+			return
+		}
+		if !claims.MFAPending {
+			BadRequestResponse.Write(w)
+			return
+		}
+		var req MFARequest
+		body := http.MaxBytesReader(w, r.Body, maxLoginBodySize)
+		if err := json.NewDecoder(body).Decode(&req); err != nil || (req.Code == "") == (req.RecoveryCode == "") {
+			BadRequestResponse.Write(w)
+			return
+		}
+
+		key := "mfa/" + claims.UserID.String()
+		if wait := lockout.reserve(key, cfg.MaxFailures, cfg.LockoutDuration, time.Now()); wait > 0 {
+			writeTooManyRequests(w, wait)
+			return
+		}
+		factors, err := cfg.MFAStore.FindMFA(r.Context(), claims.UserID)
+		if err != nil {
+			lockout.release(key)
+			WriteResponse(w, InternalServerErrorResponse, err)
+			return
+		}
+
+		ok, err := verifySecondFactor(r.Context(), cfg, claims.UserID, factors, &req)
+		if err != nil && !errors.Is(err, ErrTOTPReplayed) && !errors.Is(err, ErrRecoveryCodeUsed) {
+			lockout.release(key)
+			WriteResponse(w, InternalServerErrorResponse, err)
+			return
+		}
+		if !ok {
+			lockout.fail(key, cfg.MaxFailures, cfg.LockoutDuration, time.Now())
+			UnauthorizedResponse.Write(w)
+			return
+		}
+		lockout.reset(key)
+		log.Info().Str("user_id", claims.UserID.String()).Bool("recovery_code", req.RecoveryCode != "").Msg("mfa verified")
+
+		cfg.issueToken(w, r, claims.UserID, false)
+	}
+}
+
+// verifySecondFactor checks the TOTP or recovery code of req and records its use. Users without
+// factors have none to verify.
+func verifySecondFactor(ctx context.Context, config *LoginConfig, userID uuid.UUID, factors *MFAFactors, req *MFARequest) (bool, error) {
+	if factors == nil {
+		return false, nil
+	}
+	if req.RecoveryCode != "" {
+		index := auth.VerifyRecoveryCode(factors.RecoveryCodes, req.RecoveryCode)
+		if index < 0 {
+			return false, nil
+		}
+		// factors may be stale: the store decides whether the code is still unused
+		if err := config.MFAStore.ConsumeRecoveryCode(ctx, userID, factors.RecoveryCodes[index]); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if factors.TOTPSecret == "" {
+		return false, nil
+	}
+	step, ok := auth.ValidateTOTP(config.TOTP, factors.TOTPSecret, req.Code, time.Now(), factors.LastTOTPStep)
+	if !ok {
+		return false, nil
+	}
+	if err := config.MFAStore.UpdateTOTPStep(ctx, userID, step); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,177 @@
+package possum
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mikespook/possum/auth"
+)
+
+// memoryMFAStore is an in-memory MFAStore for testing.
+type memoryMFAStore struct {
+	sync.Mutex
+	factors map[uuid.UUID]*MFAFactors
+}
+
+func (s *memoryMFAStore) FindMFA(_ context.Context, userID uuid.UUID) (*MFAFactors, error) {
+	s.Lock()
+	defer s.Unlock()
+	factors, ok := s.factors[userID]
+	if !ok {
+		return nil, nil
+	}
+	copied := *factors
+	copied.RecoveryCodes = append([]string(nil), copied.RecoveryCodes...)
+	return &copied, nil
+}
+
+func (s *memoryMFAStore) UpdateTOTPStep(_ context.Context, userID uuid.UUID, step int64) error {
+	s.Lock()
+	defer s.Unlock()
+	if step <= s.factors[userID].LastTOTPStep {
+		return ErrTOTPReplayed
+	}
+	s.factors[userID].LastTOTPStep = step
+	return nil
+}
+
+func (s *memoryMFAStore) ConsumeRecoveryCode(_ context.Context, userID uuid.UUID, hash string) error {
+	s.Lock()
+	defer s.Unlock()
+	factors := s.factors[userID]
+	for i, h := range factors.RecoveryCodes {
+		if h == hash {
+			factors.RecoveryCodes = append(factors.RecoveryCodes[:i], factors.RecoveryCodes[i+1:]...)
+			return nil
+		}
+	}
+	return ErrRecoveryCodeUsed
+}
+
+// decodeLoginResult decodes the LoginResult of a response.
+func decodeLoginResult(t *testing.T, rr *httptest.ResponseRecorder) LoginResult {
+	t.Helper()
+	var resp struct {
+		Data LoginResult `json:"data"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return resp.Data
+}
+
+// TestMFAVerify tests the step-up flow from a first-factor token to a full token.
+func TestMFAVerify(t *testing.T) {
+	secret := []byte("test-secret")
+	totpSecret, _ := auth.GenerateTOTPSecret()
+	recoveryCodes, recoveryHashes, _ := auth.GenerateRecoveryCodes(2)
+	hash, _ := auth.HashPassword("correct horse")
+	userID := uuid.New()
+	users := &memoryUserStore{users: map[string]*User{
+		"admin": {ID: userID, PasswordHash: hash, MFAEnabled: true},
+	}}
+	mfaStore := &memoryMFAStore{factors: map[uuid.UUID]*MFAFactors{
+		userID: {TOTPSecret: totpSecret, RecoveryCodes: recoveryHashes},
+	}}
+	config := &LoginConfig{Secret: secret, Store: users, MFAStore: mfaStore}
+	login := Login(config)
+	verify := MFAVerify(config)
+	protected := HTTPAuth(secret, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	request := func(handler http.HandlerFunc, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	// The password alone yields a pending token that protected routes reject
+	rr := postLogin(login, "admin", "correct horse")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+	pending := decodeLoginResult(t, rr)
+	if !pending.MFARequired {
+		t.Fatal("Expected MFARequired in login result")
+	}
+	if rr := request(protected, pending.Token, ""); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d for pending token, got %d", http.StatusForbidden, rr.Code)
+	}
+
+	// Wrong codes are rejected
+	if rr := request(verify, pending.Token, `{"code":"000000"}`); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for wrong code, got %d", http.StatusUnauthorized, rr.Code)
+	}
+	if rr := request(verify, pending.Token, `{}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for missing code, got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	// A valid TOTP code upgrades the token
+	code, _ := auth.TOTPCode(auth.TOTPConfig{}, totpSecret, time.Now())
+	rr = request(verify, pending.Token, `{"code":"`+code+`"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d for valid code, got %d", http.StatusOK, rr.Code)
+	}
+	full := decodeLoginResult(t, rr)
+	if full.MFARequired {
+		t.Error("Expected upgraded token not to require MFA")
+	}
+	if rr := request(protected, full.Token, ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected status %d for upgraded token, got %d", http.StatusOK, rr.Code)
+	}
+
+	// Full tokens cannot be used for the step-up and codes cannot be replayed
+	if rr := request(verify, full.Token, `{"code":"`+code+`"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for full token, got %d", http.StatusBadRequest, rr.Code)
+	}
+	if rr := request(verify, pending.Token, `{"code":"`+code+`"}`); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for replayed code, got %d", http.StatusUnauthorized, rr.Code)
+	}
+
+	// Recovery codes work once
+	body := `{"recovery_code":"` + recoveryCodes[1] + `"}`
+	if rr := request(verify, pending.Token, body); rr.Code != http.StatusOK {
+		t.Errorf("Expected status %d for recovery code, got %d", http.StatusOK, rr.Code)
+	}
+	if rr := request(verify, pending.Token, body); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for used recovery code, got %d", http.StatusUnauthorized, rr.Code)
+	}
+
+	// Users without factors cannot complete the step-up
+	claims := auth.NewClaims(uuid.New(), nil)
+	claims.MFAPending = true
+	unenrolled, _ := auth.SignToken(secret, claims)
+	if rr := request(verify, unenrolled, `{"code":"`+code+`"}`); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d without factors, got %d", http.StatusUnauthorized, rr.Code)
+	}
+}
+
+// TestVerifySecondFactorRecoveryCodeUsed tests that a recovery code is accepted once when
+// concurrent requests loaded the same factors before either consumed it.
+func TestVerifySecondFactorRecoveryCodeUsed(t *testing.T) {
+	codes, hashes, _ := auth.GenerateRecoveryCodes(1)
+	userID := uuid.New()
+	store := &memoryMFAStore{factors: map[uuid.UUID]*MFAFactors{
+		userID: {RecoveryCodes: hashes},
+	}}
+	config := &LoginConfig{MFAStore: store}
+	factors, _ := store.FindMFA(context.Background(), userID)
+	req := &MFARequest{RecoveryCode: codes[0]}
+
+	if ok, err := verifySecondFactor(context.Background(), config, userID, factors, req); !ok || err != nil {
+		t.Fatalf("Expected the first use to succeed, got %t, %v", ok, err)
+	}
+	if ok, err := verifySecondFactor(context.Background(), config, userID, factors, req); ok || err != ErrRecoveryCodeUsed {
+		t.Errorf("Expected ErrRecoveryCodeUsed for the stale factors, got %t, %v", ok, err)
+	}
+}
@@ -0,0 +1,405 @@
+package possum
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/mikespook/possum/log"
+)
+
+const (
+	// Operations of a MuxFrame
+	MuxOpen   = "open"
+	MuxData   = "data"
+	MuxClose  = "close"
+	MuxCredit = "credit"
+
+	// ChannelCloseNotFound closes channels opened with an unknown name.
+	ChannelCloseNotFound = 4404
+)
+
+var (
+	ErrChannelClosed = errors.New("websocket channel closed")
+)
+
+// MuxFrame is the JSON text frame carrying the logical channels of a Mux. A client opens a
+// channel with {"op":"open","channel":"1","name":"chat"}, exchanges "data" frames and closes it
+// with {"op":"close","channel":"1","code":1000}, which the server acknowledges with the same
+// close frame; the client acknowledges the server's close frames likewise. Either side receives at most as many data
+// frames as it granted with its "credit" frames, plus the initial window: the client's is the
+// credit of its open frame, the server's is sent back as credit right after the open.
+type MuxFrame struct {
+	Op      string          `json:"op"`
+	Channel string          `json:"channel"`
+	Name    string          `json:"name,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Credit  int             `json:"credit,omitempty"`
+	Code    int             `json:"code,omitempty"`
+	Reason  string          `json:"reason,omitempty"`
+}
+
+// ChannelCloseError is returned by Channel.Read after the client closed the channel.
+type ChannelCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *ChannelCloseError) Error() string {
+	return fmt.Sprintf("websocket channel closed by peer: %d %s", e.Code, e.Reason)
+}
+
+// ChannelHandlerFunc serves a logical channel. The channel is closed normally when it returns
+// and with websocket.CloseInternalServerErr if it panics.
+type ChannelHandlerFunc func(ch *Channel)
+
+// MuxConfig configures a Mux.
+type MuxConfig struct {
+	Window      int `mapstructure:"window,omitempty"`       // data frames in flight per channel and direction, default 16
+	MaxChannels int `mapstructure:"max_channels,omitempty"` // open channels per connection, default 32
+}
+
+var defaultMuxConfig = &MuxConfig{
+	Window:      16,
+	MaxChannels: 32,
+}
+
+// Mux multiplexes logical channels over a single WebSocket connection, so a client
+// authenticates once and reaches several handlers by name. Each channel has its own handler
+// goroutine, flow control window and close handshake: a slow or closed channel does not affect
+// the others. Mount ServeWebSocket as the WebsocketHandlerFunc of an endpoint.
+type Mux struct {
+	config *MuxConfig
+
+	mu       sync.RWMutex
+	handlers map[string]ChannelHandlerFunc
+}
+
+// NewMux creates a mux without handlers; zero values of config fall back to the defaults.
+func NewMux(config *MuxConfig) *Mux {
+	cfg := *defaultMuxConfig
+	if config != nil {
+		if config.Window != 0 {
+			cfg.Window = config.Window
+		}
+		if config.MaxChannels != 0 {
+			cfg.MaxChannels = config.MaxChannels
+		}
+	}
+	return &Mux{config: &cfg, handlers: make(map[string]ChannelHandlerFunc)}
+}
+
+// Handle registers the handler of the channels opened with name.
+func (m *Mux) Handle(name string, handler ChannelHandlerFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[name] = handler
+}
+
+// muxConn is the state of a Mux on one connection.
+type muxConn struct {
+	mux  *Mux
+	conn *WebSocketConn
+	r    *http.Request
+
+	mu       sync.Mutex
+	channels map[string]*Channel
+	wg       sync.WaitGroup
+}
+
+// ServeWebSocket serves the channels of a connection until it is closed, then closes the
+// channels and waits for their handlers.
+func (m *Mux) ServeWebSocket(conn *WebSocketConn, r *http.Request) {
+	mc := &muxConn{mux: m, conn: conn, r: r, channels: make(map[string]*Channel)}
+	defer mc.wg.Wait()
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			mc.closeAll()
+			return
+		}
+		var frame MuxFrame
+		if err := json.Unmarshal(data, &frame); err != nil || frame.Channel == "" {
+			log.Debug().Err(err).Str("remote_addr", conn.RemoteAddr().String()).Msg("invalid mux frame")
+			continue
+		}
+		mc.handleFrame(&frame)
+	}
+}
+
+func (mc *muxConn) handleFrame(frame *MuxFrame) {
+	if frame.Op == MuxOpen {
+		mc.open(frame)
+		return
+	}
+	mc.mu.Lock()
+	ch, ok := mc.channels[frame.Channel]
+	mc.mu.Unlock()
+	if !ok {
+		// Closed meanwhile, frames in flight are dropped
+		return
+	}
+	switch frame.Op {
+	case MuxData:
+		ch.deliver(frame.Data)
+	case MuxCredit:
+		ch.grant(frame.Credit)
+	case MuxClose:
+		if ch.terminate(&ChannelCloseError{Code: frame.Code, Reason: frame.Reason}) {
+			// Acknowledge, so the client knows the channel ID can be reused
+			mc.conn.SendJSON(&MuxFrame{Op: MuxClose, Channel: ch.id, Code: frame.Code})
+		}
+	}
+}
+
+// open starts the handler of a channel opened by the client.
+func (mc *muxConn) open(frame *MuxFrame) {
+	mc.mux.mu.RLock()
+	handler, ok := mc.mux.handlers[frame.Name]
+	mc.mux.mu.RUnlock()
+
+	mc.mu.Lock()
+	code, reason := 0, ""
+	switch _, exists := mc.channels[frame.Channel]; {
+	case exists:
+		code, reason = websocket.ClosePolicyViolation, "Channel already open"
+	case !ok:
+		code, reason = ChannelCloseNotFound, "Unknown channel"
+	case len(mc.channels) >= mc.mux.config.MaxChannels:
+		code, reason = websocket.CloseTryAgainLater, "Too many channels"
+	}
+	if code != 0 {
+		mc.mu.Unlock()
+		mc.conn.SendJSON(&MuxFrame{Op: MuxClose, Channel: frame.Channel, Code: code, Reason: reason})
+		return
+	}
+	credit := frame.Credit
+	if credit <= 0 {
+		credit = mc.mux.config.Window
+	}
+	ch := newChannel(mc, frame.Channel, frame.Name, credit)
+	mc.channels[ch.id] = ch
+	mc.mu.Unlock()
+
+	mc.conn.SendJSON(&MuxFrame{Op: MuxCredit, Channel: ch.id, Credit: mc.mux.config.Window})
+	mc.wg.Add(1)
+	go func() {
+		defer mc.wg.Done()
+		defer func() {
+			// A panicking handler only takes its own channel down
+			if err := recover(); err != nil {
+				log.Error().Interface("panic", err).Str("channel", ch.id).Str("name", ch.name).Str("stack", string(debug.Stack())).Msg("channel handler panicked")
+				ch.Close(websocket.CloseInternalServerErr, "")
+				return
+			}
+			ch.Close(websocket.CloseNormalClosure, "")
+		}()
+		handler(ch)
+	}()
+}
+
+// remove forgets a closed channel, so its ID can be reused.
+func (mc *muxConn) remove(ch *Channel) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.channels[ch.id] == ch {
+		delete(mc.channels, ch.id)
+	}
+}
+
+// closeAll terminates the channels when the connection is gone.
+func (mc *muxConn) closeAll() {
+	mc.mu.Lock()
+	channels := make([]*Channel, 0, len(mc.channels))
+	for _, ch := range mc.channels {
+		channels = append(channels, ch)
+	}
+	mc.mu.Unlock()
+	for _, ch := range channels {
+		ch.terminate(ErrConnClosed)
+	}
+}
+
+// Channel is a logical stream of a Mux connection. Its methods are safe for concurrent use.
+type Channel struct {
+	id   string
+	name string
+	mc   *muxConn
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	incoming chan json.RawMessage
+
+	mu       sync.Mutex
+	credit   int
+	pending  []json.RawMessage
+	received int
+	closed   bool
+	err      error
+}
+
+func newChannel(mc *muxConn, id, name string, credit int) *Channel {
+	ctx, cancel := context.WithCancel(mc.conn.Context())
+	return &Channel{
+		id:       id,
+		name:     name,
+		mc:       mc,
+		ctx:      ctx,
+		cancel:   cancel,
+		incoming: make(chan json.RawMessage, mc.mux.config.Window),
+		credit:   credit,
+	}
+}
+
+// ID returns the channel ID chosen by the client.
+func (ch *Channel) ID() string {
+	return ch.id
+}
+
+// Name returns the handler name the channel was opened with.
+func (ch *Channel) Name() string {
+	return ch.name
+}
+
+// Conn returns the physical connection.
+func (ch *Channel) Conn() *WebSocketConn {
+	return ch.mc.conn
+}
+
+// Request returns the upgrade request of the connection.
+func (ch *Channel) Request() *http.Request {
+	return ch.mc.r
+}
+
+// Context returns a context derived from the connection's, cancelled when the channel closes.
+func (ch *Channel) Context() context.Context {
+	return ch.ctx
+}
+
+// Send queues a JSON value for the client without blocking. Data beyond the client's credit
+// waits in the channel for more credit, up to the window; then ErrSendQueueFull is returned.
+func (ch *Channel) Send(data json.RawMessage) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.closed {
+		return ErrChannelClosed
+	}
+	if ch.credit > 0 && len(ch.pending) == 0 {
+		// Credit is only spent on data the connection accepted
+		if err := ch.mc.conn.SendJSON(&MuxFrame{Op: MuxData, Channel: ch.id, Data: data}); err != nil {
+			return err
+		}
+		ch.credit--
+		return nil
+	}
+	if len(ch.pending) >= ch.mc.mux.config.Window {
+		return ErrSendQueueFull
+	}
+	ch.pending = append(ch.pending, data)
+	return nil
+}
+
+// SendJSON encodes v as JSON and sends it.
+func (ch *Channel) SendJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ch.Send(data)
+}
+
+// Read returns the next data of the channel. Once the channel is closed it returns a
+// *ChannelCloseError if the client closed it and ErrChannelClosed otherwise.
+func (ch *Channel) Read() (json.RawMessage, error) {
+	var data json.RawMessage
+	select {
+	case data = <-ch.incoming:
+	default:
+		select {
+		case data = <-ch.incoming:
+		case <-ch.ctx.Done():
+			ch.mu.Lock()
+			defer ch.mu.Unlock()
+			if closeErr, ok := ch.err.(*ChannelCloseError); ok {
+				return nil, closeErr
+			}
+			return nil, ErrChannelClosed
+		}
+	}
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.received++
+	// Grant credit in batches rather than frame by frame
+	if ch.received >= (ch.mc.mux.config.Window+1)/2 && !ch.closed {
+		ch.mc.conn.SendJSON(&MuxFrame{Op: MuxCredit, Channel: ch.id, Credit: ch.received})
+		ch.received = 0
+	}
+	return data, nil
+}
+
+// ReadJSON reads the next data and decodes it into v.
+func (ch *Channel) ReadJSON(v any) error {
+	data, err := ch.Read()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Close closes the channel with a close code and reason; the connection and its other channels
+// stay open. Close is idempotent.
+func (ch *Channel) Close(code int, reason string) error {
+	if ch.terminate(ErrChannelClosed) {
+		ch.mc.conn.SendJSON(&MuxFrame{Op: MuxClose, Channel: ch.id, Code: code, Reason: reason})
+	}
+	return nil
+}
+
+// deliver queues data from the client. A client sending beyond its credit has ignored flow
+// control, so the channel is closed.
+func (ch *Channel) deliver(data json.RawMessage) {
+	select {
+	case ch.incoming <- data:
+	default:
+		ch.Close(websocket.ClosePolicyViolation, "Flow control window exceeded")
+	}
+}
+
+// grant adds credit from the client and sends the data waiting for it.
+func (ch *Channel) grant(credit int) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.credit += credit
+	for ch.credit > 0 && len(ch.pending) > 0 && !ch.closed {
+		if err := ch.mc.conn.SendJSON(&MuxFrame{Op: MuxData, Channel: ch.id, Data: ch.pending[0]}); err != nil {
+			// Keep the data and the credit for the next grant
+			return
+		}
+		ch.pending[0] = nil
+		ch.pending = ch.pending[1:]
+		ch.credit--
+	}
+}
+
+// terminate marks the channel closed with err and reports whether it was still open.
+func (ch *Channel) terminate(err error) bool {
+	ch.mu.Lock()
+	if ch.closed {
+		ch.mu.Unlock()
+		return false
+	}
+	ch.closed = true
+	ch.err = err
+	ch.pending = nil
+	ch.mu.Unlock()
+	ch.cancel()
+	ch.mc.remove(ch)
+	return true
+}
@@ -0,0 +1,216 @@
+package possum
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestMux serves a mux with echo, burst, sink, done and panic channels.
+func newTestMux(t *testing.T, closed chan<- error) *websocket.Conn {
+	t.Helper()
+	mux := NewMux(&MuxConfig{Window: 2, MaxChannels: 3})
+	mux.Handle("echo", func(ch *Channel) {
+		for {
+			data, err := ch.Read()
+			if err != nil {
+				closed <- err
+				return
+			}
+			ch.Send(data)
+		}
+	})
+	mux.Handle("burst", func(ch *Channel) {
+		// One for the credit of the client and two waiting in the window
+		for i := range 3 {
+			if err := ch.SendJSON(i); err != nil {
+				t.Errorf("Failed to send %d: %v", i, err)
+			}
+		}
+		if err := ch.SendJSON("overflow"); !errors.Is(err, ErrSendQueueFull) {
+			t.Errorf("Expected ErrSendQueueFull, got %v", err)
+		}
+		<-ch.Context().Done()
+	})
+	mux.Handle("sink", func(ch *Channel) {
+		<-ch.Context().Done()
+	})
+	mux.Handle("done", func(ch *Channel) {})
+	mux.Handle("panic", func(ch *Channel) {
+		panic("boom")
+	})
+	return dialWebSocket(t, nil, func(conn *WebSocketConn, r *http.Request) {
+		mux.ServeWebSocket(conn, r)
+	})
+}
+
+func writeFrame(t *testing.T, ws *websocket.Conn, frame MuxFrame) {
+	t.Helper()
+	if err := ws.WriteJSON(&frame); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+}
+
+// readFrames reads n frames and formats them as "op channel data|code".
+func readFrames(t *testing.T, ws *websocket.Conn, n int) []string {
+	t.Helper()
+	var frames []string
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer ws.SetReadDeadline(time.Time{})
+	for range n {
+		var frame MuxFrame
+		if err := ws.ReadJSON(&frame); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		switch frame.Op {
+		case MuxData:
+			frames = append(frames, fmt.Sprintf("data %s %s", frame.Channel, frame.Data))
+		case MuxCredit:
+			frames = append(frames, fmt.Sprintf("credit %s %d", frame.Channel, frame.Credit))
+		default:
+			frames = append(frames, fmt.Sprintf("%s %s %d", frame.Op, frame.Channel, frame.Code))
+		}
+	}
+	return frames
+}
+
+func assertFrames(t *testing.T, expected, got []string) {
+	t.Helper()
+	if fmt.Sprint(expected) != fmt.Sprint(got) {
+		t.Errorf("Expected frames %q, got %q", expected, got)
+	}
+}
+
+// TestMuxChannels tests that channels of one connection are routed and closed independently.
+func TestMuxChannels(t *testing.T) {
+	closed := make(chan error, 1)
+	ws := newTestMux(t, closed)
+
+	writeFrame(t, ws, MuxFrame{Op: MuxOpen, Channel: "a", Name: "echo"})
+	writeFrame(t, ws, MuxFrame{Op: MuxOpen, Channel: "b", Name: "echo"})
+	assertFrames(t, []string{"credit a 2", "credit b 2"}, readFrames(t, ws, 2))
+
+	writeFrame(t, ws, MuxFrame{Op: MuxData, Channel: "b", Data: json.RawMessage(`"to b"`)})
+	assertFrames(t, []string{"credit b 1", "data b \"to b\""}, readFrames(t, ws, 2))
+	writeFrame(t, ws, MuxFrame{Op: MuxData, Channel: "a", Data: json.RawMessage(`{"n":1}`)})
+	assertFrames(t, []string{"credit a 1", "data a {\"n\":1}"}, readFrames(t, ws, 2))
+
+	writeFrame(t, ws, MuxFrame{Op: MuxClose, Channel: "a", Code: 4000, Reason: "bye"})
+	var closeErr *ChannelCloseError
+	if err := <-closed; !errors.As(err, &closeErr) || closeErr.Code != 4000 || closeErr.Reason != "bye" {
+		t.Errorf("Expected close 4000 bye, got %v", err)
+	}
+	// The server acknowledges the client's close frame, then b is served as before
+	writeFrame(t, ws, MuxFrame{Op: MuxData, Channel: "b", Data: json.RawMessage(`2`)})
+	assertFrames(t, []string{"close a 4000", "credit b 1", "data b 2"}, readFrames(t, ws, 3))
+}
+
+// TestMuxOpen tests the close codes of channels that cannot be opened or whose handler returns.
+func TestMuxOpen(t *testing.T) {
+	ws := newTestMux(t, make(chan error, 4))
+
+	tests := []struct {
+		name     string
+		frame    MuxFrame
+		expected []string
+	}{
+		{
+			name:     "Handler returns",
+			frame:    MuxFrame{Op: MuxOpen, Channel: "1", Name: "done"},
+			expected: []string{"credit 1 2", "close 1 1000"},
+		},
+		{
+			name:     "Handler panics",
+			frame:    MuxFrame{Op: MuxOpen, Channel: "p", Name: "panic"},
+			expected: []string{"credit p 2", "close p 1011"},
+		},
+		{
+			name:     "Unknown name",
+			frame:    MuxFrame{Op: MuxOpen, Channel: "2", Name: "missing"},
+			expected: []string{"close 2 4404"},
+		},
+		{
+			name:     "Open",
+			frame:    MuxFrame{Op: MuxOpen, Channel: "3", Name: "sink"},
+			expected: []string{"credit 3 2"},
+		},
+		{
+			name:     "Already open",
+			frame:    MuxFrame{Op: MuxOpen, Channel: "3", Name: "sink"},
+			expected: []string{"close 3 1008"},
+		},
+		{
+			name:     "Second",
+			frame:    MuxFrame{Op: MuxOpen, Channel: "4", Name: "sink"},
+			expected: []string{"credit 4 2"},
+		},
+		{
+			name:     "Third",
+			frame:    MuxFrame{Op: MuxOpen, Channel: "5", Name: "sink"},
+			expected: []string{"credit 5 2"},
+		},
+		{
+			name:     "Too many channels",
+			frame:    MuxFrame{Op: MuxOpen, Channel: "6", Name: "sink"},
+			expected: []string{"close 6 1013"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			writeFrame(t, ws, tc.frame)
+			assertFrames(t, tc.expected, readFrames(t, ws, len(tc.expected)))
+		})
+	}
+}
+
+// TestMuxFlowControl tests that each direction respects the credit granted by the other.
+func TestMuxFlowControl(t *testing.T) {
+	ws := newTestMux(t, make(chan error, 1))
+
+	// The server holds back what exceeds the client's credit
+	writeFrame(t, ws, MuxFrame{Op: MuxOpen, Channel: "burst", Name: "burst", Credit: 1})
+	assertFrames(t, []string{"credit burst 2", "data burst 0"}, readFrames(t, ws, 2))
+	writeFrame(t, ws, MuxFrame{Op: MuxCredit, Channel: "burst", Credit: 3})
+	assertFrames(t, []string{"data burst 1", "data burst 2"}, readFrames(t, ws, 2))
+
+	// A client ignoring the server's window only loses its channel
+	writeFrame(t, ws, MuxFrame{Op: MuxOpen, Channel: "sink", Name: "sink"})
+	assertFrames(t, []string{"credit sink 2"}, readFrames(t, ws, 1))
+	for i := range 3 {
+		writeFrame(t, ws, MuxFrame{Op: MuxData, Channel: "sink", Data: json.RawMessage(fmt.Sprint(i))})
+	}
+	assertFrames(t, []string{"close sink 1008"}, readFrames(t, ws, 1))
+	writeFrame(t, ws, MuxFrame{Op: MuxOpen, Channel: "echo", Name: "echo"})
+	assertFrames(t, []string{"credit echo 2"}, readFrames(t, ws, 1))
+}
+
+// TestMuxSendFailure tests that data the connection does not accept spends no credit.
+func TestMuxSendFailure(t *testing.T) {
+	cfg := (&WebSocketConfig{SendQueueSize: 1}).withDefaults()
+	conn := newWebSocketConn(nil, cfg, httptest.NewRequest(http.MethodGet, "/", nil))
+	mc := &muxConn{mux: NewMux(nil), conn: conn, channels: make(map[string]*Channel)}
+	ch := newChannel(mc, "1", "test", 2)
+
+	if err := ch.Send(json.RawMessage(`1`)); err != nil {
+		t.Fatalf("Failed to send: %v", err)
+	}
+	if err := ch.Send(json.RawMessage(`2`)); !errors.Is(err, ErrSendQueueFull) {
+		t.Errorf("Expected ErrSendQueueFull, got %v", err)
+	}
+	if ch.credit != 1 {
+		t.Errorf("Expected 1 credit left, got %d", ch.credit)
+	}
+	conn.Close(websocket.CloseNormalClosure, "")
+	if err := ch.Send(json.RawMessage(`3`)); !errors.Is(err, ErrConnClosed) {
+		t.Errorf("Expected ErrConnClosed, got %v", err)
+	}
+	if ch.credit != 1 {
+		t.Errorf("Expected 1 credit left, got %d", ch.credit)
+	}
+}
@@ -0,0 +1,234 @@
+package possum
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Types of a PresenceEvent
+	PresenceJoin   = "join"
+	PresenceLeave  = "leave"
+	PresenceTyping = "typing"
+)
+
+// PresenceEvent reports a change of presence. An empty Room means the user came online or went
+// offline; otherwise the user entered or left the room, or is typing in it.
+type PresenceEvent struct {
+	Type   string    `json:"type"`
+	UserID uuid.UUID `json:"user_id"`
+	Room   string    `json:"room,omitempty"`
+}
+
+// PresenceConfig configures presence tracking.
+type PresenceConfig struct {
+	// Debounce delays leave events; a user reconnecting or rejoining within it emits nothing.
+	Debounce time.Duration `mapstructure:"debounce,omitempty"` // default 5s
+	// TypingInterval is the minimum interval between typing events of a user in a room.
+	TypingInterval time.Duration `mapstructure:"typing_interval,omitempty"` // default 3s
+}
+
+var defaultPresenceConfig = &PresenceConfig{
+	Debounce:       5 * time.Second,
+	TypingInterval: 3 * time.Second,
+}
+
+// presenceState is the presence of a user in a room, or online for the empty room.
+type presenceState struct {
+	conns int
+	// leaving counts the scheduled leave events; a timer only fires for the latest one
+	leaving int
+	timer   *time.Timer
+	typing  time.Time
+}
+
+// Presence tracks which users are online and in which rooms from the connections of a hub.
+// A user is present as long as any of their connections is, so users with several devices
+// come online once and go offline with their last connection. Only authenticated connections
+// count, and only those of the local hub: every node tracks its own connections.
+type Presence struct {
+	hub    *Hub
+	config *PresenceConfig
+	subscribers[PresenceEvent]
+
+	mu      sync.Mutex
+	members map[string]map[uuid.UUID]*presenceState
+	pending []PresenceEvent
+	notify  chan struct{}
+	done    chan struct{}
+	stopped sync.Once
+}
+
+// NewPresence starts tracking the connections of hub; zero values of config fall back to the
+// defaults. A hub has at most one Presence: a new one replaces and stops the previous.
+func NewPresence(hub *Hub, config *PresenceConfig) *Presence {
+	cfg := *defaultPresenceConfig
+	if config != nil {
+		if config.Debounce != 0 {
+			cfg.Debounce = config.Debounce
+		}
+		if config.TypingInterval != 0 {
+			cfg.TypingInterval = config.TypingInterval
+		}
+	}
+	p := &Presence{
+		hub:     hub,
+		config:  &cfg,
+		members: make(map[string]map[uuid.UUID]*presenceState),
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go p.run()
+	if previous := hub.setPresence(p); previous != nil {
+		previous.stop()
+	}
+	return p
+}
+
+// Subscribe registers handler for every event and returns a function removing it. Handlers
+// run one at a time in the order of the events, and may broadcast through the hub.
+func (p *Presence) Subscribe(handler func(event PresenceEvent)) (unsubscribe func()) {
+	return p.add(handler)
+}
+
+// Close stops tracking the hub and delivering events. It is idempotent.
+func (p *Presence) Close() {
+	p.hub.removePresence(p)
+	p.stop()
+}
+
+// stop ends the dispatcher goroutine and the pending leave timers.
+func (p *Presence) stop() {
+	p.stopped.Do(func() {
+		close(p.done)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for _, users := range p.members {
+			for _, state := range users {
+				if state.timer != nil {
+					state.timer.Stop()
+				}
+			}
+		}
+	})
+}
+
+// Online reports whether a user is online. Like RoomMembers, it agrees with the events: a user
+// whose last connection closed is online until the debounce delay emits the leave event.
+func (p *Presence) Online(userID uuid.UUID) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.members[""][userID]
+	return ok
+}
+
+// OnlineUsers returns the users online.
+func (p *Presence) OnlineUsers() []uuid.UUID {
+	return p.RoomMembers("")
+}
+
+// RoomMembers returns the online members of a room, including those whose leave event is still
+// debounced. Filtering them would hide a user who reconnects in time, since that emits no join.
+func (p *Presence) RoomMembers(room string) []uuid.UUID {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	users := make([]uuid.UUID, 0, len(p.members[room]))
+	for userID := range p.members[room] {
+		users = append(users, userID)
+	}
+	return users
+}
+
+// Typing emits a typing event for a member of a room, at most once per TypingInterval, so it
+// can be called on every keystroke. Users who are not in the room are ignored.
+func (p *Presence) Typing(userID uuid.UUID, room string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state, ok := p.members[room][userID]
+	if !ok || room == "" || time.Since(state.typing) < p.config.TypingInterval {
+		return
+	}
+	state.typing = time.Now()
+	p.emit(PresenceEvent{Type: PresenceTyping, UserID: userID, Room: room})
+}
+
+// enter counts a connection of a user entering a room; it is called by the hub under its lock.
+func (p *Presence) enter(userID uuid.UUID, room string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	users, ok := p.members[room]
+	if !ok {
+		users = make(map[uuid.UUID]*presenceState)
+		p.members[room] = users
+	}
+	state, ok := users[userID]
+	if !ok {
+		state = &presenceState{}
+		users[userID] = state
+		p.emit(PresenceEvent{Type: PresenceJoin, UserID: userID, Room: room})
+	}
+	state.conns++
+	if state.timer != nil {
+		// Back before the leave was announced
+		state.timer.Stop()
+		state.timer = nil
+	}
+}
+
+// exit counts a connection of a user leaving a room; it is called by the hub under its lock.
+// The leave event is only emitted if the user does not come back within the debounce delay.
+func (p *Presence) exit(userID uuid.UUID, room string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	state, ok := p.members[room][userID]
+	if !ok {
+		return
+	}
+	state.conns--
+	if state.conns > 0 {
+		return
+	}
+	state.leaving++
+	leaving := state.leaving
+	state.timer = time.AfterFunc(p.config.Debounce, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if state.conns > 0 || state.leaving != leaving {
+			return
+		}
+		delete(p.members[room], userID)
+		if len(p.members[room]) == 0 {
+			delete(p.members, room)
+		}
+		p.emit(PresenceEvent{Type: PresenceLeave, UserID: userID, Room: room})
+	})
+}
+
+// emit queues an event for the dispatcher goroutine; p.mu must be held.
+func (p *Presence) emit(event PresenceEvent) {
+	p.pending = append(p.pending, event)
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers the queued events until Close.
+func (p *Presence) run() {
+	for {
+		select {
+		case <-p.notify:
+			p.mu.Lock()
+			events := p.pending
+			p.pending = nil
+			p.mu.Unlock()
+			for _, event := range events {
+				p.dispatch(event)
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
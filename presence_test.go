@@ -0,0 +1,238 @@
+package possum
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// newTestPresence tracks a new hub with a short debounce and collects its events.
+func newTestPresence(t *testing.T) (*Hub, *Presence, <-chan PresenceEvent) {
+	t.Helper()
+	hub := NewHub()
+	p := NewPresence(hub, &PresenceConfig{Debounce: 50 * time.Millisecond, TypingInterval: time.Hour})
+	t.Cleanup(p.Close)
+	events := make(chan PresenceEvent, 64)
+	p.Subscribe(func(event PresenceEvent) {
+		events <- event
+	})
+	return hub, p, events
+}
+
+// collect returns the events received within d, sorted for comparison.
+func collect(events <-chan PresenceEvent, d time.Duration) []string {
+	var got []string
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case event := <-events:
+			got = append(got, fmt.Sprintf("%s %s %s", event.Type, event.UserID, event.Room))
+		case <-timer.C:
+			sort.Strings(got)
+			return got
+		}
+	}
+}
+
+func formatEvents(events ...PresenceEvent) []string {
+	var formatted []string
+	for _, event := range events {
+		formatted = append(formatted, fmt.Sprintf("%s %s %s", event.Type, event.UserID, event.Room))
+	}
+	sort.Strings(formatted)
+	return formatted
+}
+
+// TestPresence tests join and leave events of users with several connections and flapping ones.
+func TestPresence(t *testing.T) {
+	alice, bob := uuid.New(), uuid.New()
+
+	tests := []struct {
+		name     string
+		run      func(hub *Hub, p *Presence)
+		expected []PresenceEvent
+		online   []uuid.UUID
+		members  []uuid.UUID
+	}{
+		{
+			name: "Join",
+			run: func(hub *Hub, p *Presence) {
+				newBackplaneConn(hub, alice, "lobby")
+				newBackplaneConn(hub, bob)
+			},
+			expected: []PresenceEvent{
+				{Type: PresenceJoin, UserID: alice},
+				{Type: PresenceJoin, UserID: alice, Room: "lobby"},
+				{Type: PresenceJoin, UserID: bob},
+			},
+			online:  []uuid.UUID{alice, bob},
+			members: []uuid.UUID{alice},
+		},
+		{
+			name: "Second connection",
+			run: func(hub *Hub, p *Presence) {
+				first := newBackplaneConn(hub, alice, "lobby")
+				newBackplaneConn(hub, alice, "lobby")
+				hub.Unregister(first)
+			},
+			expected: []PresenceEvent{
+				{Type: PresenceJoin, UserID: alice},
+				{Type: PresenceJoin, UserID: alice, Room: "lobby"},
+			},
+			online:  []uuid.UUID{alice},
+			members: []uuid.UUID{alice},
+		},
+		{
+			name: "Leave room",
+			run: func(hub *Hub, p *Presence) {
+				conn := newBackplaneConn(hub, alice, "lobby")
+				hub.Leave(conn, "lobby")
+				hub.Leave(conn, "lobby")
+			},
+			expected: []PresenceEvent{
+				{Type: PresenceJoin, UserID: alice},
+				{Type: PresenceJoin, UserID: alice, Room: "lobby"},
+				{Type: PresenceLeave, UserID: alice, Room: "lobby"},
+			},
+			online: []uuid.UUID{alice},
+		},
+		{
+			name: "Disconnect",
+			run: func(hub *Hub, p *Presence) {
+				hub.Unregister(newBackplaneConn(hub, alice, "lobby"))
+			},
+			expected: []PresenceEvent{
+				{Type: PresenceJoin, UserID: alice},
+				{Type: PresenceJoin, UserID: alice, Room: "lobby"},
+				{Type: PresenceLeave, UserID: alice},
+				{Type: PresenceLeave, UserID: alice, Room: "lobby"},
+			},
+		},
+		{
+			name: "Flapping connection",
+			run: func(hub *Hub, p *Presence) {
+				for range 3 {
+					hub.Unregister(newBackplaneConn(hub, alice, "lobby"))
+				}
+				newBackplaneConn(hub, alice, "lobby")
+			},
+			expected: []PresenceEvent{
+				{Type: PresenceJoin, UserID: alice},
+				{Type: PresenceJoin, UserID: alice, Room: "lobby"},
+			},
+			online:  []uuid.UUID{alice},
+			members: []uuid.UUID{alice},
+		},
+		{
+			name: "Anonymous connection",
+			run: func(hub *Hub, p *Presence) {
+				newBackplaneConn(hub, uuid.Nil, "lobby")
+			},
+		},
+		{
+			name: "Typing",
+			run: func(hub *Hub, p *Presence) {
+				newBackplaneConn(hub, alice, "lobby")
+				p.Typing(alice, "lobby")
+				p.Typing(alice, "lobby")
+				p.Typing(alice, "kitchen")
+				p.Typing(bob, "lobby")
+			},
+			expected: []PresenceEvent{
+				{Type: PresenceJoin, UserID: alice},
+				{Type: PresenceJoin, UserID: alice, Room: "lobby"},
+				{Type: PresenceTyping, UserID: alice, Room: "lobby"},
+			},
+			online:  []uuid.UUID{alice},
+			members: []uuid.UUID{alice},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			hub, p, events := newTestPresence(t)
+			tc.run(hub, p)
+
+			if got, expected := collect(events, 200*time.Millisecond), formatEvents(tc.expected...); !slices.Equal(got, expected) {
+				t.Errorf("Expected events %v, got %v", expected, got)
+			}
+			assertUsers(t, "online", tc.online, p.OnlineUsers())
+			assertUsers(t, "members", tc.members, p.RoomMembers("lobby"))
+			for _, userID := range []uuid.UUID{alice, bob} {
+				if p.Online(userID) != slices.Contains(tc.online, userID) {
+					t.Errorf("Unexpected Online(%s) %v", userID, p.Online(userID))
+				}
+			}
+		})
+	}
+}
+
+// TestPresenceAttach tests that connections registered before tracking starts are present.
+func TestPresenceAttach(t *testing.T) {
+	alice := uuid.New()
+	hub := NewHub()
+	newBackplaneConn(hub, alice, "lobby")
+
+	p := NewPresence(hub, nil)
+	defer p.Close()
+	assertUsers(t, "members", []uuid.UUID{alice}, p.RoomMembers("lobby"))
+}
+
+// TestPresenceClose tests closing twice and that a replaced presence stops while the new one tracks the hub.
+func TestPresenceClose(t *testing.T) {
+	alice := uuid.New()
+	hub := NewHub()
+	first := NewPresence(hub, nil)
+	second := NewPresence(hub, nil)
+	defer second.Close()
+
+	select {
+	case <-first.done:
+	default:
+		t.Error("Expected the replaced presence to stop")
+	}
+	first.Close()
+	first.Close()
+
+	newBackplaneConn(hub, alice)
+	if !second.Online(alice) {
+		t.Error("Expected closing the replaced presence to keep the new one")
+	}
+	if first.Online(alice) {
+		t.Error("Expected the replaced presence not to track connections")
+	}
+}
+
+// TestPresenceDebounce tests that a user is still present until the leave event is emitted.
+func TestPresenceDebounce(t *testing.T) {
+	alice := uuid.New()
+	hub, p, events := newTestPresence(t)
+	hub.Unregister(newBackplaneConn(hub, alice, "lobby"))
+
+	if !p.Online(alice) || len(p.RoomMembers("lobby")) != 1 {
+		t.Error("Expected the user to be present within the debounce delay")
+	}
+	collect(events, 200*time.Millisecond)
+	if p.Online(alice) || len(p.RoomMembers("lobby")) != 0 {
+		t.Error("Expected the user to be gone after the leave event")
+	}
+}
+
+func assertUsers(t *testing.T, name string, expected, got []uuid.UUID) {
+	t.Helper()
+	sortUsers := func(users []uuid.UUID) []string {
+		var ids []string
+		for _, user := range users {
+			ids = append(ids, user.String())
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	if !slices.Equal(sortUsers(expected), sortUsers(got)) {
+		t.Errorf("Expected %s %v, got %v", name, expected, got)
+	}
+}
@@ -0,0 +1,93 @@
+package possum
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type RateLimitConfig struct {
+	Rate  float64 `mapstructure:"rate,omitempty"`  // requests per second
+	Burst int     `mapstructure:"burst,omitempty"` // maximum requests allowed at once
+}
+
+// RateLimit returns a middleware that limits the request rate with a token bucket.
+// When a tenant has been resolved, its RateLimit configuration is used instead of config
+// and each tenant gets its own bucket. Rejected requests get a 429 response with Retry-After.
+func RateLimit(config *RateLimitConfig) HandlerFunc {
+	limiter := &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			cfg, key := config, ""
+			if tenant, ok := TenantFromContext(r.Context()); ok {
+				key = tenant.ID
+				if tenant.RateLimit != nil {
+					cfg = tenant.RateLimit
+				}
+			}
+			if cfg == nil || cfg.Rate <= 0 {
+				next(w, r)
+				return
+			}
+			if ok, wait := limiter.allow(key, cfg, time.Now()); !ok {
+				writeTooManyRequests(w, wait)
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+type rateLimiter struct {
+	sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func (limiter *rateLimiter) allow(key string, config *RateLimitConfig, now time.Time) (bool, time.Duration) {
+	limiter.Lock()
+	defer limiter.Unlock()
+	bucket, ok := limiter.buckets[key]
+	if !ok || bucket.config != *config {
+		bucket = newTokenBucket(*config, now)
+		limiter.buckets[key] = bucket
+	}
+	return bucket.take(now)
+}
+
+// tokenBucket is a classic token bucket. It is not safe for concurrent use.
+type tokenBucket struct {
+	config RateLimitConfig
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(config RateLimitConfig, now time.Time) *tokenBucket {
+	if config.Burst < 1 {
+		config.Burst = 1
+	}
+	return &tokenBucket{config: config, tokens: float64(config.Burst), last: now}
+}
+
+// take consumes a token if available, otherwise it returns how long until one will be.
+func (bucket *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	elapsed := now.Sub(bucket.last).Seconds()
+	bucket.last = now
+	bucket.tokens = math.Min(float64(bucket.config.Burst), bucket.tokens+elapsed*bucket.config.Rate)
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / bucket.config.Rate * float64(time.Second))
+}
+
+// writeTooManyRequests writes a 429 response with a Retry-After header rounded up to whole seconds.
+func writeTooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	TooManyRequestsResponse.Write(w)
+}
@@ -0,0 +1,110 @@
+package possum
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestTokenBucket tests the token bucket refill and Retry-After calculation.
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(RateLimitConfig{Rate: 2, Burst: 2}, now)
+
+	// The burst is available immediately
+	for i := 0; i < 2; i++ {
+		if ok, _ := bucket.take(now); !ok {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+	}
+
+	// The bucket is empty and refills at 2 tokens per second
+	ok, wait := bucket.take(now)
+	if ok {
+		t.Fatal("Expected request to be rejected")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("Expected wait of 500ms, got %v", wait)
+	}
+	if ok, _ := bucket.take(now.Add(500 * time.Millisecond)); !ok {
+		t.Error("Expected request to be allowed after refill")
+	}
+}
+
+// TestRateLimit tests the RateLimit middleware with default and per-tenant configurations.
+func TestRateLimit(t *testing.T) {
+	store := TenantMap{
+		"acme":   {ID: "acme", RateLimit: &RateLimitConfig{Rate: 0.001, Burst: 3}},
+		"globex": {ID: "globex"},
+	}
+
+	// Test cases
+	tests := []struct {
+		name            string
+		config          *RateLimitConfig
+		tenant          string
+		requests        int
+		expectedAllowed int
+	}{
+		{
+			name:            "No limit",
+			config:          nil,
+			requests:        5,
+			expectedAllowed: 5,
+		},
+		{
+			name:            "Default limit",
+			config:          &RateLimitConfig{Rate: 0.001, Burst: 2},
+			requests:        5,
+			expectedAllowed: 2,
+		},
+		{
+			name:            "Tenant limit",
+			config:          &RateLimitConfig{Rate: 0.001, Burst: 2},
+			tenant:          "acme",
+			requests:        5,
+			expectedAllowed: 3,
+		},
+		{
+			name:            "Tenant falls back to default limit",
+			config:          &RateLimitConfig{Rate: 0.001, Burst: 2},
+			tenant:          "globex",
+			requests:        5,
+			expectedAllowed: 2,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			middlewares := []HandlerFunc{RateLimit(tc.config)}
+			if tc.tenant != "" {
+				middlewares = append([]HandlerFunc{Tenant(store, TenantFromHeader("X-Tenant-ID"))}, middlewares...)
+			}
+			handler := Chain(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}, middlewares...)
+
+			allowed := 0
+			for i := 0; i < tc.requests; i++ {
+				req := httptest.NewRequest("GET", "/", nil)
+				req.Header.Set("X-Tenant-ID", tc.tenant)
+				rr := httptest.NewRecorder()
+				handler(rr, req)
+				switch rr.Code {
+				case http.StatusOK:
+					allowed++
+				case http.StatusTooManyRequests:
+					if rr.Header().Get("Retry-After") == "" {
+						t.Error("Expected Retry-After header on rejected request")
+					}
+				default:
+					t.Errorf("Unexpected status %d", rr.Code)
+				}
+			}
+			if allowed != tc.expectedAllowed {
+				t.Errorf("Expected %d allowed requests, got %d", tc.expectedAllowed, allowed)
+			}
+		})
+	}
+}
@@ -72,6 +72,20 @@ var (
 			Message: "Forbidden",
 		},
 	}
+
+	MFARequiredResponse = Response{
+		Error: &Error{
+			Code:    http.StatusForbidden,
+			Message: "MFA Required",
+		},
+	}
+
+	TooManyRequestsResponse = Response{
+		Error: &Error{
+			Code:    http.StatusTooManyRequests,
+			Message: "Too Many Requests",
+		},
+	}
 )
 
 type Response struct {
@@ -146,25 +160,28 @@ func (resp *Response) WriteHeader(code int) {
 
 // Write serializes the Response object to the HTTP response writer with proper headers.
 func (resp *Response) Write(w http.ResponseWriter) {
-	resp.UUID = uuid.New() // Ensure UUID is set for each response
-	w.Header().Set("X-Response-ID", resp.UUID.String())
+	// Predefined responses such as UnauthorizedResponse are shared by concurrent requests,
+	// so the UUID and status are set on a copy
+	out := *resp
+	out.UUID = uuid.New() // Ensure UUID is set for each response
+	w.Header().Set("X-Response-ID", out.UUID.String())
 	w.Header().Set("Content-Type", "application/json")
-	if resp.Error == nil {
-		if resp.code == 0 {
-			resp.code = http.StatusOK
+	if out.Error == nil {
+		if out.code == 0 {
+			out.code = http.StatusOK
 		}
-		w.WriteHeader(resp.code)
+		w.WriteHeader(out.code)
 	} else {
 		if logResp, ok := w.(*logResponseWriter); ok {
-			logResp.err = errors.New(resp.Error.Message)
+			logResp.err = errors.New(out.Error.Message)
 			w = logResp
 		}
-		w.WriteHeader(resp.Error.Code)
+		w.WriteHeader(out.Error.Code)
 	}
-	if resp.code == http.StatusNoContent {
+	if out.code == http.StatusNoContent {
 		return
 	}
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
+	if err := json.NewEncoder(w).Encode(&out); err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
@@ -175,3 +192,8 @@ type Error struct {
 	Message string `json:"message"`
 	Stack   []byte `json:"stack,omitempty"`
 }
+
+// Error implements the error interface, so handlers can return an *Error with its code.
+func (e *Error) Error() string {
+	return e.Message
+}
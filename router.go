@@ -0,0 +1,252 @@
+package possum
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/mikespook/possum/auth"
+	"github.com/mikespook/possum/config"
+	"github.com/mikespook/possum/log"
+)
+
+// Envelope is the frame exchanged by Router, JSON unless another codec was negotiated. Requests
+// carrying an ID get a response with the same type and ID holding either the handler's result as
+// payload or an error. The payload is encoded with the codec of the connection.
+type Envelope struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// Message is a received envelope with the connection it arrived on.
+type Message struct {
+	*Envelope
+	Conn    *WebSocketConn
+	Request *http.Request
+
+	codec Codec
+}
+
+// Context returns the connection context.
+func (msg *Message) Context() context.Context {
+	return msg.Conn.Context()
+}
+
+// Decode decodes the payload into v.
+func (msg *Message) Decode(v any) error {
+	if len(msg.Payload) == 0 {
+		return nil
+	}
+	return msg.Codec().Unmarshal(msg.Payload, v)
+}
+
+// Codec returns the codec of the connection the message arrived on.
+func (msg *Message) Codec() Codec {
+	if msg.codec == nil {
+		return JSONCodec
+	}
+	return msg.codec
+}
+
+// reply encodes an envelope with the codec of the message and sends it.
+func (msg *Message) reply(envelope *Envelope) {
+	codec := msg.Codec()
+	data, err := codec.EncodeEnvelope(envelope)
+	if err != nil {
+		log.Error().Err(err).Str("type", envelope.Type).Str("codec", codec.Name()).Msg("failed to encode envelope")
+		return
+	}
+	msg.Conn.Send(codec.MessageType(), data)
+}
+
+// MessageHandlerFunc handles a message. A non-nil result is sent as payload of the response when
+// the message has an ID; an error is always sent back, with the code of an *Error or 500.
+type MessageHandlerFunc func(msg *Message) (any, error)
+
+// MessageMiddleware wraps a MessageHandlerFunc, like HandlerFunc does for HTTP handlers.
+type MessageMiddleware func(MessageHandlerFunc) MessageHandlerFunc
+
+// ChainMessage composes multiple message middlewares into a single handler, applying them in reverse order.
+func ChainMessage(handler MessageHandlerFunc, middlewares ...MessageMiddleware) MessageHandlerFunc {
+	for i := range middlewares {
+		handler = middlewares[len(middlewares)-1-i](handler)
+	}
+	return handler
+}
+
+var (
+	// Predefined message errors
+	ErrUnknownMessageType = &Error{Code: http.StatusNotFound, Message: "Unknown Message Type"}
+	ErrInvalidEnvelope    = &Error{Code: http.StatusBadRequest, Message: "Invalid Envelope"}
+	ErrInvalidPayload     = &Error{Code: http.StatusBadRequest, Message: "Invalid Payload"}
+)
+
+// Router dispatches envelopes received on a WebSocket connection to the handler registered
+// for their type. Messages of a connection are handled one at a time in arrival order.
+type Router struct {
+	mu          sync.RWMutex
+	handlers    map[string]MessageHandlerFunc
+	middlewares []MessageMiddleware
+}
+
+// NewRouter creates an empty router.
+func NewRouter() *Router {
+	return &Router{handlers: make(map[string]MessageHandlerFunc)}
+}
+
+// Use adds middlewares applied to every message, including unknown types.
+func (router *Router) Use(middlewares ...MessageMiddleware) {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+	router.middlewares = append(router.middlewares, middlewares...)
+}
+
+// Handle registers the handler of a message type with its own middlewares.
+func (router *Router) Handle(msgType string, handler MessageHandlerFunc, middlewares ...MessageMiddleware) {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+	router.handlers[msgType] = ChainMessage(handler, middlewares...)
+}
+
+// HandleMessage registers a handler receiving the payload decoded into T. Payloads that do
+// not decode are answered with ErrInvalidPayload.
+func HandleMessage[T any](router *Router, msgType string, handler func(msg *Message, payload T) (any, error), middlewares ...MessageMiddleware) {
+	router.Handle(msgType, func(msg *Message) (any, error) {
+		var payload T
+		if err := msg.Decode(&payload); err != nil {
+			return nil, ErrInvalidPayload
+		}
+		return handler(msg, payload)
+	}, middlewares...)
+}
+
+// ServeWebSocket reads envelopes until the connection is closed. It is a WebsocketHandlerFunc.
+// Envelopes are decoded with the codec negotiated by the connection.
+func (router *Router) ServeWebSocket(conn *WebSocketConn, r *http.Request) {
+	codec := conn.Codec()
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		msg := &Message{Conn: conn, Request: r, codec: codec}
+		envelope, err := codec.DecodeEnvelope(data)
+		if err != nil || envelope.Type == "" {
+			msg.reply(&Envelope{Error: ErrInvalidEnvelope})
+			continue
+		}
+		msg.Envelope = envelope
+		router.dispatch(msg)
+	}
+}
+
+// dispatch runs the handler of a message and sends the response.
+func (router *Router) dispatch(msg *Message) {
+	router.mu.RLock()
+	handler, ok := router.handlers[msg.Type]
+	if !ok {
+		handler = func(msg *Message) (any, error) {
+			return nil, ErrUnknownMessageType
+		}
+	}
+	handler = ChainMessage(handler, router.middlewares...)
+	router.mu.RUnlock()
+
+	result, err := handler(msg)
+	if err != nil {
+		msg.reply(&Envelope{Type: msg.Type, ID: msg.ID, Error: messageError(err)})
+		return
+	}
+	if msg.ID == "" {
+		return
+	}
+	response := &Envelope{Type: msg.Type, ID: msg.ID}
+	if result != nil {
+		payload, err := msg.Codec().Marshal(result)
+		if err != nil {
+			msg.reply(&Envelope{Type: msg.Type, ID: msg.ID, Error: messageError(err)})
+			return
+		}
+		response.Payload = payload
+	}
+	msg.reply(response)
+}
+
+// messageError converts a handler error into the error of an envelope, like WriteResponse does.
+func messageError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	e = &Error{Code: http.StatusInternalServerError, Message: err.Error()}
+	if config.IsDebug() {
+		e.Stack = debug.Stack()
+	}
+	return e
+}
+
+// MessageLog is a middleware logging every message with its outcome and duration.
+func MessageLog(next MessageHandlerFunc) MessageHandlerFunc {
+	return func(msg *Message) (any, error) {
+		start := time.Now()
+		result, err := next(msg)
+		log.Info().
+			Str("type", msg.Type).
+			Str("id", msg.ID).
+			Str("remote_addr", msg.Conn.RemoteAddr().String()).
+			Dur("duration", time.Since(start)).
+			Err(err).
+			Msg("message")
+		return result, err
+	}
+}
+
+// MessageRequireClaims is a middleware rejecting messages of connections without claims,
+// i.e. not authenticated by WebSocketAuth, with an unauthorized error.
+func MessageRequireClaims(next MessageHandlerFunc) MessageHandlerFunc {
+	return func(msg *Message) (any, error) {
+		if _, ok := msg.Context().Value(ClaimsKey).(*auth.JWTClaims); !ok {
+			return nil, UnauthorizedResponse.Error
+		}
+		return next(msg)
+	}
+}
+
+// MessageRateLimit returns a middleware limiting the message rate of each connection with a
+// token bucket. Rejected messages get a 429 error.
+func MessageRateLimit(config *RateLimitConfig) MessageMiddleware {
+	var mu sync.Mutex
+	buckets := make(map[*WebSocketConn]*tokenBucket)
+	return func(next MessageHandlerFunc) MessageHandlerFunc {
+		return func(msg *Message) (any, error) {
+			if config == nil || config.Rate <= 0 {
+				return next(msg)
+			}
+			now := time.Now()
+			mu.Lock()
+			bucket, ok := buckets[msg.Conn]
+			if !ok {
+				bucket = newTokenBucket(*config, now)
+				buckets[msg.Conn] = bucket
+				conn := msg.Conn
+				context.AfterFunc(conn.Context(), func() {
+					mu.Lock()
+					defer mu.Unlock()
+					delete(buckets, conn)
+				})
+			}
+			allowed, _ := bucket.take(now)
+			mu.Unlock()
+			if !allowed {
+				return nil, TooManyRequestsResponse.Error
+			}
+			return next(msg)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package possum
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestRouter tests dispatching envelopes to typed handlers and the responses sent back.
+func TestRouter(t *testing.T) {
+	type addRequest struct {
+		A int `json:"a"`
+		B int `json:"b"`
+	}
+	var notified []string
+	router := NewRouter()
+	HandleMessage(router, "add", func(msg *Message, req addRequest) (any, error) {
+		return req.A + req.B, nil
+	})
+	router.Handle("fail", func(msg *Message) (any, error) {
+		return nil, &Error{Code: http.StatusConflict, Message: "Conflict"}
+	})
+	router.Handle("crash", func(msg *Message) (any, error) {
+		return nil, errors.New("boom")
+	})
+	router.Handle("notify", func(msg *Message) (any, error) {
+		notified = append(notified, string(msg.Payload))
+		return "ignored", nil
+	})
+	ws := dialWebSocket(t, nil, router.ServeWebSocket)
+
+	tests := []struct {
+		name     string
+		request  string
+		expected string
+	}{
+		{
+			name:     "Typed payload",
+			request:  `{"type":"add","id":"1","payload":{"a":1,"b":2}}`,
+			expected: `{"type":"add","id":"1","payload":3}`,
+		},
+		{
+			name:     "Invalid payload",
+			request:  `{"type":"add","id":"2","payload":"nope"}`,
+			expected: `{"type":"add","id":"2","error":{"code":400,"message":"Invalid Payload"}}`,
+		},
+		{
+			name:     "Error with code",
+			request:  `{"type":"fail","id":"3"}`,
+			expected: `{"type":"fail","id":"3","error":{"code":409,"message":"Conflict"}}`,
+		},
+		{
+			name:     "Plain error",
+			request:  `{"type":"crash","id":"4"}`,
+			expected: `{"type":"crash","id":"4","error":{"code":500,"message":"boom"}}`,
+		},
+		{
+			name:     "Unknown type",
+			request:  `{"type":"missing","id":"5"}`,
+			expected: `{"type":"missing","id":"5","error":{"code":404,"message":"Unknown Message Type"}}`,
+		},
+		{
+			name:     "Invalid envelope",
+			request:  `not json`,
+			expected: `{"type":"","error":{"code":400,"message":"Invalid Envelope"}}`,
+		},
+		{
+			// Messages without an ID get no response; the next request proves nothing was sent
+			name:     "Without ID",
+			request:  `{"type":"notify","payload":"hello"}`,
+			expected: "",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := ws.WriteMessage(websocket.TextMessage, []byte(tc.request)); err != nil {
+				t.Fatalf("Failed to write: %v", err)
+			}
+			if tc.expected == "" {
+				ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"add","id":"sync"}`))
+				tc.expected = `{"type":"add","id":"sync","payload":0}`
+			}
+			var response Envelope
+			if err := ws.ReadJSON(&response); err != nil {
+				t.Fatalf("Failed to read: %v", err)
+			}
+			// The stack trace is only included in debug mode
+			if response.Error != nil {
+				response.Error.Stack = nil
+			}
+			data, _ := json.Marshal(&response)
+			assertJSONEqual(t, tc.expected, string(data))
+		})
+	}
+	if len(notified) != 1 || notified[0] != `"hello"` {
+		t.Errorf("Expected notification to be handled once, got %v", notified)
+	}
+}
+
+// TestRouterMiddleware tests the order of router-wide and per-type middlewares.
+func TestRouterMiddleware(t *testing.T) {
+	var order []string
+	trace := func(name string) MessageMiddleware {
+		return func(next MessageHandlerFunc) MessageHandlerFunc {
+			return func(msg *Message) (any, error) {
+				order = append(order, name)
+				return next(msg)
+			}
+		}
+	}
+	router := NewRouter()
+	router.Use(MessageLog, trace("router"))
+	router.Handle("ping", func(msg *Message) (any, error) {
+		order = append(order, "handler")
+		return "pong", nil
+	}, trace("type"))
+	router.Handle("secret", func(msg *Message) (any, error) {
+		return "secret", nil
+	}, MessageRequireClaims)
+	router.Handle("limited", func(msg *Message) (any, error) {
+		return "ok", nil
+	}, MessageRateLimit(&RateLimitConfig{Rate: 0.001, Burst: 1}))
+	ws := dialWebSocket(t, nil, router.ServeWebSocket)
+
+	tests := []struct {
+		name     string
+		request  string
+		expected string
+	}{
+		{name: "Chain", request: `{"type":"ping","id":"1"}`, expected: `{"type":"ping","id":"1","payload":"pong"}`},
+		{name: "Require claims", request: `{"type":"secret","id":"2"}`, expected: `{"type":"secret","id":"2","error":{"code":401,"message":"Unauthorized"}}`},
+		{name: "Within rate", request: `{"type":"limited","id":"3"}`, expected: `{"type":"limited","id":"3","payload":"ok"}`},
+		{name: "Over rate", request: `{"type":"limited","id":"4"}`, expected: `{"type":"limited","id":"4","error":{"code":429,"message":"Too Many Requests"}}`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ws.WriteMessage(websocket.TextMessage, []byte(tc.request))
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				t.Fatalf("Failed to read: %v", err)
+			}
+			assertJSONEqual(t, tc.expected, string(data))
+		})
+	}
+	if len(order) < 3 || order[0] != "router" || order[1] != "type" || order[2] != "handler" {
+		t.Errorf("Expected router, type, handler order, got %v", order)
+	}
+}
+
+// assertJSONEqual compares two JSON documents semantically.
+func assertJSONEqual(t *testing.T, expected, actual string) {
+	t.Helper()
+	var e, a any
+	if err := json.Unmarshal([]byte(expected), &e); err != nil {
+		t.Fatalf("Invalid expected JSON %s: %v", expected, err)
+	}
+	if err := json.Unmarshal([]byte(actual), &a); err != nil {
+		t.Fatalf("Invalid JSON %s: %v", actual, err)
+	}
+	eb, _ := json.Marshal(e)
+	ab, _ := json.Marshal(a)
+	if string(eb) != string(ab) {
+		t.Errorf("Expected %s, got %s", expected, actual)
+	}
+}
@@ -0,0 +1,369 @@
+package possum
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrFlusherNotImplement = errors.New("underlying ResponseWriter does not implement Flusher")
+	ErrInvalidSSEEvent     = errors.New("SSE event ID and type must not contain line breaks")
+)
+
+// SSEEvent is a Server-Sent Event. Data spanning several lines is sent as several data fields.
+type SSEEvent struct {
+	ID    string `json:"id,omitempty"`
+	Event string `json:"event,omitempty"` // type of the event, "message" when empty
+	Data  []byte `json:"data"`
+}
+
+// SSEWriter writes an event stream to a response. It is safe for concurrent use.
+type SSEWriter struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+// NewSSEWriter starts an event stream: it sends the status and headers of text/event-stream and
+// flushes them. The writer must implement http.Flusher; logResponseWriter of Log does.
+func NewSSEWriter(w http.ResponseWriter) (*SSEWriter, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, ErrFlusherNotImplement
+	}
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	// Keep reverse proxies such as nginx from buffering the stream
+	header.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &SSEWriter{w: w, flusher: flusher}, nil
+}
+
+// Send writes an event and flushes it. IDs and types containing CR or LF would inject fields
+// into the stream and are rejected with ErrInvalidSSEEvent.
+func (sw *SSEWriter) Send(event *SSEEvent) error {
+	if strings.ContainsAny(event.ID, "\r\n") || strings.ContainsAny(event.Event, "\r\n") {
+		return ErrInvalidSSEEvent
+	}
+	var b strings.Builder
+	if event.ID != "" {
+		fmt.Fprintf(&b, "id: %s\n", event.ID)
+	}
+	if event.Event != "" {
+		fmt.Fprintf(&b, "event: %s\n", event.Event)
+	}
+	// CRLF, a lone CR and LF all end a line in the stream
+	for _, line := range strings.Split(dataLineBreaks.Replace(string(event.Data)), "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteByte('\n')
+	return sw.write(b.String())
+}
+
+var dataLineBreaks = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+// Comment writes a comment line, which clients ignore; it keeps idle connections open.
+func (sw *SSEWriter) Comment(text string) error {
+	return sw.write(": " + text + "\n\n")
+}
+
+// Retry tells the client how long to wait before reconnecting.
+func (sw *SSEWriter) Retry(d time.Duration) error {
+	return sw.write(fmt.Sprintf("retry: %d\n\n", d.Milliseconds()))
+}
+
+func (sw *SSEWriter) write(s string) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if _, err := sw.w.Write([]byte(s)); err != nil {
+		return err
+	}
+	sw.flusher.Flush()
+	return nil
+}
+
+// SSEConfig configures an SSEBroker.
+type SSEConfig struct {
+	Heartbeat  time.Duration `mapstructure:"heartbeat,omitempty"`   // interval of keep-alive comments, default 15s
+	ReplaySize int           `mapstructure:"replay_size,omitempty"` // events kept per topic for Last-Event-ID, default 256
+	BufferSize int           `mapstructure:"buffer_size,omitempty"` // events queued per subscriber, default 64
+	Retry      time.Duration `mapstructure:"retry,omitempty"`       // reconnection delay sent to clients, 0 keeps theirs
+	// TopicTTL is how long a topic without subscribers keeps its replay buffer after its last
+	// event, default 1h.
+	TopicTTL time.Duration `mapstructure:"topic_ttl,omitempty"`
+	// Authorize decides whether the client of r may subscribe to topic; nil allows every topic.
+	// ServeHTTP takes the topics from the query, so set it unless every topic is public.
+	Authorize func(r *http.Request, topic string) bool `mapstructure:"-"`
+}
+
+var defaultSSEConfig = &SSEConfig{
+	Heartbeat:  15 * time.Second,
+	ReplaySize: 256,
+	BufferSize: 64,
+	TopicTTL:   time.Hour,
+}
+
+// SSEBroker publishes events to the subscribers of topics over Server-Sent Events. Event IDs
+// are sequence numbers shared by every topic of the broker, so a client reconnecting with the
+// Last-Event-ID header gets the events of its topics it missed, from the replay buffer, before
+// live events. Subscribers too slow to keep up are disconnected and resume the same way.
+type SSEBroker struct {
+	config *SSEConfig
+
+	mu     sync.Mutex
+	seq    uint64
+	topics map[string]*sseTopic
+	swept  time.Time
+}
+
+type sseTopic struct {
+	published   time.Time
+	replay      []sseEntry
+	subscribers map[*sseSubscriber]struct{}
+}
+
+type sseEntry struct {
+	seq   uint64
+	event *SSEEvent
+}
+
+type sseSubscriber struct {
+	topics []string
+	events chan *SSEEvent
+}
+
+// NewSSEBroker creates a broker; zero values of config fall back to the defaults.
+func NewSSEBroker(config *SSEConfig) *SSEBroker {
+	cfg := *defaultSSEConfig
+	if config != nil {
+		if config.Heartbeat != 0 {
+			cfg.Heartbeat = config.Heartbeat
+		}
+		if config.ReplaySize != 0 {
+			cfg.ReplaySize = config.ReplaySize
+		}
+		if config.BufferSize != 0 {
+			cfg.BufferSize = config.BufferSize
+		}
+		if config.TopicTTL != 0 {
+			cfg.TopicTTL = config.TopicTTL
+		}
+		cfg.Retry = config.Retry
+		cfg.Authorize = config.Authorize
+	}
+	return &SSEBroker{config: &cfg, topics: make(map[string]*sseTopic)}
+}
+
+// Publish sends an event of the given type to the subscribers of topic and returns its ID.
+func (b *SSEBroker) Publish(topic, event string, data []byte) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if now.Sub(b.swept) >= b.config.TopicTTL {
+		b.sweep(now)
+	}
+	b.seq++
+	ev := &SSEEvent{ID: strconv.FormatUint(b.seq, 10), Event: event, Data: data}
+	t := b.topic(topic)
+	t.published = now
+	if len(t.replay) >= b.config.ReplaySize {
+		t.replay[0] = sseEntry{}
+		t.replay = t.replay[1:]
+	}
+	t.replay = append(t.replay, sseEntry{seq: b.seq, event: ev})
+	for sub := range t.subscribers {
+		select {
+		case sub.events <- ev:
+		default:
+			b.drop(sub)
+		}
+	}
+	return ev.ID
+}
+
+// PublishJSON encodes v as JSON and publishes it.
+func (b *SSEBroker) PublishJSON(topic, event string, v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return b.Publish(topic, event, data), nil
+}
+
+// Subscribers returns the number of clients subscribed to topic.
+func (b *SSEBroker) Subscribers(topic string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if t, ok := b.topics[topic]; ok {
+		return len(t.subscribers)
+	}
+	return 0
+}
+
+// Handler returns a handler streaming the events of the given topics.
+func (b *SSEBroker) Handler(topics ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b.serve(w, r, topics)
+	}
+}
+
+// ServeHTTP streams the events of the topics listed in the topic query parameter. Clients choose
+// the topics, so SSEConfig.Authorize should restrict them.
+func (b *SSEBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	topics := r.URL.Query()["topic"]
+	if len(topics) == 0 {
+		BadRequestResponse.Write(w)
+		return
+	}
+	b.serve(w, r, topics)
+}
+
+// serve streams events until the client disconnects, which cancels the request context.
+// Topics the client is not authorized for get ForbiddenResponse.
+func (b *SSEBroker) serve(w http.ResponseWriter, r *http.Request, topics []string) {
+	if b.config.Authorize != nil {
+		for _, topic := range topics {
+			if !b.config.Authorize(r, topic) {
+				ForbiddenResponse.Write(w)
+				return
+			}
+		}
+	}
+	sw, err := NewSSEWriter(w)
+	if err != nil {
+		InternalServerErrorResponse.Write(w)
+		return
+	}
+	sub, replay := b.subscribe(topics, r.Header.Get("Last-Event-ID"))
+	defer b.unsubscribe(sub)
+
+	if b.config.Retry > 0 {
+		if err := sw.Retry(b.config.Retry); err != nil {
+			return
+		}
+	}
+	for _, ev := range replay {
+		if err := sw.Send(ev); err != nil {
+			return
+		}
+	}
+	heartbeat := time.NewTicker(b.config.Heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case ev, ok := <-sub.events:
+			if !ok {
+				// Dropped for being too slow; the client resumes from its last event
+				return
+			}
+			if err := sw.Send(ev); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := sw.Comment("heartbeat"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// subscribe registers a subscriber and returns the events published after lastEventID, in
+// order, atomically so that no event is missed or sent twice.
+func (b *SSEBroker) subscribe(topics []string, lastEventID string) (*sseSubscriber, []*SSEEvent) {
+	sub := &sseSubscriber{topics: topics, events: make(chan *SSEEvent, b.config.BufferSize)}
+	last, err := strconv.ParseUint(lastEventID, 10, 64)
+	resume := err == nil
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var replay []sseEntry
+	for _, name := range topics {
+		t := b.topic(name)
+		if _, ok := t.subscribers[sub]; ok {
+			continue // listed twice
+		}
+		t.subscribers[sub] = struct{}{}
+		if !resume {
+			continue
+		}
+		for _, entry := range t.replay {
+			if entry.seq > last {
+				replay = append(replay, entry)
+			}
+		}
+	}
+	sort.Slice(replay, func(i, j int) bool { return replay[i].seq < replay[j].seq })
+	events := make([]*SSEEvent, len(replay))
+	for i, entry := range replay {
+		events[i] = entry.event
+	}
+	return sub, events
+}
+
+// unsubscribe removes a subscriber that is still registered.
+func (b *SSEBroker) unsubscribe(sub *sseSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remove(sub)
+}
+
+// drop disconnects a subscriber; b.mu must be held.
+func (b *SSEBroker) drop(sub *sseSubscriber) {
+	if b.remove(sub) {
+		close(sub.events)
+	}
+}
+
+// remove unregisters a subscriber from its topics and reports whether it was registered;
+// b.mu must be held.
+func (b *SSEBroker) remove(sub *sseSubscriber) bool {
+	removed := false
+	for _, name := range sub.topics {
+		t, ok := b.topics[name]
+		if !ok {
+			continue
+		}
+		if _, ok := t.subscribers[sub]; ok {
+			delete(t.subscribers, sub)
+			removed = true
+		}
+		if len(t.subscribers) == 0 && len(t.replay) == 0 {
+			delete(b.topics, name)
+		}
+	}
+	return removed
+}
+
+// sweep removes the topics without subscribers whose last event is older than TopicTTL; b.mu
+// must be held.
+func (b *SSEBroker) sweep(now time.Time) {
+	for name, t := range b.topics {
+		if len(t.subscribers) == 0 && now.Sub(t.published) >= b.config.TopicTTL {
+			delete(b.topics, name)
+		}
+	}
+	b.swept = now
+}
+
+// topic returns a topic, creating it; b.mu must be held. Topics are kept while they have
+// subscribers, and their events to replay for TopicTTL after the last one.
+func (b *SSEBroker) topic(name string) *sseTopic {
+	t, ok := b.topics[name]
+	if !ok {
+		t = &sseTopic{subscribers: make(map[*sseSubscriber]struct{})}
+		b.topics[name] = t
+	}
+	return t
+}
@@ -0,0 +1,348 @@
+package possum
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSSEWriter tests the wire format of events.
+func TestSSEWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		write    func(sw *SSEWriter) error
+		expected string
+	}{
+		{
+			name: "Data only",
+			write: func(sw *SSEWriter) error {
+				return sw.Send(&SSEEvent{Data: []byte("hello")})
+			},
+			expected: "data: hello\n\n",
+		},
+		{
+			name: "All fields and multiline data",
+			write: func(sw *SSEWriter) error {
+				return sw.Send(&SSEEvent{ID: "7", Event: "update", Data: []byte("a\r\nb\nc")})
+			},
+			expected: "id: 7\nevent: update\ndata: a\ndata: b\ndata: c\n\n",
+		},
+		{
+			name: "Data with lone CR",
+			write: func(sw *SSEWriter) error {
+				return sw.Send(&SSEEvent{Data: []byte("hello\rid: 999\revent: admin")})
+			},
+			expected: "data: hello\ndata: id: 999\ndata: event: admin\n\n",
+		},
+		{
+			name: "Comment",
+			write: func(sw *SSEWriter) error {
+				return sw.Comment("heartbeat")
+			},
+			expected: ": heartbeat\n\n",
+		},
+		{
+			name: "Retry",
+			write: func(sw *SSEWriter) error {
+				return sw.Retry(3 * time.Second)
+			},
+			expected: "retry: 3000\n\n",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			sw, err := NewSSEWriter(w)
+			if err != nil {
+				t.Fatalf("Failed to create writer: %v", err)
+			}
+			if err := tc.write(sw); err != nil {
+				t.Fatalf("Failed to write: %v", err)
+			}
+			if w.Body.String() != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, w.Body.String())
+			}
+			if w.Header().Get("Content-Type") != "text/event-stream" || w.Header().Get("Cache-Control") != "no-cache" {
+				t.Errorf("Unexpected headers %v", w.Header())
+			}
+			if !w.Flushed {
+				t.Error("Expected the stream to be flushed")
+			}
+		})
+	}
+}
+
+// TestSSEWriterNoFlusher tests that streams require a flushing writer.
+func TestSSEWriterNoFlusher(t *testing.T) {
+	w := struct{ http.ResponseWriter }{httptest.NewRecorder()}
+	if _, err := NewSSEWriter(w); err != ErrFlusherNotImplement {
+		t.Errorf("Expected ErrFlusherNotImplement, got %v", err)
+	}
+}
+
+// TestSSEWriterLineBreaks tests that IDs and types cannot inject fields into the stream.
+func TestSSEWriterLineBreaks(t *testing.T) {
+	tests := []struct {
+		name  string
+		event *SSEEvent
+	}{
+		{
+			name:  "ID",
+			event: &SSEEvent{ID: "1\ndata: injected", Data: []byte("x")},
+		},
+		{
+			name:  "Type",
+			event: &SSEEvent{Event: "update\r", Data: []byte("x")},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			sw, err := NewSSEWriter(w)
+			if err != nil {
+				t.Fatalf("Failed to create writer: %v", err)
+			}
+			if err := sw.Send(tc.event); err != ErrInvalidSSEEvent {
+				t.Errorf("Expected ErrInvalidSSEEvent, got %v", err)
+			}
+			if w.Body.Len() != 0 {
+				t.Errorf("Expected nothing written, got %q", w.Body.String())
+			}
+		})
+	}
+}
+
+// sseClient reads events of a stream, skipping comments unless asked for.
+type sseClient struct {
+	resp    *http.Response
+	scanner *bufio.Scanner
+	cancel  context.CancelFunc
+}
+
+func openSSE(t *testing.T, url, lastEventID string) *sseClient {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		resp.Body.Close()
+	})
+	return &sseClient{resp: resp, scanner: bufio.NewScanner(resp.Body), cancel: cancel}
+}
+
+// next returns the lines of the next block, e.g. "id: 1|event: e|data: x".
+func (c *sseClient) next(t *testing.T) string {
+	t.Helper()
+	var lines []string
+	for c.scanner.Scan() {
+		line := c.scanner.Text()
+		if line == "" {
+			if len(lines) > 0 {
+				return strings.Join(lines, "|")
+			}
+			continue
+		}
+		lines = append(lines, line)
+	}
+	t.Fatalf("Stream ended: %v", c.scanner.Err())
+	return ""
+}
+
+// waitSubscribers waits until topic has n subscribers.
+func waitSubscribers(t *testing.T, b *SSEBroker, topic string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for b.Subscribers(topic) != n && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if b.Subscribers(topic) != n {
+		t.Fatalf("Expected %d subscribers of %s, got %d", n, topic, b.Subscribers(topic))
+	}
+}
+
+// TestSSEBroker tests live events, resume with Last-Event-ID and heartbeats through the Log middleware.
+func TestSSEBroker(t *testing.T) {
+	b := NewSSEBroker(&SSEConfig{Heartbeat: 50 * time.Millisecond, Retry: time.Second})
+	server := httptest.NewServer(Chain(b.ServeHTTP, Log))
+	defer server.Close()
+
+	b.Publish("news", "headline", []byte("before"))
+	live := openSSE(t, server.URL+"?topic=news&topic=sports", "")
+	if ct := live.resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected text/event-stream, got %s", ct)
+	}
+	if got := live.next(t); got != "retry: 1000" {
+		t.Errorf("Expected retry, got %q", got)
+	}
+	waitSubscribers(t, b, "news", 1)
+
+	b.Publish("news", "headline", []byte("first"))
+	b.Publish("weather", "forecast", []byte("rain"))
+	b.PublishJSON("sports", "score", map[string]int{"home": 1})
+	for _, expected := range []string{
+		"id: 2|event: headline|data: first",
+		`id: 4|event: score|data: {"home":1}`,
+		": heartbeat",
+	} {
+		if got := live.next(t); got != expected {
+			t.Errorf("Expected %q, got %q", expected, got)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		lastEventID string
+		expected    []string
+	}{
+		{
+			name:        "Resume",
+			lastEventID: "1",
+			expected:    []string{"id: 2|event: headline|data: first", `id: 4|event: score|data: {"home":1}`},
+		},
+		{
+			name:        "Up to date",
+			lastEventID: "4",
+		},
+		{
+			name:        "Invalid ID",
+			lastEventID: "abc",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := openSSE(t, server.URL+"?topic=news&topic=sports", tc.lastEventID)
+			c.next(t) // retry
+			for _, expected := range tc.expected {
+				if got := c.next(t); got != expected {
+					t.Errorf("Expected %q, got %q", expected, got)
+				}
+			}
+			// Nothing else is replayed before live events
+			if got := c.next(t); got != ": heartbeat" {
+				t.Errorf("Expected heartbeat, got %q", got)
+			}
+		})
+	}
+
+	live.cancel()
+	waitSubscribers(t, b, "news", 0)
+}
+
+// TestSSEBrokerNoTopic tests that ServeHTTP requires a topic.
+func TestSSEBrokerNoTopic(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewSSEBroker(nil).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/events", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400, got %d", w.Code)
+	}
+}
+
+// TestSSEBrokerSlowSubscriber tests that a subscriber whose buffer is full is disconnected.
+func TestSSEBrokerSlowSubscriber(t *testing.T) {
+	b := NewSSEBroker(&SSEConfig{BufferSize: 1})
+	sub, _ := b.subscribe([]string{"a", "b"}, "")
+	b.Publish("a", "", []byte("1"))
+	b.Publish("b", "", []byte("2"))
+
+	if ev := <-sub.events; string(ev.Data) != "1" {
+		t.Errorf("Expected the buffered event, got %s", ev.Data)
+	}
+	if _, ok := <-sub.events; ok {
+		t.Error("Expected the subscriber to be disconnected")
+	}
+	if b.Subscribers("a") != 0 || b.Subscribers("b") != 0 {
+		t.Error("Expected the subscriber to be removed from every topic")
+	}
+	b.unsubscribe(sub)
+}
+
+// TestSSEBrokerAuthorize tests that subscriptions to topics the client is not authorized for are forbidden.
+func TestSSEBrokerAuthorize(t *testing.T) {
+	b := NewSSEBroker(&SSEConfig{
+		Heartbeat: 50 * time.Millisecond,
+		Authorize: func(r *http.Request, topic string) bool {
+			return topic == "public" || r.Header.Get("X-Role") == "admin"
+		},
+	})
+	server := httptest.NewServer(b)
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		query    string
+		role     string
+		expected int
+	}{
+		{
+			name:     "Public topic",
+			query:    "?topic=public",
+			expected: http.StatusOK,
+		},
+		{
+			name:     "Private topic",
+			query:    "?topic=public&topic=private",
+			expected: http.StatusForbidden,
+		},
+		{
+			name:     "Private topic of an admin",
+			query:    "?topic=private",
+			role:     "admin",
+			expected: http.StatusOK,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+tc.query, nil)
+			if tc.role != "" {
+				req.Header.Set("X-Role", tc.role)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.expected {
+				t.Errorf("Expected %d, got %d", tc.expected, resp.StatusCode)
+			}
+		})
+	}
+}
+
+// TestSSEBrokerTopicExpiry tests that topics without subscribers are forgotten TopicTTL after their last event.
+func TestSSEBrokerTopicExpiry(t *testing.T) {
+	b := NewSSEBroker(&SSEConfig{TopicTTL: time.Minute})
+	b.Publish("stale", "", []byte("1"))
+	b.Publish("watched", "", []byte("2"))
+	sub, _ := b.subscribe([]string{"watched"}, "")
+	defer b.unsubscribe(sub)
+
+	b.mu.Lock()
+	b.sweep(time.Now().Add(30 * time.Second))
+	if len(b.topics) != 2 {
+		t.Errorf("Expected both topics within TopicTTL, got %d", len(b.topics))
+	}
+	b.sweep(time.Now().Add(2 * time.Minute))
+	_, stale := b.topics["stale"]
+	_, watched := b.topics["watched"]
+	b.mu.Unlock()
+	if stale {
+		t.Error("Expected the stale topic to expire")
+	}
+	if !watched {
+		t.Error("Expected the subscribed topic to be kept")
+	}
+}
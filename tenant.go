@@ -0,0 +1,162 @@
+package possum
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mikespook/possum/auth"
+)
+
+const (
+	// TenantKey is the key used to store the resolved TenantInfo in the context
+	TenantKey = ContextKey("tenant")
+)
+
+var (
+	ErrTenantNotFound = errors.New("tenant not found")
+)
+
+// TenantInfo describes a tenant and the per-tenant configuration other possum
+// middlewares look up from the request context. Nil or empty fields fall back
+// to the configuration the middleware was created with. A CORS configuration
+// must have been initialised with Init before it is returned by a TenantStore;
+// Tenant does it for the tenants of a TenantMap.
+type TenantInfo struct {
+	ID        string           `mapstructure:"id"`
+	CORS      *CORSConfig      `mapstructure:"cors,omitempty"`
+	RateLimit *RateLimitConfig `mapstructure:"rate_limit,omitempty"`
+	JWTSecret []byte           `mapstructure:"jwt_secret,omitempty"`
+}
+
+// TenantStore validates tenant IDs and loads their configuration.
+// GetTenant must return ErrTenantNotFound for unknown tenants.
+type TenantStore interface {
+	GetTenant(ctx context.Context, id string) (*TenantInfo, error)
+}
+
+// TenantMap is a static TenantStore keyed by tenant ID.
+type TenantMap map[string]*TenantInfo
+
+// GetTenant implements TenantStore.
+func (m TenantMap) GetTenant(_ context.Context, id string) (*TenantInfo, error) {
+	tenant, ok := m[id]
+	if !ok {
+		return nil, ErrTenantNotFound
+	}
+	return tenant, nil
+}
+
+// TenantResolver extracts a tenant ID from a request, returning "" if the request does not carry one.
+type TenantResolver func(r *http.Request) string
+
+// TenantFromSubdomain resolves the tenant from the label right before baseDomain, e.g. "acme"
+// for "acme.example.com" and "www.acme.example.com" with baseDomain "example.com".
+func TenantFromSubdomain(baseDomain string) TenantResolver {
+	suffix := "." + strings.ToLower(strings.TrimPrefix(baseDomain, "."))
+	return func(r *http.Request) string {
+		host := strings.ToLower(r.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !strings.HasSuffix(host, suffix) {
+			return ""
+		}
+		sub := strings.TrimSuffix(host, suffix)
+		if i := strings.LastIndexByte(sub, '.'); i >= 0 {
+			sub = sub[i+1:]
+		}
+		return sub
+	}
+}
+
+// TenantFromHeader resolves the tenant from the named request header, e.g. "X-Tenant-ID".
+func TenantFromHeader(header string) TenantResolver {
+	return func(r *http.Request) string {
+		return strings.TrimSpace(r.Header.Get(header))
+	}
+}
+
+// TenantFromPathPrefix resolves the tenant from the first path segment, e.g. "acme" for "/acme/orders".
+// The path is left untouched so routes can be registered as "/{tenant}/...".
+func TenantFromPathPrefix() TenantResolver {
+	return func(r *http.Request) string {
+		path := strings.TrimPrefix(r.URL.Path, "/")
+		if i := strings.IndexByte(path, '/'); i >= 0 {
+			path = path[:i]
+		}
+		return path
+	}
+}
+
+// TenantFromClaims resolves the tenant from the JWT claims placed in the context by HTTPAuth,
+// so it only works when Tenant runs after the authentication middleware.
+func TenantFromClaims() TenantResolver {
+	return func(r *http.Request) string {
+		claims, ok := r.Context().Value(ClaimsKey).(*auth.JWTClaims)
+		if !ok {
+			return ""
+		}
+		return claims.TenantID
+	}
+}
+
+// Tenant returns a middleware that resolves the tenant with the first resolver yielding a non-empty ID,
+// validates it through the store and places the TenantInfo in the request context under TenantKey.
+// If the request is already authenticated, the tenant claim of the token must match the resolved tenant.
+func Tenant(store TenantStore, resolvers ...TenantResolver) HandlerFunc {
+	if tenants, ok := store.(TenantMap); ok {
+		for _, tenant := range tenants {
+			if tenant.CORS != nil {
+				tenant.CORS.compile()
+			}
+		}
+	}
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			var id string
+			for _, resolve := range resolvers {
+				if id = resolve(r); id != "" {
+					break
+				}
+			}
+			if id == "" {
+				resp := NewResponse(r)
+				resp.SetError(http.StatusBadRequest, "Tenant Required")
+				resp.Write(w)
+				return
+			}
+
+			tenant, err := store.GetTenant(r.Context(), id)
+			if err != nil {
+				if errors.Is(err, ErrTenantNotFound) {
+					NotFoundResponse.Write(w)
+					return
+				}
+				WriteResponse(w, InternalServerErrorResponse, err)
+				return
+			}
+
+			if claims, ok := r.Context().Value(ClaimsKey).(*auth.JWTClaims); ok && !tenantMatches(tenant, claims) {
+				ForbiddenResponse.Write(w)
+				return
+			}
+
+			next(w, r.WithContext(context.WithValue(r.Context(), TenantKey, tenant)))
+		}
+	}
+}
+
+// TenantFromContext returns the TenantInfo placed in the context by the Tenant middleware.
+func TenantFromContext(ctx context.Context) (*TenantInfo, bool) {
+	tenant, ok := ctx.Value(TenantKey).(*TenantInfo)
+	return tenant, ok && tenant != nil
+}
+
+// tenantMatches reports whether the claims may be used with the tenant. Once a tenant has been
+// resolved, tokens must be scoped to it: tokens without a tenant claim do not match either.
+func tenantMatches(tenant *TenantInfo, claims *auth.JWTClaims) bool {
+	return claims.TenantID == tenant.ID
+}
@@ -0,0 +1,415 @@
+package possum
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/mikespook/possum/auth"
+)
+
+// tenantToken signs a token scoped to tenantID for testing.
+func tenantToken(t *testing.T, secret []byte, tenantID string) string {
+	t.Helper()
+	claims := &auth.JWTClaims{
+		UserID:   uuid.New(),
+		TenantID: tenantID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return token
+}
+
+// failingTenantStore is a TenantStore that always fails.
+type failingTenantStore struct{}
+
+func (failingTenantStore) GetTenant(context.Context, string) (*TenantInfo, error) {
+	return nil, errors.New("store unavailable")
+}
+
+// TestTenantResolvers tests the built-in tenant resolvers.
+func TestTenantResolvers(t *testing.T) {
+	claimsCtx := context.WithValue(context.Background(), ClaimsKey, &auth.JWTClaims{TenantID: "acme"})
+
+	// Test cases
+	tests := []struct {
+		name     string
+		resolver TenantResolver
+		request  *http.Request
+		expected string
+	}{
+		{
+			name:     "Subdomain",
+			resolver: TenantFromSubdomain("example.com"),
+			request:  httptest.NewRequest("GET", "http://acme.example.com/", nil),
+			expected: "acme",
+		},
+		{
+			name:     "Subdomain with port and nested label",
+			resolver: TenantFromSubdomain("example.com"),
+			request:  httptest.NewRequest("GET", "http://api.acme.example.com:8080/", nil),
+			expected: "acme",
+		},
+		{
+			name:     "Subdomain with several nested labels",
+			resolver: TenantFromSubdomain("example.com"),
+			request:  httptest.NewRequest("GET", "http://www.eu.acme.example.com/", nil),
+			expected: "acme",
+		},
+		{
+			name:     "Subdomain of another domain",
+			resolver: TenantFromSubdomain("example.com"),
+			request:  httptest.NewRequest("GET", "http://acme.example.com.evil.net/", nil),
+			expected: "",
+		},
+		{
+			name:     "Bare base domain",
+			resolver: TenantFromSubdomain("example.com"),
+			request:  httptest.NewRequest("GET", "http://example.com/", nil),
+			expected: "",
+		},
+		{
+			name:     "Header",
+			resolver: TenantFromHeader("X-Tenant-ID"),
+			request: func() *http.Request {
+				req := httptest.NewRequest("GET", "/", nil)
+				req.Header.Set("X-Tenant-ID", " acme ")
+				return req
+			}(),
+			expected: "acme",
+		},
+		{
+			name:     "Path prefix",
+			resolver: TenantFromPathPrefix(),
+			request:  httptest.NewRequest("GET", "/acme/orders/1", nil),
+			expected: "acme",
+		},
+		{
+			name:     "Claims",
+			resolver: TenantFromClaims(),
+			request:  httptest.NewRequest("GET", "/", nil).WithContext(claimsCtx),
+			expected: "acme",
+		},
+		{
+			name:     "Claims missing",
+			resolver: TenantFromClaims(),
+			request:  httptest.NewRequest("GET", "/", nil),
+			expected: "",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.resolver(tc.request); got != tc.expected {
+				t.Errorf("Expected tenant %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+// TestTenant tests the Tenant middleware for resolving, validating and cross-checking tenants.
+func TestTenant(t *testing.T) {
+	store := TenantMap{
+		"acme":   {ID: "acme"},
+		"globex": {ID: "globex"},
+	}
+
+	// Test cases
+	tests := []struct {
+		name           string
+		store          TenantStore
+		header         string
+		claims         *auth.JWTClaims
+		expectedStatus int
+		expectedTenant string
+	}{
+		{
+			name:           "Known tenant",
+			store:          store,
+			header:         "acme",
+			expectedStatus: http.StatusOK,
+			expectedTenant: "acme",
+		},
+		{
+			name:           "Missing tenant",
+			store:          store,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Unknown tenant",
+			store:          store,
+			header:         "initech",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Store failure",
+			store:          failingTenantStore{},
+			header:         "acme",
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name:           "Matching claims",
+			store:          store,
+			header:         "acme",
+			claims:         &auth.JWTClaims{TenantID: "acme"},
+			expectedStatus: http.StatusOK,
+			expectedTenant: "acme",
+		},
+		{
+			name:           "Mismatching claims",
+			store:          store,
+			header:         "globex",
+			claims:         &auth.JWTClaims{TenantID: "acme"},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Unscoped claims",
+			store:          store,
+			header:         "globex",
+			claims:         &auth.JWTClaims{},
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var resolved string
+			handler := Chain(func(w http.ResponseWriter, r *http.Request) {
+				tenant, ok := TenantFromContext(r.Context())
+				if !ok {
+					t.Error("Tenant not found in request context")
+					return
+				}
+				resolved = tenant.ID
+				w.WriteHeader(http.StatusOK)
+			}, Tenant(tc.store, TenantFromHeader("X-Tenant-ID")))
+
+			req := httptest.NewRequest("GET", "/", nil)
+			if tc.header != "" {
+				req.Header.Set("X-Tenant-ID", tc.header)
+			}
+			if tc.claims != nil {
+				req = req.WithContext(context.WithValue(req.Context(), ClaimsKey, tc.claims))
+			}
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tc.expectedStatus, rr.Code)
+			}
+			if resolved != tc.expectedTenant {
+				t.Errorf("Expected tenant %q, got %q", tc.expectedTenant, resolved)
+			}
+		})
+	}
+}
+
+// TestTenantHTTPAuth tests that HTTPAuth uses the tenant's JWT secret and rejects tokens of other tenants.
+func TestTenantHTTPAuth(t *testing.T) {
+	defaultSecret := []byte("default-secret")
+	acmeSecret := []byte("acme-secret")
+	store := TenantMap{
+		"acme":   {ID: "acme", JWTSecret: acmeSecret},
+		"globex": {ID: "globex"},
+	}
+
+	// Test cases
+	tests := []struct {
+		name           string
+		tenant         string
+		token          string
+		expectedStatus int
+	}{
+		{
+			name:           "Tenant secret",
+			tenant:         "acme",
+			token:          tenantToken(t, acmeSecret, "acme"),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Default secret rejected for tenant with own secret",
+			tenant:         "acme",
+			token:          tenantToken(t, defaultSecret, "acme"),
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Default secret for tenant without own secret",
+			tenant:         "globex",
+			token:          tenantToken(t, defaultSecret, "globex"),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Token of another tenant",
+			tenant:         "globex",
+			token:          tenantToken(t, defaultSecret, "acme"),
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Token without a tenant",
+			tenant:         "globex",
+			token:          tenantToken(t, defaultSecret, ""),
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := Chain(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}, Tenant(store, TenantFromHeader("X-Tenant-ID")), func(next http.HandlerFunc) http.HandlerFunc {
+				return HTTPAuth(defaultSecret, next)
+			})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-Tenant-ID", tc.tenant)
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tc.expectedStatus, rr.Code)
+			}
+		})
+	}
+}
+
+// TestTenantCors tests that Cors prefers the tenant's CORS configuration.
+func TestTenantCors(t *testing.T) {
+	tenantCORS := &CORSConfig{AllowOrigin: "https://acme.example.com"}
+	tenantCORS.Init()
+	store := TenantMap{
+		"acme":   {ID: "acme", CORS: tenantCORS},
+		"globex": {ID: "globex"},
+	}
+	defaultCORS := &CORSConfig{AllowOrigin: "https://www.example.com"}
+	defaultCORS.Init()
+
+	// Test cases
+	tests := []struct {
+		name           string
+		tenant         string
+		origin         string
+		expectedOrigin string
+	}{
+		{
+			name:           "Tenant configuration",
+			tenant:         "acme",
+			origin:         "https://acme.example.com",
+			expectedOrigin: "https://acme.example.com",
+		},
+		{
+			name:           "Default configuration",
+			tenant:         "globex",
+			origin:         "https://www.example.com",
+			expectedOrigin: "https://www.example.com",
+		},
+		{
+			name:   "Origin of another tenant",
+			tenant: "globex",
+			origin: "https://acme.example.com",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := Chain(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}, Tenant(store, TenantFromHeader("X-Tenant-ID")), Cors(defaultCORS))
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-Tenant-ID", tc.tenant)
+			req.Header.Set("Origin", tc.origin)
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+
+			if got := rr.Header().Get("Access-Control-Allow-Origin"); got != tc.expectedOrigin {
+				t.Errorf("Expected origin %q, got %q", tc.expectedOrigin, got)
+			}
+		})
+	}
+}
+
+// TestTenantWebSocketAuth tests that WebSocketAuth uses the tenant's JWT secret and rejects tokens of other tenants.
+func TestTenantWebSocketAuth(t *testing.T) {
+	defaultSecret := []byte("default-secret")
+	acmeSecret := []byte("acme-secret")
+	store := TenantMap{
+		"acme":   {ID: "acme", JWTSecret: acmeSecret},
+		"globex": {ID: "globex"},
+	}
+	handler := WebSocketAuth(defaultSecret, func(conn *WebSocketConn, r *http.Request) {
+		conn.Send(websocket.TextMessage, []byte("welcome"))
+	})
+	server := httptest.NewServer(Chain(WebSocketUpgrade(&CORSConfig{AllowOrigin: "*"}, handler), Tenant(store, TenantFromHeader("X-Tenant-ID"))))
+	defer server.Close()
+
+	// Test cases
+	tests := []struct {
+		name           string
+		tenant         string
+		token          string
+		expectedReason string // of the close frame, "" if the connection is accepted
+	}{
+		{
+			name:   "Tenant secret",
+			tenant: "acme",
+			token:  tenantToken(t, acmeSecret, "acme"),
+		},
+		{
+			name:           "Default secret rejected for tenant with own secret",
+			tenant:         "acme",
+			token:          tenantToken(t, defaultSecret, "acme"),
+			expectedReason: "Invalid token",
+		},
+		{
+			name:   "Default secret for tenant without own secret",
+			tenant: "globex",
+			token:  tenantToken(t, defaultSecret, "globex"),
+		},
+		{
+			name:           "Token of another tenant",
+			tenant:         "globex",
+			token:          tenantToken(t, defaultSecret, "acme"),
+			expectedReason: "Token of another tenant",
+		},
+		{
+			name:           "Token without a tenant",
+			tenant:         "globex",
+			token:          tenantToken(t, defaultSecret, ""),
+			expectedReason: "Token of another tenant",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/?token="+tc.token, http.Header{"X-Tenant-ID": {tc.tenant}})
+			if err != nil {
+				t.Fatalf("Failed to dial: %v", err)
+			}
+			defer ws.Close()
+			_, msg, err := ws.ReadMessage()
+			if tc.expectedReason == "" {
+				if err != nil || string(msg) != "welcome" {
+					t.Errorf("Expected the connection to be accepted, got %q (%v)", msg, err)
+				}
+				return
+			}
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != tc.expectedReason {
+				t.Errorf("Expected close 1008 %q, got %v", tc.expectedReason, err)
+			}
+		})
+	}
+}
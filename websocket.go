@@ -2,7 +2,6 @@ package possum
 
 import (
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -10,101 +9,217 @@ import (
 )
 
 const (
-	// WebSocket configuration constants for timeouts and message sizes.
-	writeWait      = 10 * time.Second    // 写超时
-	pongWait       = 60 * time.Second    // 等待pong响应超时
-	pingPeriod     = (pongWait * 9) / 10 // 发送ping间隔（略小于pongWait）
-	maxMessageSize = 512 * 1024          // 最大消息大小（512KB）
+	// CompressionNoThreshold as WebSocketConfig.CompressionThreshold compresses every message.
+	CompressionNoThreshold = -1
 )
 
-var (
-	websocketUpgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			// TODO: 根据配置检查origin
-			return true
-		},
-	}
-)
+// WebSocketConfig configures a WebSocket endpoint. Zero values fall back to the default configuration.
+type WebSocketConfig struct {
+	ReadBufferSize    int           `mapstructure:"read_buffer_size,omitempty"`
+	WriteBufferSize   int           `mapstructure:"write_buffer_size,omitempty"`
+	HandshakeTimeout  time.Duration `mapstructure:"handshake_timeout,omitempty"`
+	WriteWait         time.Duration `mapstructure:"write_wait,omitempty"`         // 写超时
+	PongWait          time.Duration `mapstructure:"pong_wait,omitempty"`          // 等待pong响应超时
+	PingPeriod        time.Duration `mapstructure:"ping_period,omitempty"`        // 发送ping间隔（须小于PongWait）
+	MaxMessageSize    int64         `mapstructure:"max_message_size,omitempty"`   // 最大消息大小
+	SendQueueSize     int           `mapstructure:"send_queue_size,omitempty"`    // 发送队列容量
+	SendPolicy        SendPolicy    `mapstructure:"send_policy,omitempty"`        // 发送队列满时的策略
+	Subprotocols      []string      `mapstructure:"subprotocols,omitempty"`       // 支持的子协议，按优先级排序
+	EnableCompression bool          `mapstructure:"enable_compression,omitempty"` // permessage-deflate
+	// CompressionLevel is the flate level of permessage-deflate, from -2 (Huffman only) to 9,
+	// 0 being no compression; nil keeps the default, best speed.
+	CompressionLevel *int `mapstructure:"compression_level,omitempty"`
+	// CompressionThreshold is the minimum size of a message to compress it, default 256 bytes;
+	// CompressionNoThreshold compresses every message.
+	CompressionThreshold int `mapstructure:"compression_threshold,omitempty"`
+	// CORS is the origin policy of the endpoint; nil uses the default CORS configuration.
+	CORS *CORSConfig `mapstructure:"cors,omitempty"`
+	// Metrics collects the counters of the endpoint's connections; nil disables them.
+	Metrics *WebSocketMetrics `mapstructure:"-"`
+	// Codecs are offered as subprotocols after Subprotocols; without a match JSONCodec is used.
+	Codecs []Codec `mapstructure:"-"`
+	// LongPolling serves clients that cannot upgrade over HTTP long-polling on the same URL;
+	// nil disables the fallback.
+	LongPolling *LongPollConfig `mapstructure:"long_polling,omitempty"`
+	// Limiter caps the connections of the endpoint and their message rate; nil disables limits.
+	Limiter *ConnLimiter `mapstructure:"-"`
+}
 
-type WebsocketHandlerFunc func(conn *websocket.Conn, r *http.Request)
+var defaultWebSocketConfig = &WebSocketConfig{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	WriteWait:       10 * time.Second,
+	PongWait:        60 * time.Second,
+	PingPeriod:      54 * time.Second,
+	MaxMessageSize:  512 * 1024,
+	SendQueueSize:   256,
+	SendPolicy:      SendDropNewest,
 
-// WebSocketUpgrade is a middleware that handles WebSocket connections with CORS support.
-func WebSocketUpgrade(corsConfig *CORSConfig, next WebsocketHandlerFunc) http.HandlerFunc {
-	if corsConfig == nil {
-		corsConfig = defaultCORSConfig
+	CompressionThreshold: 256,
+}
+
+func SetDefaultWebSocketConfig(config *WebSocketConfig) {
+	defaultWebSocketConfig = config
+}
+
+// withDefaults returns a copy of config with zero values replaced by the default configuration.
+func (config *WebSocketConfig) withDefaults() *WebSocketConfig {
+	cfg := *defaultWebSocketConfig
+	if config == nil {
+		return &cfg
+	}
+	merged := *config
+	if merged.ReadBufferSize == 0 {
+		merged.ReadBufferSize = cfg.ReadBufferSize
+	}
+	if merged.WriteBufferSize == 0 {
+		merged.WriteBufferSize = cfg.WriteBufferSize
+	}
+	if merged.HandshakeTimeout == 0 {
+		merged.HandshakeTimeout = cfg.HandshakeTimeout
+	}
+	if merged.WriteWait == 0 {
+		merged.WriteWait = cfg.WriteWait
+	}
+	if merged.PongWait == 0 {
+		merged.PongWait = cfg.PongWait
 	}
-	// 配置WebSocket upgrader
-	websocketUpgrader.ReadBufferSize = 1024  // 可以从配置中读取
-	websocketUpgrader.WriteBufferSize = 1024 // 可以从配置中读取
+	if merged.PingPeriod == 0 {
+		merged.PingPeriod = merged.PongWait * 9 / 10
+	}
+	if merged.MaxMessageSize == 0 {
+		merged.MaxMessageSize = cfg.MaxMessageSize
+	}
+	if merged.SendQueueSize == 0 {
+		merged.SendQueueSize = cfg.SendQueueSize
+	}
+	if merged.SendPolicy == "" {
+		merged.SendPolicy = cfg.SendPolicy
+	}
+	if merged.CompressionThreshold == 0 {
+		merged.CompressionThreshold = cfg.CompressionThreshold
+	}
+	if merged.Subprotocols == nil {
+		merged.Subprotocols = cfg.Subprotocols
+	}
+	if merged.CORS == nil {
+		merged.CORS = cfg.CORS
+	}
+	if merged.Metrics == nil {
+		merged.Metrics = cfg.Metrics
+	}
+	if merged.Codecs == nil {
+		merged.Codecs = cfg.Codecs
+	}
+	if merged.Limiter == nil {
+		merged.Limiter = cfg.Limiter
+	}
+	if merged.LongPolling == nil {
+		merged.LongPolling = cfg.LongPolling
+	}
+	if merged.LongPolling != nil {
+		merged.LongPolling = merged.LongPolling.withDefaults()
+	}
+	return &merged
+}
 
-	// 根据环境和CORS配置设置CheckOrigin
+// newUpgrader creates the upgrader owned by a single endpoint.
+func (config *WebSocketConfig) newUpgrader() *websocket.Upgrader {
+	subprotocols := config.Subprotocols
+	if len(config.Codecs) > 0 {
+		subprotocols = append([]string{}, config.Subprotocols...)
+		for _, codec := range config.Codecs {
+			subprotocols = append(subprotocols, codec.Name())
+		}
+	}
+	return &websocket.Upgrader{
+		HandshakeTimeout:  config.HandshakeTimeout,
+		ReadBufferSize:    config.ReadBufferSize,
+		WriteBufferSize:   config.WriteBufferSize,
+		Subprotocols:      subprotocols,
+		EnableCompression: config.EnableCompression,
+		CheckOrigin:       checkOrigin(config.CORS),
+	}
+}
+
+// checkOrigin returns the origin policy for a CORS configuration, preferring the resolved tenant's.
+func checkOrigin(corsConfig *CORSConfig) func(r *http.Request) bool {
+	// 开发环境允许所有源
 	if config.IsDev() {
-		websocketUpgrader.CheckOrigin = func(r *http.Request) bool {
-			return true // 开发环境允许所有源
+		return func(r *http.Request) bool {
+			return true
 		}
-	} else {
-		websocketUpgrader.CheckOrigin = func(r *http.Request) bool {
-			origin := r.Header.Get("Origin")
-			if corsConfig.AllowOrigin == "*" {
-				return true // 如果允许所有源，直接返回true
-			}
-			if corsConfig.AllowOrigin == "" {
-				return false // 如果没有配置具体的允许源，默认允许
-			}
-			// 检查origin是否匹配AllowOrigin（精确匹配或子字符串匹配）
-			if corsConfig.AllowOrigin == origin {
-				return true
-			}
-			// 子字符串匹配 - check if AllowOrigin is a substring of origin
-			if strings.Contains(origin, corsConfig.AllowOrigin) {
-				return true
-			}
-			return false
+	}
+	if corsConfig != nil {
+		corsConfig.compile()
+	}
+	return func(r *http.Request) bool {
+		corsConfig := corsConfig
+		if tenant, ok := TenantFromContext(r.Context()); ok && tenant.CORS != nil {
+			corsConfig = tenant.CORS
+		}
+		if corsConfig == nil {
+			corsConfig = defaultCORSConfig
 		}
+		return corsConfig.AllowsOrigin(r.Header.Get("Origin"))
+	}
+}
+
+// WebsocketHandlerFunc handles a managed WebSocket connection. The connection is closed
+// normally when the handler returns, after the messages it queued have been sent.
+type WebsocketHandlerFunc func(conn *WebSocketConn, r *http.Request)
+
+// WebSocketUpgrade is a middleware that handles WebSocket connections with CORS support,
+// using the default WebSocket configuration with the given CORS configuration as origin policy.
+func WebSocketUpgrade(corsConfig *CORSConfig, next WebsocketHandlerFunc) http.HandlerFunc {
+	return WebSocketUpgradeWithConfig(&WebSocketConfig{CORS: corsConfig}, next)
+}
+
+// WebSocketUpgradeWithConfig is a middleware that handles WebSocket connections for an endpoint
+// with its own configuration. Each endpoint owns its upgrader, so endpoints never affect each other.
+func WebSocketUpgradeWithConfig(wsConfig *WebSocketConfig, next WebsocketHandlerFunc) http.HandlerFunc {
+	cfg := wsConfig.withDefaults()
+	upgrader := cfg.newUpgrader()
+	var polling *longPoll
+	if cfg.LongPolling != nil {
+		polling = newLongPoll(cfg, upgrader, next)
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		if polling != nil && !websocket.IsWebSocketUpgrade(r) {
+			polling.ServeHTTP(w, r)
+			return
+		}
+		var slot *connSlot
+		if cfg.Limiter != nil {
+			var ok bool
+			if slot, ok = cfg.Limiter.acquire(r); !ok {
+				cfg.Limiter.reject(w)
+				return
+			}
+		}
 		// 升级HTTP连接到WebSocket
-		conn, err := websocketUpgrader.Upgrade(w, r, nil)
+		raw, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			// WebSocket升级失败时，Upgrade函数已经写入了错误响应，不需要再次写入
 			// 避免重复的WriteHeader调用
+			slot.release()
 			return
 		}
 
-		// 设置连接参数
-		conn.SetReadLimit(maxMessageSize)
-		conn.SetReadDeadline(time.Now().Add(pongWait))
-		conn.SetPongHandler(func(string) error {
-			conn.SetReadDeadline(time.Now().Add(pongWait))
-			return nil
-		})
-
-		// 启动ping处理器
-		go func() {
-			ticker := time.NewTicker(pingPeriod)
-			defer ticker.Stop()
-			for {
-				<-ticker.C
-				conn.SetWriteDeadline(time.Now().Add(writeWait))
-				if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-					return
-				}
-			}
-		}()
+		// 启动读写协程，写操作全部由写协程完成
+		conn := newWebSocketConn(raw, cfg, r)
+		conn.slot = slot
+		conn.start()
 
-		// 确保连接关闭和清理
+		// 确保连接关闭并等待所有协程退出
 		defer func() {
-			ticker := time.NewTicker(writeWait)
-			defer ticker.Stop()
-			conn.SetWriteDeadline(time.Now().Add(writeWait))
-			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-			conn.Close()
+			conn.finish()
+			cfg.Metrics.disconnected()
+			slot.release()
 		}()
 
 		// 调用下一个处理器
-		next(conn, r)
+		next(conn, r.WithContext(conn.Context()))
 	}
 }
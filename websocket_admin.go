@@ -0,0 +1,218 @@
+package possum
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+
+	"github.com/mikespook/possum/auth"
+	"github.com/mikespook/possum/log"
+)
+
+// WebSocketConnInfo describes a live connection; the counters of its stats are inlined.
+type WebSocketConnInfo struct {
+	ID         string    `json:"id"`
+	UserID     uuid.UUID `json:"user_id"`
+	RemoteAddr string    `json:"remote_addr"`
+	Transport  string    `json:"transport"`
+	Rooms      []string  `json:"rooms"`
+	WebSocketConnStats
+}
+
+// WebSocketAdmin is an HTTP handler inspecting and managing the connections of a hub. It has no
+// access control of its own: wrap it with HTTPAuth and RequireRole.
+type WebSocketAdmin struct {
+	hub *Hub
+}
+
+// NewWebSocketAdmin creates the admin handler of hub.
+func NewWebSocketAdmin(hub *Hub) *WebSocketAdmin {
+	return &WebSocketAdmin{hub: hub}
+}
+
+// ServeHTTP serves the admin API; responses carry WebSocketConnInfo data:
+//
+//	GET                       lists the connections, filtered by the user_id and room parameters
+//	GET    ?id=               describes a connection
+//	POST   ?id=               sends the body as a text message, or binary for application/octet-stream
+//	DELETE ?id=&code=&reason= closes a connection, normally unless code is given; reasons are
+//	limited to MaxCloseReasonSize bytes
+//
+// Close codes must be sendable: 1000-1003, 1007-1014 or 3000-4999; others get BadRequestResponse.
+func (a *WebSocketAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	if id == "" {
+		if r.Method != http.MethodGet {
+			MethodNotAllowedResponse.Write(w)
+			return
+		}
+		a.list(w, r)
+		return
+	}
+	conn, ok := a.hub.Conn(id)
+	if !ok {
+		NotFoundResponse.Write(w)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		info, ok := a.hub.connInfo(conn)
+		if !ok {
+			NotFoundResponse.Write(w)
+			return
+		}
+		resp := NewResponse(r)
+		resp.SetData(info)
+		resp.Write(w)
+	case http.MethodPost:
+		a.send(w, r, conn)
+	case http.MethodDelete:
+		code := websocket.CloseNormalClosure
+		if s := query.Get("code"); s != "" {
+			var err error
+			if code, err = strconv.Atoi(s); err != nil || !sendableCloseCode(code) {
+				BadRequestResponse.Write(w)
+				return
+			}
+		}
+		reason := query.Get("reason")
+		if len(reason) > MaxCloseReasonSize {
+			BadRequestResponse.Write(w)
+			return
+		}
+		a.audit(r, conn).Int("code", code).Msg("websocket admin disconnect")
+		conn.Close(code, reason)
+		resp := NewResponse(r)
+		resp.WriteHeader(http.StatusNoContent)
+		resp.Write(w)
+	default:
+		MethodNotAllowedResponse.Write(w)
+	}
+}
+
+// list writes the matching connections, oldest first.
+func (a *WebSocketAdmin) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	userID := uuid.Nil
+	if s := query.Get("user_id"); s != "" {
+		var err error
+		if userID, err = uuid.Parse(s); err != nil {
+			BadRequestResponse.Write(w)
+			return
+		}
+	}
+	room := query.Get("room")
+	infos := a.hub.connInfos(func(_ *WebSocketConn, client *hubClient) bool {
+		if userID != uuid.Nil && client.userID != userID {
+			return false
+		}
+		if room != "" {
+			if _, ok := client.rooms[room]; !ok {
+				return false
+			}
+		}
+		return true
+	})
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].ConnectedAt.Equal(infos[j].ConnectedAt) {
+			return infos[i].ID < infos[j].ID
+		}
+		return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+	})
+	resp := NewResponse(r)
+	resp.SetData(infos)
+	resp.Write(w)
+}
+
+// send queues the request body on conn, limited to its MaxMessageSize.
+func (a *WebSocketAdmin) send(w http.ResponseWriter, r *http.Request, conn *WebSocketConn) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, conn.config.MaxMessageSize))
+	if err != nil {
+		BadRequestResponse.Write(w)
+		return
+	}
+	messageType := websocket.TextMessage
+	if r.Header.Get("Content-Type") == "application/octet-stream" {
+		messageType = websocket.BinaryMessage
+	}
+	a.audit(r, conn).Int("size", len(data)).Msg("websocket admin send")
+	switch err := conn.Send(messageType, data); {
+	case errors.Is(err, ErrConnClosed):
+		NotFoundResponse.Write(w)
+	case errors.Is(err, ErrSendQueueFull):
+		TooManyRequestsResponse.Write(w)
+	case err != nil:
+		WriteResponse(w, InternalServerErrorResponse, err)
+	default:
+		resp := NewResponse(r)
+		resp.WriteHeader(http.StatusNoContent)
+		resp.Write(w)
+	}
+}
+
+// audit starts the log entry of an action on conn, with the administrator from the claims.
+func (a *WebSocketAdmin) audit(r *http.Request, conn *WebSocketConn) *zerolog.Event {
+	event := log.Info().Str("conn_id", conn.ID())
+	if claims, ok := r.Context().Value(ClaimsKey).(*auth.JWTClaims); ok {
+		event = event.Str("admin_id", claims.UserID.String())
+	}
+	return event
+}
+
+// sendableCloseCode reports whether code may be sent in a close frame: the codes defined by
+// RFC 6455 and registered with IANA, except those reserved for reporting (1004-1006, 1015),
+// and the codes of libraries and applications.
+func sendableCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	}
+	return code >= 3000 && code <= 4999
+}
+
+// connInfos describes the registered connections accepted by match, which runs under h.mu.
+func (h *Hub) connInfos(match func(conn *WebSocketConn, client *hubClient) bool) []WebSocketConnInfo {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	infos := []WebSocketConnInfo{}
+	for conn, client := range h.clients {
+		if match(conn, client) {
+			infos = append(infos, newConnInfo(conn, client))
+		}
+	}
+	return infos
+}
+
+// connInfo describes a registered connection.
+func (h *Hub) connInfo(conn *WebSocketConn) (WebSocketConnInfo, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	client, ok := h.clients[conn]
+	if !ok {
+		return WebSocketConnInfo{}, false
+	}
+	return newConnInfo(conn, client), true
+}
+
+func newConnInfo(conn *WebSocketConn, client *hubClient) WebSocketConnInfo {
+	rooms := make([]string, 0, len(client.rooms))
+	for room := range client.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return WebSocketConnInfo{
+		ID:                 conn.ID(),
+		UserID:             client.userID,
+		RemoteAddr:         conn.RemoteAddr().String(),
+		Transport:          conn.Transport(),
+		Rooms:              rooms,
+		WebSocketConnStats: conn.Stats(),
+	}
+}
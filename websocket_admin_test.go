@@ -0,0 +1,165 @@
+package possum
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"github.com/mikespook/possum/auth"
+)
+
+// TestWebSocketAdmin tests listing, messaging and disconnecting the connections of a hub.
+func TestWebSocketAdmin(t *testing.T) {
+	secret := []byte("test-secret")
+	hub := NewHub()
+	server := newHubServer(t, secret, hub)
+	alice, bob := uuid.New(), uuid.New()
+	dialHub(t, server, secret, alice, "a")
+	bobWS := dialHub(t, server, secret, bob, "b", "a")
+
+	admin := httptest.NewServer(HTTPAuth(secret, RequireRole("admin", NewWebSocketAdmin(hub).ServeHTTP)))
+	defer admin.Close()
+	token := func(roles ...string) string {
+		claims := auth.NewClaims(uuid.New(), nil)
+		claims.Roles = roles
+		token, _ := auth.SignToken(secret, claims)
+		return token
+	}
+	adminToken := token("admin")
+	request := func(method, query, body, token string, data any) int {
+		req, _ := http.NewRequest(method, admin.URL+"?"+query, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to %s: %v", method, err)
+		}
+		defer resp.Body.Close()
+		if data != nil && resp.StatusCode == http.StatusOK {
+			var envelope struct {
+				Data json.RawMessage `json:"data"`
+			}
+			json.NewDecoder(resp.Body).Decode(&envelope)
+			json.Unmarshal(envelope.Data, data)
+		}
+		return resp.StatusCode
+	}
+	users := func(infos []WebSocketConnInfo) string {
+		var s []string
+		for _, info := range infos {
+			name := "alice"
+			if info.UserID == bob {
+				name = "bob"
+			}
+			s = append(s, fmt.Sprintf("%s%v", name, info.Rooms))
+		}
+		return strings.Join(s, " ")
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		token    string
+		code     int
+		expected string
+	}{
+		{name: "All", code: http.StatusOK, expected: "alice[a] bob[a b]"},
+		{name: "By user", query: "user_id=" + bob.String(), code: http.StatusOK, expected: "bob[a b]"},
+		{name: "By room", query: "room=b", code: http.StatusOK, expected: "bob[a b]"},
+		{name: "No match", query: "room=c", code: http.StatusOK},
+		{name: "Invalid user", query: "user_id=bob", code: http.StatusBadRequest},
+		{name: "Not an admin", token: token("support"), code: http.StatusForbidden},
+		{name: "Unknown connection", query: "id=missing", code: http.StatusNotFound},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.token == "" {
+				tc.token = adminToken
+			}
+			var infos []WebSocketConnInfo
+			if code := request(http.MethodGet, tc.query, "", tc.token, &infos); code != tc.code {
+				t.Fatalf("Expected %d, got %d", tc.code, code)
+			}
+			if got := users(infos); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+
+	var infos []WebSocketConnInfo
+	request(http.MethodGet, "user_id="+bob.String(), "", adminToken, &infos)
+	id := infos[0].ID
+	var info WebSocketConnInfo
+	if code := request(http.MethodGet, "id="+id, "", adminToken, &info); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+	if info.ID != id || info.Transport != TransportWebSocket || info.RemoteAddr == "" || info.MessagesOut != 1 || info.ConnectedAt.IsZero() {
+		t.Errorf("Unexpected connection %+v", info)
+	}
+
+	if code := request(http.MethodPost, "id="+id, "maintenance soon", adminToken, nil); code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", code)
+	}
+	if _, msg, err := bobWS.ReadMessage(); err != nil || string(msg) != "maintenance soon" {
+		t.Errorf("Expected the admin message, got %q (%v)", msg, err)
+	}
+
+	for _, code := range []string{"abc", "999", "1005", "1006", "1015", "2000", "5000"} {
+		if status := request(http.MethodDelete, "id="+id+"&code="+code, "", adminToken, nil); status != http.StatusBadRequest {
+			t.Errorf("Expected 400 for close code %s, got %d", code, status)
+		}
+	}
+	if status := request(http.MethodDelete, "id="+id+"&reason="+strings.Repeat("x", MaxCloseReasonSize+1), "", adminToken, nil); status != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a long reason, got %d", status)
+	}
+	if code := request(http.MethodDelete, "id="+id+"&code=4003&reason=kicked", "", adminToken, nil); code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", code)
+	}
+	_, _, err := bobWS.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != 4003 || closeErr.Text != "kicked" {
+		t.Errorf("Expected close 4003 kicked, got %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for hub.Len() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if code := request(http.MethodGet, "id="+id, "", adminToken, nil); code != http.StatusNotFound {
+		t.Errorf("Expected 404 after disconnect, got %d", code)
+	}
+}
+
+// TestSendableCloseCode tests the close codes an administrator may send.
+func TestSendableCloseCode(t *testing.T) {
+	tests := []struct {
+		code     int
+		expected bool
+	}{
+		{code: 999, expected: false},
+		{code: websocket.CloseNormalClosure, expected: true},
+		{code: websocket.CloseUnsupportedData, expected: true},
+		{code: 1004, expected: false},
+		{code: websocket.CloseNoStatusReceived, expected: false},
+		{code: websocket.CloseAbnormalClosure, expected: false},
+		{code: websocket.CloseInvalidFramePayloadData, expected: true},
+		{code: websocket.CloseTryAgainLater, expected: true},
+		{code: 1014, expected: true},
+		{code: websocket.CloseTLSHandshake, expected: false},
+		{code: 2999, expected: false},
+		{code: 3000, expected: true},
+		{code: 4999, expected: true},
+		{code: 5000, expected: false},
+	}
+	for _, tc := range tests {
+		if got := sendableCloseCode(tc.code); got != tc.expected {
+			t.Errorf("sendableCloseCode(%d): expected %t, got %t", tc.code, tc.expected, got)
+		}
+	}
+}
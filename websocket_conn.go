@@ -0,0 +1,467 @@
+package possum
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"github.com/mikespook/possum/log"
+)
+
+const (
+	// incomingQueueSize is the number of received messages buffered for ReadMessage.
+	incomingQueueSize = 16
+	// MaxCloseReasonSize is the number of bytes of a close reason that fit in a close frame,
+	// whose payload is at most 125 bytes including the code.
+	MaxCloseReasonSize = 123
+)
+
+var (
+	ErrConnClosed    = errors.New("websocket connection closed")
+	ErrSendQueueFull = errors.New("websocket send queue full")
+)
+
+type wsMessage struct {
+	messageType int
+	data        []byte
+	// key identifies messages that supersede each other under SendCoalesce
+	key string
+}
+
+// WebSocketConn is a managed WebSocket connection. A single writer goroutine owns all writes
+// to the underlying connection, including pings, and a single reader goroutine handles control
+// frames and delivers data messages to ReadMessage. Send, SendJSON and Close are safe to call
+// from any goroutine.
+type WebSocketConn struct {
+	id     string
+	conn   *websocket.Conn
+	config *WebSocketConfig
+
+	mu  sync.RWMutex
+	ctx context.Context
+
+	done      <-chan struct{}
+	cancel    context.CancelFunc
+	queue     *sendQueue
+	session   *Session
+	poll      *pollSession
+	slot      *connSlot
+	rate      *tokenBucket
+	rateMu    sync.Mutex
+	incoming  chan wsMessage
+	calls     chan func()
+	closing   chan struct{}
+	closeMsg  []byte
+	closeOnce sync.Once
+	readErr   error
+	readDone  chan struct{}
+	writeDone chan struct{}
+
+	connectedAt time.Time
+	messagesIn  atomic.Int64
+	messagesOut atomic.Int64
+	bytesIn     atomic.Int64
+	bytesOut    atomic.Int64
+	dropped     atomic.Int64
+	closeCode   atomic.Int64
+}
+
+// WebSocketConnStats are the counters of a single connection.
+type WebSocketConnStats struct {
+	ConnectedAt time.Time `json:"connected_at"`
+	MessagesIn  int64     `json:"messages_in"`
+	MessagesOut int64     `json:"messages_out"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	// MessagesDropped counts messages discarded by the send policy.
+	MessagesDropped int64 `json:"messages_dropped"`
+	// CloseCode is the code of the close frame sent or received first, 0 while open
+	// and websocket.CloseAbnormalClosure if the connection failed without one.
+	CloseCode int `json:"close_code,omitempty"`
+}
+
+// newWebSocketConn wraps an upgraded connection, or nil for a polling session; its context
+// derives from the request's.
+func newWebSocketConn(conn *websocket.Conn, config *WebSocketConfig, r *http.Request) *WebSocketConn {
+	ctx, cancel := context.WithCancel(r.Context())
+	return &WebSocketConn{
+		id:        uuid.NewString(),
+		conn:      conn,
+		config:    config,
+		ctx:       ctx,
+		done:      ctx.Done(),
+		cancel:    cancel,
+		queue:     newSendQueue(config.SendQueueSize, config.SendPolicy),
+		rate:      config.Limiter.newMessageBucket(),
+		incoming:  make(chan wsMessage, incomingQueueSize),
+		calls:     make(chan func()),
+		closing:   make(chan struct{}),
+		readDone:  make(chan struct{}),
+		writeDone: make(chan struct{}),
+
+		connectedAt: time.Now(),
+	}
+}
+
+// start runs the reader and writer goroutines. Polling sessions are served by requests instead.
+func (c *WebSocketConn) start() {
+	if c.poll != nil {
+		c.config.Metrics.connected()
+		go c.poll.run()
+		return
+	}
+	if c.config.EnableCompression && c.config.CompressionLevel != nil {
+		if err := c.conn.SetCompressionLevel(*c.config.CompressionLevel); err != nil {
+			log.Error().Err(err).Int("level", *c.config.CompressionLevel).Msg("invalid websocket compression level")
+		}
+	}
+	c.config.Metrics.connected()
+	go c.readPump()
+	go c.writePump()
+}
+
+// ID returns the unique ID of the connection, e.g. to target it with WebSocketAdmin.
+func (c *WebSocketConn) ID() string {
+	return c.id
+}
+
+// Context returns the connection context. It carries the values of the upgrade request, such as
+// claims and tenant, and is cancelled when the connection is closed by either side.
+func (c *WebSocketConn) Context() context.Context {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ctx
+}
+
+// setContext replaces the connection context with one derived from it, e.g. to add claims.
+func (c *WebSocketConn) setContext(ctx context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ctx = ctx
+}
+
+// Stats returns the counters of the connection.
+func (c *WebSocketConn) Stats() WebSocketConnStats {
+	return WebSocketConnStats{
+		ConnectedAt:     c.connectedAt,
+		MessagesIn:      c.messagesIn.Load(),
+		MessagesOut:     c.messagesOut.Load(),
+		BytesIn:         c.bytesIn.Load(),
+		BytesOut:        c.bytesOut.Load(),
+		MessagesDropped: c.dropped.Load(),
+		CloseCode:       int(c.closeCode.Load()),
+	}
+}
+
+// Transport returns TransportWebSocket, or TransportPolling for a long-polling session.
+func (c *WebSocketConn) Transport() string {
+	if c.poll != nil {
+		return TransportPolling
+	}
+	return TransportWebSocket
+}
+
+// Subprotocol returns the subprotocol negotiated during the upgrade, or "" if there is none.
+func (c *WebSocketConn) Subprotocol() string {
+	if c.poll != nil {
+		return c.poll.subprotocol
+	}
+	if c.conn == nil {
+		return ""
+	}
+	return c.conn.Subprotocol()
+}
+
+// Codec returns the codec negotiated from WebSocketConfig.Codecs, or JSONCodec.
+func (c *WebSocketConn) Codec() Codec {
+	subprotocol := c.Subprotocol()
+	for _, codec := range c.config.Codecs {
+		if codec.Name() == subprotocol {
+			return codec
+		}
+	}
+	return JSONCodec
+}
+
+// RemoteAddr returns the remote network address.
+func (c *WebSocketConn) RemoteAddr() net.Addr {
+	if c.poll != nil {
+		return c.poll.addr
+	}
+	return c.conn.RemoteAddr()
+}
+
+// Send queues a message for the writer goroutine. It never blocks: when the queue is full the
+// configured SendPolicy applies, and ErrSendQueueFull is returned if the message was not queued.
+// It returns ErrConnClosed once the connection is closing.
+func (c *WebSocketConn) Send(messageType int, data []byte) error {
+	return c.SendKeyed("", messageType, data)
+}
+
+// SendKeyed is Send for messages that supersede each other, such as state updates: under
+// SendCoalesce a queued message with the same key is replaced instead of queueing another.
+// Other policies ignore the key.
+func (c *WebSocketConn) SendKeyed(key string, messageType int, data []byte) error {
+	select {
+	case <-c.done:
+		return ErrConnClosed
+	default:
+	}
+	dropped, err := c.queue.push(wsMessage{messageType: messageType, data: data, key: key})
+	if dropped {
+		c.dropped.Add(1)
+		c.config.Metrics.droppedMessages(1)
+	}
+	if err != nil && c.queue.policy == SendDisconnect {
+		// The client cannot keep up; let it reconnect later rather than buffer without bound.
+		// It resynchronises anyway, so the backlog is dropped instead of delaying the close.
+		c.Close(websocket.CloseTryAgainLater, "Send queue full")
+		if n := c.queue.clear(); n > 0 {
+			c.dropped.Add(int64(n))
+			c.config.Metrics.droppedMessages(n)
+		}
+	}
+	return err
+}
+
+// SendJSON encodes v as JSON and queues it as a text message.
+func (c *WebSocketConn) SendJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Send(websocket.TextMessage, data)
+}
+
+// SendValue encodes v with the negotiated codec and queues it as a text or binary message.
+func (c *WebSocketConn) SendValue(v any) error {
+	codec := c.Codec()
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Send(codec.MessageType(), data)
+}
+
+// ReadMessage returns the next data message. Once the connection is closed it returns the
+// read error, which is a *websocket.CloseError if the peer closed the connection.
+func (c *WebSocketConn) ReadMessage() (messageType int, data []byte, err error) {
+	msg, ok := <-c.incoming
+	if !ok {
+		if c.readErr != nil {
+			return 0, nil, c.readErr
+		}
+		return 0, nil, ErrConnClosed
+	}
+	return msg.messageType, msg.data, nil
+}
+
+// ReadJSON reads the next data message and decodes it from JSON into v.
+func (c *WebSocketConn) ReadJSON(v any) error {
+	_, data, err := c.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ReadValue reads the next data message and decodes it with the negotiated codec into v.
+func (c *WebSocketConn) ReadValue(v any) error {
+	_, data, err := c.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return c.Codec().Unmarshal(data, v)
+}
+
+// Close starts the closing handshake with the given close code and reason. Messages already
+// queued are sent first, unless SendDisconnect discarded them. Close is idempotent; only the
+// first code and reason are used. Reasons are cut to MaxCloseReasonSize bytes.
+func (c *WebSocketConn) Close(code int, reason string) error {
+	c.closeOnce.Do(func() {
+		c.closeCode.CompareAndSwap(0, int64(code))
+		c.closeMsg = websocket.FormatCloseMessage(code, truncateCloseReason(reason))
+		close(c.closing)
+		c.cancel()
+	})
+	return nil
+}
+
+// truncateCloseReason cuts reason to MaxCloseReasonSize bytes without splitting a UTF-8 sequence.
+func truncateCloseReason(reason string) string {
+	if len(reason) <= MaxCloseReasonSize {
+		return reason
+	}
+	i := MaxCloseReasonSize
+	for i > 0 && !utf8.RuneStart(reason[i]) {
+		i--
+	}
+	return reason[:i]
+}
+
+// wait blocks until both helper goroutines have exited. It may be called more than once.
+func (c *WebSocketConn) wait() {
+	<-c.readDone
+	<-c.writeDone
+}
+
+// finish closes the connection normally unless it is already closing and waits for the
+// helper goroutines; the connection is gone when it returns.
+func (c *WebSocketConn) finish() {
+	c.Close(websocket.CloseNormalClosure, "")
+	c.wait()
+}
+
+// readPump reads until the connection fails, handling pongs and queueing data messages. A
+// handler that leaves PongWait without taking a message off the full queue has fallen behind:
+// the connection is closed with websocket.ClosePolicyViolation rather than stop reading, which
+// would leave pongs and close frames unprocessed.
+func (c *WebSocketConn) readPump() {
+	defer func() {
+		c.cancel()
+		close(c.incoming)
+		close(c.readDone)
+	}()
+	c.conn.SetReadLimit(c.config.MaxMessageSize)
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(c.config.PongWait))
+		return nil
+	})
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.config.PongWait))
+		messageType, data, err := c.conn.ReadMessage()
+		if err != nil {
+			code := int64(websocket.CloseAbnormalClosure)
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) {
+				code = int64(closeErr.Code)
+			}
+			c.closeCode.CompareAndSwap(0, code)
+			c.readErr = err
+			return
+		}
+		c.messagesIn.Add(1)
+		c.bytesIn.Add(int64(len(data)))
+		c.config.Metrics.received(len(data))
+		if !c.allowMessage() {
+			continue
+		}
+		msg := wsMessage{messageType: messageType, data: data}
+		select {
+		case c.incoming <- msg:
+			continue
+		case <-c.done:
+			// Closing: keep reading until the peer acknowledges, discarding data
+			continue
+		default:
+		}
+		timer := time.NewTimer(c.config.PongWait)
+		select {
+		case c.incoming <- msg:
+		case <-c.done:
+		case <-timer.C:
+			c.Close(websocket.ClosePolicyViolation, "Handler too slow")
+		}
+		timer.Stop()
+	}
+}
+
+// writePump is the only goroutine writing to the connection.
+func (c *WebSocketConn) writePump() {
+	ticker := time.NewTicker(c.config.PingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.cancel()
+		c.conn.Close()
+		if c.session != nil {
+			c.session.detach(c)
+		}
+		close(c.writeDone)
+	}()
+	for {
+		select {
+		case <-c.queue.notify:
+			if err := c.flush(); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := c.write(wsMessage{messageType: websocket.PingMessage}); err != nil {
+				return
+			}
+		case fn := <-c.calls:
+			fn()
+		case <-c.closing:
+			c.flush()
+			c.conn.SetWriteDeadline(time.Now().Add(c.config.WriteWait))
+			if err := c.conn.WriteMessage(websocket.CloseMessage, c.closeMsg); err != nil {
+				return
+			}
+			// Give the peer time to acknowledge the close
+			timer := time.NewTimer(c.config.WriteWait)
+			defer timer.Stop()
+			select {
+			case <-c.readDone:
+			case <-timer.C:
+			}
+			return
+		case <-c.readDone:
+			return
+		}
+	}
+}
+
+// inWriter runs fn on the writer goroutine between two writes and waits for it to return. It
+// returns false without running fn once the writer goroutine has exited.
+func (c *WebSocketConn) inWriter(fn func()) bool {
+	done := make(chan struct{})
+	select {
+	case c.calls <- func() { defer close(done); fn() }:
+		<-done
+		return true
+	case <-c.writeDone:
+		return false
+	}
+}
+
+// flush writes the queued messages.
+func (c *WebSocketConn) flush() error {
+	for {
+		msg, ok := c.queue.pop()
+		if !ok {
+			return nil
+		}
+		if err := c.write(msg); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *WebSocketConn) write(msg wsMessage) error {
+	if c.session != nil && msg.messageType != websocket.PingMessage {
+		// Numbered before writing so that a failed write is replayed on resume
+		c.session.sequence(msg)
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.config.WriteWait))
+	if c.config.EnableCompression {
+		// Compressing small messages costs more than it saves
+		c.conn.EnableWriteCompression(len(msg.data) >= c.config.CompressionThreshold)
+	}
+	if err := c.conn.WriteMessage(msg.messageType, msg.data); err != nil {
+		return err
+	}
+	if msg.messageType == websocket.TextMessage || msg.messageType == websocket.BinaryMessage {
+		c.messagesOut.Add(1)
+		c.bytesOut.Add(int64(len(msg.data)))
+		c.config.Metrics.sent(len(msg.data))
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package possum
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialWebSocket starts a server for handler and connects a client to it.
+func dialWebSocket(t *testing.T, cfg *WebSocketConfig, handler WebsocketHandlerFunc) *websocket.Conn {
+	t.Helper()
+	if cfg == nil {
+		cfg = &WebSocketConfig{}
+	}
+	if cfg.CORS == nil {
+		cfg.CORS = &CORSConfig{AllowOrigin: "*"}
+	}
+	server := httptest.NewServer(WebSocketUpgradeWithConfig(cfg, handler))
+	t.Cleanup(server.Close)
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+// TestWebSocketConnConcurrentSend tests that many goroutines can send at once and that queued
+// messages are flushed before the normal closure.
+func TestWebSocketConnConcurrentSend(t *testing.T) {
+	const senders, messages = 8, 20
+	ws := dialWebSocket(t, &WebSocketConfig{PingPeriod: time.Millisecond}, func(conn *WebSocketConn, r *http.Request) {
+		var wg sync.WaitGroup
+		for i := 0; i < senders; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < messages; j++ {
+					if err := conn.Send(websocket.TextMessage, []byte(fmt.Sprintf("%d-%d", i, j))); err != nil {
+						t.Errorf("Failed to send: %v", err)
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+	})
+
+	received := 0
+	for {
+		_, _, err := ws.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				t.Errorf("Expected normal closure, got %v", err)
+			}
+			break
+		}
+		received++
+	}
+	if received != senders*messages {
+		t.Errorf("Expected %d messages, got %d", senders*messages, received)
+	}
+}
+
+// TestWebSocketConnEcho tests reading and writing JSON messages.
+func TestWebSocketConnEcho(t *testing.T) {
+	type message struct {
+		Text string `json:"text"`
+	}
+	ws := dialWebSocket(t, nil, func(conn *WebSocketConn, r *http.Request) {
+		for {
+			var msg message
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			conn.SendJSON(msg)
+		}
+	})
+
+	for _, text := range []string{"hello", "world"} {
+		if err := ws.WriteJSON(message{Text: text}); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+		var got message
+		if err := ws.ReadJSON(&got); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if got.Text != text {
+			t.Errorf("Expected %q, got %q", text, got.Text)
+		}
+	}
+}
+
+// TestWebSocketConnContext tests that the context is cancelled when the client disconnects
+// and that ReadMessage reports the close error.
+func TestWebSocketConnContext(t *testing.T) {
+	done := make(chan error, 1)
+	ws := dialWebSocket(t, nil, func(conn *WebSocketConn, r *http.Request) {
+		<-conn.Context().Done()
+		if r.Context().Err() == nil {
+			t.Error("Expected request context to be cancelled with the connection")
+		}
+		_, _, err := conn.ReadMessage()
+		done <- err
+	})
+
+	ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	select {
+	case err := <-done:
+		if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("Expected going away close error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handler was not notified of the disconnect")
+	}
+}
+
+// TestWebSocketConnClose tests closing from another goroutine with a custom code.
+func TestWebSocketConnClose(t *testing.T) {
+	sendErr := make(chan error, 1)
+	ws := dialWebSocket(t, nil, func(conn *WebSocketConn, r *http.Request) {
+		go conn.Close(4000, "bye")
+		<-conn.Context().Done()
+		sendErr <- conn.Send(websocket.TextMessage, []byte("late"))
+	})
+
+	_, _, err := ws.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != 4000 || closeErr.Text != "bye" {
+		t.Errorf("Expected close 4000 bye, got %v", err)
+	}
+	if err := <-sendErr; !errors.Is(err, ErrConnClosed) {
+		t.Errorf("Expected ErrConnClosed, got %v", err)
+	}
+}
+
+// TestWebSocketConnCloseLongReason tests that reasons too long for a close frame are cut
+// rather than failing the closing handshake.
+func TestWebSocketConnCloseLongReason(t *testing.T) {
+	reason := strings.Repeat("é", MaxCloseReasonSize)
+	ws := dialWebSocket(t, nil, func(conn *WebSocketConn, r *http.Request) {
+		conn.Close(4000, reason)
+	})
+
+	_, _, err := ws.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != 4000 {
+		t.Fatalf("Expected close 4000, got %v", err)
+	}
+	// Two-byte runes are not split
+	if expected := reason[:MaxCloseReasonSize-1]; closeErr.Text != expected {
+		t.Errorf("Expected reason %q, got %q", expected, closeErr.Text)
+	}
+}
+
+// TestWebSocketConnSlowHandler tests that a handler not reading its messages gets the connection
+// closed with a policy violation instead of stalling the reader.
+func TestWebSocketConnSlowHandler(t *testing.T) {
+	ws := dialWebSocket(t, &WebSocketConfig{PongWait: 200 * time.Millisecond}, func(conn *WebSocketConn, r *http.Request) {
+		<-conn.Context().Done()
+	})
+	for i := 0; i <= incomingQueueSize; i++ {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte("ignored")); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := ws.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation {
+		t.Errorf("Expected close 1008, got %v", err)
+	}
+}
+
+// TestWebSocketConnSendQueueFull tests that Send never blocks on a full queue.
+func TestWebSocketConnSendQueueFull(t *testing.T) {
+	cfg := (&WebSocketConfig{SendQueueSize: 2}).withDefaults()
+	conn := newWebSocketConn(nil, cfg, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	tests := []struct {
+		name     string
+		expected error
+	}{
+		{name: "First message", expected: nil},
+		{name: "Second message", expected: nil},
+		{name: "Queue full", expected: ErrSendQueueFull},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := conn.Send(websocket.TextMessage, []byte(tc.name)); !errors.Is(err, tc.expected) {
+				t.Errorf("Expected %v, got %v", tc.expected, err)
+			}
+		})
+	}
+}
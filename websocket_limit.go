@@ -0,0 +1,184 @@
+package possum
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"github.com/mikespook/possum/auth"
+)
+
+// WebSocketLimitConfig caps the WebSocket connections of the endpoints sharing a ConnLimiter.
+// Zero values leave a dimension unlimited.
+type WebSocketLimitConfig struct {
+	MaxConnections int `mapstructure:"max_connections,omitempty"` // concurrent connections in total
+	MaxPerUser     int `mapstructure:"max_per_user,omitempty"`    // concurrent connections of a user ID
+	MaxPerIP       int `mapstructure:"max_per_ip,omitempty"`      // concurrent connections of a remote IP
+	// RetryAfter is sent with the 429 responses of rejected upgrades, default 5s.
+	RetryAfter time.Duration `mapstructure:"retry_after,omitempty"`
+	// MessageRate limits the messages received on each connection; connections exceeding it are
+	// closed with websocket.ClosePolicyViolation. Nil leaves it unlimited.
+	MessageRate *RateLimitConfig `mapstructure:"message_rate,omitempty"`
+}
+
+var defaultWebSocketLimitConfig = &WebSocketLimitConfig{
+	RetryAfter: 5 * time.Second,
+}
+
+// ConnLimiter counts the open connections of the endpoints it is configured on; see
+// WebSocketConfig.Limiter. Users are identified by the claims on the upgrade request, e.g. from
+// HTTPAuth, or by those WebSocketAuth puts on the connection, which closes connections over the
+// per-user cap with websocket.ClosePolicyViolation.
+type ConnLimiter struct {
+	config *WebSocketLimitConfig
+
+	mu    sync.Mutex
+	total int
+	users map[uuid.UUID]int
+	ips   map[string]int
+}
+
+// NewConnLimiter creates a limiter; zero values of config fall back to the defaults.
+func NewConnLimiter(config *WebSocketLimitConfig) *ConnLimiter {
+	cfg := *defaultWebSocketLimitConfig
+	if config != nil {
+		cfg = *config
+		if cfg.RetryAfter == 0 {
+			cfg.RetryAfter = defaultWebSocketLimitConfig.RetryAfter
+		}
+	}
+	return &ConnLimiter{config: &cfg, users: make(map[uuid.UUID]int), ips: make(map[string]int)}
+}
+
+// Connections returns the number of open connections.
+func (l *ConnLimiter) Connections() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.total
+}
+
+// connSlot is the slot of a connection in a ConnLimiter.
+type connSlot struct {
+	limiter *ConnLimiter
+	ip      string
+	userID  uuid.UUID // guarded by limiter.mu
+	once    sync.Once
+}
+
+// acquire takes a connection slot for r, counted for the user of its claims if any. It returns
+// false if a cap is reached.
+func (l *ConnLimiter) acquire(r *http.Request) (*connSlot, bool) {
+	userID := uuid.Nil
+	if claims, ok := r.Context().Value(ClaimsKey).(*auth.JWTClaims); ok {
+		userID = claims.UserID
+	}
+	ip := remoteIP(r)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cfg := l.config
+	if cfg.MaxConnections > 0 && l.total >= cfg.MaxConnections ||
+		cfg.MaxPerIP > 0 && l.ips[ip] >= cfg.MaxPerIP ||
+		!l.allowsUser(userID) {
+		return nil, false
+	}
+	l.total++
+	l.ips[ip]++
+	slot := &connSlot{limiter: l, ip: ip}
+	slot.setUser(userID)
+	return slot, true
+}
+
+// remoteIP returns the IP of the client of r, without the port.
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// allowsUser reports whether userID is under the per-user cap; l.mu must be held.
+func (l *ConnLimiter) allowsUser(userID uuid.UUID) bool {
+	return l.config.MaxPerUser <= 0 || userID == uuid.Nil || l.users[userID] < l.config.MaxPerUser
+}
+
+// setUser counts the slot for userID; l.mu must be held.
+func (s *connSlot) setUser(userID uuid.UUID) {
+	if userID != uuid.Nil {
+		s.userID = userID
+		s.limiter.users[userID]++
+	}
+}
+
+// claim counts the slot for the user authenticated after the upgrade, unless it already counts
+// for a user. It returns false if the user is at the per-user cap; a nil slot allows any user.
+func (s *connSlot) claim(userID uuid.UUID) bool {
+	if s == nil {
+		return true
+	}
+	l := s.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s.userID != uuid.Nil {
+		return true
+	}
+	if !l.allowsUser(userID) {
+		return false
+	}
+	s.setUser(userID)
+	return true
+}
+
+// release frees the slot. It is idempotent and a no-op on a nil slot.
+func (s *connSlot) release() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		l := s.limiter
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.total--
+		if l.ips[s.ip]--; l.ips[s.ip] == 0 {
+			delete(l.ips, s.ip)
+		}
+		if s.userID != uuid.Nil {
+			if l.users[s.userID]--; l.users[s.userID] == 0 {
+				delete(l.users, s.userID)
+			}
+		}
+	})
+}
+
+// reject writes the 429 response of an upgrade over a cap.
+func (l *ConnLimiter) reject(w http.ResponseWriter) {
+	writeTooManyRequests(w, l.config.RetryAfter)
+}
+
+// newMessageBucket returns the message rate bucket of a new connection, or nil.
+func (l *ConnLimiter) newMessageBucket() *tokenBucket {
+	if l == nil || l.config.MessageRate == nil || l.config.MessageRate.Rate <= 0 {
+		return nil
+	}
+	return newTokenBucket(*l.config.MessageRate, time.Now())
+}
+
+// allowMessage takes a token of the message rate and closes the connection with a policy
+// violation when there is none.
+func (c *WebSocketConn) allowMessage() bool {
+	if c.rate == nil {
+		return true
+	}
+	c.rateMu.Lock()
+	ok, _ := c.rate.take(time.Now())
+	c.rateMu.Unlock()
+	if !ok {
+		c.Close(websocket.ClosePolicyViolation, "Message rate exceeded")
+	}
+	return ok
+}
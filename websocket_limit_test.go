@@ -0,0 +1,213 @@
+package possum
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"github.com/mikespook/possum/auth"
+)
+
+// TestConnLimiter tests the caps of each dimension and that released slots are reused.
+func TestConnLimiter(t *testing.T) {
+	alice, bob := uuid.New(), uuid.New()
+	request := func(ip string, userID uuid.UUID) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		r.RemoteAddr = ip + ":1234"
+		if userID != uuid.Nil {
+			r = r.WithContext(context.WithValue(r.Context(), ClaimsKey, &auth.JWTClaims{UserID: userID}))
+		}
+		return r
+	}
+
+	tests := []struct {
+		name     string
+		config   WebSocketLimitConfig
+		requests []*http.Request
+		expected []bool
+	}{
+		{
+			name:     "Total",
+			config:   WebSocketLimitConfig{MaxConnections: 2},
+			requests: []*http.Request{request("10.0.0.1", alice), request("10.0.0.2", bob), request("10.0.0.3", uuid.Nil)},
+			expected: []bool{true, true, false},
+		},
+		{
+			name:     "Per IP",
+			config:   WebSocketLimitConfig{MaxPerIP: 1},
+			requests: []*http.Request{request("10.0.0.1", alice), request("10.0.0.1", bob), request("10.0.0.2", alice)},
+			expected: []bool{true, false, true},
+		},
+		{
+			name:     "Per user",
+			config:   WebSocketLimitConfig{MaxPerUser: 1},
+			requests: []*http.Request{request("10.0.0.1", alice), request("10.0.0.2", alice), request("10.0.0.2", bob)},
+			expected: []bool{true, false, true},
+		},
+		{
+			name:     "Anonymous users are not capped per user",
+			config:   WebSocketLimitConfig{MaxPerUser: 1},
+			requests: []*http.Request{request("10.0.0.1", uuid.Nil), request("10.0.0.2", uuid.Nil)},
+			expected: []bool{true, true},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			l := NewConnLimiter(&tc.config)
+			var slots []*connSlot
+			for i, r := range tc.requests {
+				slot, ok := l.acquire(r)
+				if ok != tc.expected[i] {
+					t.Fatalf("Expected request %d allowed=%t", i, tc.expected[i])
+				}
+				if ok {
+					slots = append(slots, slot)
+				}
+			}
+			for _, slot := range slots {
+				slot.release()
+				slot.release() // idempotent
+			}
+			if l.Connections() != 0 || len(l.users) != 0 || len(l.ips) != 0 {
+				t.Errorf("Expected every slot released, got %d %v %v", l.Connections(), l.users, l.ips)
+			}
+			for i, r := range tc.requests {
+				if _, ok := l.acquire(r); ok != tc.expected[i] {
+					t.Errorf("Expected request %d allowed=%t after release", i, tc.expected[i])
+				}
+			}
+		})
+	}
+}
+
+// TestWebSocketConnLimit tests that upgrades over a cap get a 429 response with Retry-After.
+func TestWebSocketConnLimit(t *testing.T) {
+	secret := []byte("test-secret")
+	_, token, _ := auth.GenerateJWT(secret, uuid.New(), nil)
+	limiter := NewConnLimiter(&WebSocketLimitConfig{MaxPerUser: 1, RetryAfter: 3 * time.Second})
+	server := httptest.NewServer(HTTPAuth(secret, WebSocketUpgradeWithConfig(&WebSocketConfig{
+		CORS:    &CORSConfig{AllowOrigin: "*"},
+		Limiter: limiter,
+	}, func(conn *WebSocketConn, r *http.Request) {
+		conn.ReadMessage()
+	})))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	header := http.Header{"Authorization": {"Bearer " + token}}
+
+	first, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	_, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %v (%v)", resp, err)
+	}
+	if resp.Header.Get("Retry-After") != "3" {
+		t.Errorf("Expected Retry-After 3, got %q", resp.Header.Get("Retry-After"))
+	}
+	var body Response
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error == nil || body.Error.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected a 429 Response, got %+v (%v)", body, err)
+	}
+
+	first.Close()
+	deadline := time.Now().Add(time.Second)
+	for limiter.Connections() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	second, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("Expected the slot to be released, got %v", err)
+	}
+	second.Close()
+}
+
+// TestWebSocketConnLimitAuth tests that the per-user cap applies to users authenticated by
+// WebSocketAuth after the upgrade, whose connections over the cap are closed.
+func TestWebSocketConnLimitAuth(t *testing.T) {
+	secret := []byte("test-secret")
+	_, alice, _ := auth.GenerateJWT(secret, uuid.New(), nil)
+	_, bob, _ := auth.GenerateJWT(secret, uuid.New(), nil)
+	limiter := NewConnLimiter(&WebSocketLimitConfig{MaxPerUser: 1})
+	server := httptest.NewServer(WebSocketUpgradeWithConfig(&WebSocketConfig{
+		CORS:    &CORSConfig{AllowOrigin: "*"},
+		Limiter: limiter,
+	}, WebSocketAuth(secret, func(conn *WebSocketConn, r *http.Request) {
+		conn.Send(websocket.TextMessage, []byte("welcome"))
+		conn.ReadMessage()
+	})))
+	defer server.Close()
+	dial := func(token string) (*websocket.Conn, error) {
+		ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?token="+token, nil)
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		t.Cleanup(func() { ws.Close() })
+		_, _, err = ws.ReadMessage()
+		return ws, err
+	}
+
+	first, err := dial(alice)
+	if err != nil {
+		t.Fatalf("Expected the first connection to be accepted, got %v", err)
+	}
+	_, err = dial(alice)
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation || closeErr.Text != "Too many connections" {
+		t.Errorf("Expected close 1008 over the per-user cap, got %v", err)
+	}
+	if _, err := dial(bob); err != nil {
+		t.Errorf("Expected another user to be accepted, got %v", err)
+	}
+
+	first.Close()
+	deadline := time.Now().Add(time.Second)
+	for limiter.Connections() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := dial(alice); err != nil {
+		t.Errorf("Expected the user's slot to be released, got %v", err)
+	}
+}
+
+// TestWebSocketMessageRate tests that connections exceeding the message rate are closed with a
+// policy violation.
+func TestWebSocketMessageRate(t *testing.T) {
+	received := make(chan string, 4)
+	ws := dialWebSocket(t, &WebSocketConfig{
+		Limiter: NewConnLimiter(&WebSocketLimitConfig{MessageRate: &RateLimitConfig{Rate: 0.01, Burst: 2}}),
+	}, func(conn *WebSocketConn, r *http.Request) {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			received <- string(data)
+		}
+	})
+	for _, msg := range []string{"1", "2", "3", "4"} {
+		ws.WriteMessage(websocket.TextMessage, []byte(msg))
+	}
+	_, _, err := ws.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation {
+		t.Fatalf("Expected a policy violation, got %v", err)
+	}
+	if got := []string{<-received, <-received}; got[0] != "1" || got[1] != "2" {
+		t.Errorf("Expected the burst to be delivered, got %v", got)
+	}
+	select {
+	case msg := <-received:
+		t.Errorf("Expected messages over the rate to be discarded, got %s", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
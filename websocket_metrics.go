@@ -0,0 +1,105 @@
+package possum
+
+import (
+	"expvar"
+	"net/http"
+	"sync/atomic"
+)
+
+// WebSocketMetrics aggregates the counters and gauges of the connections of one or more
+// endpoints sharing it through WebSocketConfig.Metrics. Message and byte counters only grow,
+// so rates are derived by the scraper. All methods are safe for concurrent use and nil-safe.
+type WebSocketMetrics struct {
+	active      atomic.Int64
+	connections atomic.Int64
+	messagesIn  atomic.Int64
+	messagesOut atomic.Int64
+	bytesIn     atomic.Int64
+	bytesOut    atomic.Int64
+	dropped     atomic.Int64
+}
+
+// WebSocketStats is a snapshot of WebSocketMetrics.
+type WebSocketStats struct {
+	Active      int64 `json:"active"`      // gauge of open connections
+	Connections int64 `json:"connections"` // connections accepted since start
+	MessagesIn  int64 `json:"messages_in"`
+	MessagesOut int64 `json:"messages_out"`
+	BytesIn     int64 `json:"bytes_in"`
+	BytesOut    int64 `json:"bytes_out"`
+	Dropped     int64 `json:"dropped"` // messages discarded by send policies
+}
+
+// NewWebSocketMetrics creates zeroed metrics.
+func NewWebSocketMetrics() *WebSocketMetrics {
+	return &WebSocketMetrics{}
+}
+
+// Snapshot returns the current values.
+func (m *WebSocketMetrics) Snapshot() WebSocketStats {
+	if m == nil {
+		return WebSocketStats{}
+	}
+	return WebSocketStats{
+		Active:      m.active.Load(),
+		Connections: m.connections.Load(),
+		MessagesIn:  m.messagesIn.Load(),
+		MessagesOut: m.messagesOut.Load(),
+		BytesIn:     m.bytesIn.Load(),
+		BytesOut:    m.bytesOut.Load(),
+		Dropped:     m.dropped.Load(),
+	}
+}
+
+// Publish exposes the metrics as an expvar variable, served by expvar.Handler on /debug/vars.
+// Like expvar.Publish it panics if the name is already in use.
+func (m *WebSocketMetrics) Publish(name string) {
+	expvar.Publish(name, expvar.Func(func() any {
+		return m.Snapshot()
+	}))
+}
+
+// ServeHTTP writes a snapshot as the data of a Response, for mounting on a metrics endpoint.
+func (m *WebSocketMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	resp := NewResponse(r)
+	resp.SetData(m.Snapshot())
+	resp.Write(w)
+}
+
+func (m *WebSocketMetrics) connected() {
+	if m == nil {
+		return
+	}
+	m.connections.Add(1)
+	m.active.Add(1)
+}
+
+func (m *WebSocketMetrics) disconnected() {
+	if m == nil {
+		return
+	}
+	m.active.Add(-1)
+}
+
+func (m *WebSocketMetrics) received(n int) {
+	if m == nil {
+		return
+	}
+	m.messagesIn.Add(1)
+	m.bytesIn.Add(int64(n))
+}
+
+func (m *WebSocketMetrics) sent(n int) {
+	if m == nil {
+		return
+	}
+	m.messagesOut.Add(1)
+	m.bytesOut.Add(int64(n))
+}
+
+func (m *WebSocketMetrics) droppedMessages(n int) {
+	if m == nil {
+		return
+	}
+	m.dropped.Add(int64(n))
+}
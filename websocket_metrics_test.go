@@ -0,0 +1,85 @@
+package possum
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// TestWebSocketMetrics tests the counters and gauge collected from live connections.
+func TestWebSocketMetrics(t *testing.T) {
+	metrics := NewWebSocketMetrics()
+	release := make(chan struct{})
+	ws := dialWebSocket(t, &WebSocketConfig{Metrics: metrics}, func(conn *WebSocketConn, r *http.Request) {
+		conn.ReadMessage()
+		conn.Send(websocket.TextMessage, []byte("pong"))
+		<-release
+	})
+
+	ws.WriteMessage(websocket.TextMessage, []byte("ping!"))
+	if _, _, err := ws.ReadMessage(); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	open := metrics.Snapshot()
+	close(release)
+	ws.ReadMessage() // wait for the close frame
+	ws.Close()
+
+	tests := []struct {
+		name     string
+		actual   int64
+		expected int64
+	}{
+		{name: "Active while open", actual: open.Active, expected: 1},
+		{name: "Connections", actual: open.Connections, expected: 1},
+		{name: "Messages in", actual: open.MessagesIn, expected: 1},
+		{name: "Messages out", actual: open.MessagesOut, expected: 1},
+		{name: "Bytes in", actual: open.BytesIn, expected: 5},
+		{name: "Bytes out", actual: open.BytesOut, expected: 4},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.actual != tc.expected {
+				t.Errorf("Expected %d, got %d", tc.expected, tc.actual)
+			}
+		})
+	}
+}
+
+// TestWebSocketMetricsExport tests exposing the metrics through expvar and HTTP.
+func TestWebSocketMetricsExport(t *testing.T) {
+	metrics := NewWebSocketMetrics()
+	metrics.connected()
+	metrics.sent(3)
+	name := "possum_websocket_" + uuid.NewString() // expvar names cannot be reused
+	metrics.Publish(name)
+
+	var stats WebSocketStats
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &stats); err != nil {
+		t.Fatalf("Failed to decode expvar: %v", err)
+	}
+	if stats.Active != 1 || stats.BytesOut != 3 {
+		t.Errorf("Unexpected expvar stats %+v", stats)
+	}
+
+	w := httptest.NewRecorder()
+	metrics.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	var resp struct {
+		Data WebSocketStats `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Data != stats {
+		t.Errorf("Expected %+v, got %s (%v)", stats, w.Body.String(), err)
+	}
+
+	// Connections without metrics are not counted
+	var none *WebSocketMetrics
+	none.connected()
+	if none.Snapshot() != (WebSocketStats{}) {
+		t.Error("Expected empty stats for nil metrics")
+	}
+}
@@ -0,0 +1,99 @@
+package possum
+
+import (
+	"sync"
+)
+
+// SendPolicy decides what happens to a message sent to a connection whose send queue is full.
+type SendPolicy string
+
+const (
+	// SendDropNewest rejects the new message with ErrSendQueueFull.
+	SendDropNewest SendPolicy = "drop_newest"
+	// SendDropOldest discards the oldest queued message to make room for the new one.
+	SendDropOldest SendPolicy = "drop_oldest"
+	// SendCoalesce replaces a queued message with the same key, see WebSocketConn.SendKeyed,
+	// so only the latest state is sent; messages without a match are rejected when full.
+	SendCoalesce SendPolicy = "coalesce"
+	// SendDisconnect closes the connection with websocket.CloseTryAgainLater (1013) right away,
+	// discarding the queued messages.
+	SendDisconnect SendPolicy = "disconnect"
+)
+
+// sendQueue is the bounded FIFO between senders and the writer goroutine.
+type sendQueue struct {
+	mu       sync.Mutex
+	items    []wsMessage
+	capacity int
+	policy   SendPolicy
+	// notify wakes the writer; it holds at most one pending signal
+	notify chan struct{}
+}
+
+func newSendQueue(capacity int, policy SendPolicy) *sendQueue {
+	return &sendQueue{
+		items:    make([]wsMessage, 0, capacity),
+		capacity: capacity,
+		policy:   policy,
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// push queues msg according to the policy. It reports whether a message, the new or a queued
+// one, was dropped, and returns ErrSendQueueFull if msg was not queued.
+func (q *sendQueue) push(msg wsMessage) (dropped bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.policy == SendCoalesce && msg.key != "" {
+		for i := range q.items {
+			if q.items[i].key == msg.key {
+				q.items[i] = msg
+				return true, nil
+			}
+		}
+	}
+	if len(q.items) >= q.capacity {
+		if q.policy != SendDropOldest || q.capacity == 0 {
+			return true, ErrSendQueueFull
+		}
+		q.items[0] = wsMessage{}
+		q.items = q.items[1:]
+		dropped = true
+	}
+	q.items = append(q.items, msg)
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return dropped, nil
+}
+
+// pop removes the oldest message.
+func (q *sendQueue) pop() (wsMessage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return wsMessage{}, false
+	}
+	msg := q.items[0]
+	q.items[0] = wsMessage{} // release the data
+	q.items = q.items[1:]
+	return msg, true
+}
+
+// clear discards the queued messages and returns how many there were.
+func (q *sendQueue) clear() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := len(q.items)
+	clear(q.items)
+	q.items = q.items[:0]
+	return n
+}
+
+// len returns the number of queued messages.
+func (q *sendQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
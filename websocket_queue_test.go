@@ -0,0 +1,132 @@
+package possum
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestSendPolicy tests the send policies on a full queue of an unstarted connection.
+func TestSendPolicy(t *testing.T) {
+	type send struct {
+		key      string
+		data     string
+		expected error
+	}
+	tests := []struct {
+		name            string
+		policy          SendPolicy
+		sends           []send
+		expectedQueue   []string
+		expectedDropped int64
+		expectedClose   int
+	}{
+		{
+			name:   "Drop newest",
+			policy: SendDropNewest,
+			sends: []send{
+				{data: "a"}, {data: "b"}, {data: "c", expected: ErrSendQueueFull},
+			},
+			expectedQueue:   []string{"a", "b"},
+			expectedDropped: 1,
+		},
+		{
+			name:   "Default policy",
+			policy: "",
+			sends: []send{
+				{data: "a"}, {data: "b"}, {data: "c", expected: ErrSendQueueFull},
+			},
+			expectedQueue:   []string{"a", "b"},
+			expectedDropped: 1,
+		},
+		{
+			name:   "Drop oldest",
+			policy: SendDropOldest,
+			sends: []send{
+				{data: "a"}, {data: "b"}, {data: "c"}, {data: "d"},
+			},
+			expectedQueue:   []string{"c", "d"},
+			expectedDropped: 2,
+		},
+		{
+			name:   "Coalesce",
+			policy: SendCoalesce,
+			sends: []send{
+				{key: "x", data: "x1"}, {data: "a"}, {key: "x", data: "x2"}, {key: "y", data: "y1", expected: ErrSendQueueFull},
+			},
+			expectedQueue:   []string{"x2", "a"},
+			expectedDropped: 2,
+		},
+		{
+			name:   "Keys ignored without coalescing",
+			policy: SendDropNewest,
+			sends: []send{
+				{key: "x", data: "x1"}, {key: "x", data: "x2"},
+			},
+			expectedQueue: []string{"x1", "x2"},
+		},
+		{
+			name:   "Disconnect",
+			policy: SendDisconnect,
+			sends: []send{
+				{data: "a"}, {data: "b"}, {data: "c", expected: ErrSendQueueFull}, {data: "d", expected: ErrConnClosed},
+			},
+			expectedDropped: 3,
+			expectedClose:   websocket.CloseTryAgainLater,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics := NewWebSocketMetrics()
+			cfg := (&WebSocketConfig{SendQueueSize: 2, Metrics: metrics}).withDefaults()
+			cfg.SendPolicy = tc.policy
+			conn := newWebSocketConn(nil, cfg, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			for _, s := range tc.sends {
+				if err := conn.SendKeyed(s.key, websocket.TextMessage, []byte(s.data)); !errors.Is(err, s.expected) {
+					t.Errorf("Send %s: expected %v, got %v", s.data, s.expected, err)
+				}
+			}
+			var queue []string
+			for msg, ok := conn.queue.pop(); ok; msg, ok = conn.queue.pop() {
+				queue = append(queue, string(msg.data))
+			}
+			if !reflect.DeepEqual(queue, tc.expectedQueue) {
+				t.Errorf("Expected queue %v, got %v", tc.expectedQueue, queue)
+			}
+			stats := conn.Stats()
+			if stats.MessagesDropped != tc.expectedDropped {
+				t.Errorf("Expected %d dropped, got %d", tc.expectedDropped, stats.MessagesDropped)
+			}
+			if dropped := metrics.Snapshot().Dropped; dropped != tc.expectedDropped {
+				t.Errorf("Expected %d dropped in metrics, got %d", tc.expectedDropped, dropped)
+			}
+			if stats.CloseCode != tc.expectedClose {
+				t.Errorf("Expected close code %d, got %d", tc.expectedClose, stats.CloseCode)
+			}
+		})
+	}
+}
+
+// TestSendPolicyDisconnect tests that a client too slow for its queue is closed with 1013.
+func TestSendPolicyDisconnect(t *testing.T) {
+	ws := dialWebSocket(t, &WebSocketConfig{SendQueueSize: 1, SendPolicy: SendDisconnect}, func(conn *WebSocketConn, r *http.Request) {
+		// The writer drains one message at most while the handler keeps sending
+		for conn.Send(websocket.TextMessage, []byte("tick")) == nil {
+		}
+		<-conn.Context().Done()
+	})
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseTryAgainLater {
+				t.Errorf("Expected close 1013, got %v", err)
+			}
+			return
+		}
+	}
+}
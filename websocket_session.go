@@ -0,0 +1,302 @@
+package possum
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"github.com/mikespook/possum/auth"
+)
+
+const (
+	// SessionIDParam and LastSeqParam are the query parameters of a reconnecting client.
+	SessionIDParam = "session_id"
+	LastSeqParam   = "last_seq"
+
+	// SessionMessageType is the envelope type of the frame announcing the session.
+	SessionMessageType = "session"
+)
+
+// SessionConfig configures resumable WebSocket sessions.
+type SessionConfig struct {
+	ReplaySize int           `mapstructure:"replay_size,omitempty"` // messages kept for replay, default 256
+	TTL        time.Duration `mapstructure:"ttl,omitempty"`         // lifetime of a disconnected session, default 2m
+}
+
+var defaultSessionConfig = &SessionConfig{
+	ReplaySize: 256,
+	TTL:        2 * time.Minute,
+}
+
+// SessionHello is the payload of the session frame sent before any other message. Data messages
+// that follow are numbered Seq+1, Seq+2 and so on; the client keeps the number of the last one
+// it received to resume. Resumed is false when a new session was started instead.
+type SessionHello struct {
+	SessionID string `json:"session_id"`
+	Seq       uint64 `json:"seq"`
+	Resumed   bool   `json:"resumed"`
+}
+
+// SessionStore keeps the sessions of an endpoint, see SessionStore.Handler. A session
+// outlives its connection for the configured TTL so that a client reconnecting with its session
+// ID and last-seen sequence gets the messages it missed replayed before live traffic resumes.
+type SessionStore struct {
+	config *SessionConfig
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// Session is the sequenced message stream of a client across reconnections.
+type Session struct {
+	id     string
+	userID uuid.UUID
+	store  *SessionStore
+
+	mu     sync.Mutex
+	seq    uint64
+	replay []sequencedMessage
+	conn   *WebSocketConn
+	expiry *time.Timer
+}
+
+type sequencedMessage struct {
+	seq uint64
+	msg wsMessage
+}
+
+// NewSessionStore creates a store; zero values of config fall back to the defaults.
+func NewSessionStore(config *SessionConfig) *SessionStore {
+	cfg := *defaultSessionConfig
+	if config != nil {
+		if config.ReplaySize != 0 {
+			cfg.ReplaySize = config.ReplaySize
+		}
+		if config.TTL != 0 {
+			cfg.TTL = config.TTL
+		}
+	}
+	return &SessionStore{config: &cfg, sessions: make(map[string]*Session)}
+}
+
+// Get returns a live session.
+func (store *SessionStore) Get(id string) (*Session, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	s, ok := store.sessions[id]
+	return s, ok
+}
+
+// Len returns the number of live sessions, connected or not.
+func (store *SessionStore) Len() int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return len(store.sessions)
+}
+
+// Handler is a WebsocketMiddleware making the connections of an endpoint resumable before
+// calling next. It must run after WebSocketAuth: a session belongs to the user of the claims on
+// the connection and is only resumed by the same user, so connections without claims get a new
+// session that cannot be resumed: it is neither stored nor buffers messages for replay. Polling
+// connections cannot be resumed and are passed through.
+func (store *SessionStore) Handler(next WebsocketHandlerFunc) WebsocketHandlerFunc {
+	return func(conn *WebSocketConn, r *http.Request) {
+		if conn.poll == nil && !conn.openSession(store, r) {
+			return
+		}
+		next(conn, r)
+	}
+}
+
+// resume returns the session requested by r if it can be resumed by the user of conn, or a new
+// one, with the sequence number the client has seen. New resumable sessions are stored once
+// attached.
+func (store *SessionStore) resume(conn *WebSocketConn, r *http.Request) (s *Session, last uint64, resumed bool) {
+	var userID uuid.UUID
+	if claims, ok := conn.Context().Value(ClaimsKey).(*auth.JWTClaims); ok {
+		userID = claims.UserID
+	}
+	query := r.URL.Query()
+	if s, ok := store.Get(query.Get(SessionIDParam)); ok && userID != uuid.Nil && s.userID == userID {
+		last, err := strconv.ParseUint(query.Get(LastSeqParam), 10, 64)
+		if err == nil && s.canReplay(last) {
+			return s, last, true
+		}
+	}
+	return &Session{id: uuid.New().String(), userID: userID, store: store}, 0, false
+}
+
+// ID returns the session ID.
+func (s *Session) ID() string {
+	return s.id
+}
+
+// Seq returns the sequence number of the last message sent.
+func (s *Session) Seq() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seq
+}
+
+// Send sends a message on the current connection of the session. While the client is away the
+// message is kept for replay instead, so nothing sent during a reconnection gap is lost as long
+// as it fits in the replay buffer. Sessions that cannot be resumed drop it.
+func (s *Session) Send(messageType int, data []byte) error {
+	for {
+		s.mu.Lock()
+		conn := s.conn
+		if conn == nil {
+			s.record(wsMessage{messageType: messageType, data: data})
+			s.mu.Unlock()
+			return nil
+		}
+		s.mu.Unlock()
+		if err := conn.Send(messageType, data); err != ErrConnClosed {
+			return err
+		}
+		// Wait until the connection has handed its unsent messages to the session
+		<-conn.writeDone
+	}
+}
+
+// SendJSON encodes v as JSON and sends it as a text message.
+func (s *Session) SendJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.Send(websocket.TextMessage, data)
+}
+
+// resumable reports whether the session has an owner who can resume it.
+func (s *Session) resumable() bool {
+	return s.userID != uuid.Nil
+}
+
+// canReplay reports whether every message after last is still buffered.
+func (s *Session) canReplay(last uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if last > s.seq {
+		return false
+	}
+	return last == s.seq || (len(s.replay) > 0 && s.replay[0].seq <= last+1)
+}
+
+// record numbers a message and buffers it for replay if the session is resumable; s.mu must
+// be held.
+func (s *Session) record(msg wsMessage) {
+	s.seq++
+	if !s.resumable() {
+		return
+	}
+	if len(s.replay) >= s.store.config.ReplaySize {
+		s.replay[0] = sequencedMessage{}
+		s.replay = s.replay[1:]
+	}
+	s.replay = append(s.replay, sequencedMessage{seq: s.seq, msg: msg})
+}
+
+// sequence numbers a message about to be written by the connection.
+func (s *Session) sequence(msg wsMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.record(msg)
+}
+
+// attach makes conn the connection of the session, replacing a previous one that has not
+// noticed the disconnection yet, and returns the messages to replay.
+func (s *Session) attach(conn *WebSocketConn, last uint64) []wsMessage {
+	s.mu.Lock()
+	old := s.conn
+	s.mu.Unlock()
+	if old != nil {
+		old.Close(websocket.CloseGoingAway, "Session resumed")
+		<-old.writeDone
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	s.conn = conn
+	// New sessions are stored here; others may have expired since they were looked up
+	if s.resumable() {
+		s.store.mu.Lock()
+		s.store.sessions[s.id] = s
+		s.store.mu.Unlock()
+	}
+
+	var replay []wsMessage
+	for _, m := range s.replay {
+		if m.seq > last {
+			replay = append(replay, m.msg)
+		}
+	}
+	return replay
+}
+
+// detach is called by the writer goroutine of conn when it exits. The messages conn has not
+// written are kept for replay, and the session expires unless it is resumed within the TTL;
+// sessions that cannot be resumed are gone.
+func (s *Session) detach(conn *WebSocketConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != conn {
+		return
+	}
+	for msg, ok := conn.queue.pop(); ok; msg, ok = conn.queue.pop() {
+		s.record(msg)
+	}
+	s.conn = nil
+	if s.resumable() {
+		s.expiry = time.AfterFunc(s.store.config.TTL, s.expire)
+	}
+}
+
+// expire removes the session unless it was resumed.
+func (s *Session) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		return
+	}
+	s.store.mu.Lock()
+	delete(s.store.sessions, s.id)
+	s.store.mu.Unlock()
+}
+
+// openSession announces the session to the client with the negotiated codec and replays the
+// messages it missed. It runs on the writer goroutine so that nothing is written in between,
+// and returns false if the connection is gone. A failed write is noticed by the reader goroutine.
+func (c *WebSocketConn) openSession(store *SessionStore, r *http.Request) bool {
+	s, last, resumed := store.resume(c, r)
+	codec := c.Codec()
+	payload, _ := codec.Marshal(&SessionHello{SessionID: s.id, Seq: last, Resumed: resumed})
+	hello, _ := codec.EncodeEnvelope(&Envelope{Type: SessionMessageType, Payload: payload})
+	return c.inWriter(func() {
+		replay := s.attach(c, last)
+		if err := c.write(wsMessage{messageType: codec.MessageType(), data: hello}); err == nil {
+			for _, msg := range replay {
+				if err := c.write(msg); err != nil {
+					break
+				}
+			}
+		}
+		// Number the messages written from now on
+		c.session = s
+	})
+}
+
+// Session returns the resumable session of the connection, or nil if it did not pass through
+// SessionStore.Handler. Messages sent through it survive reconnections.
+func (c *WebSocketConn) Session() *Session {
+	return c.session
+}
@@ -0,0 +1,277 @@
+package possum
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"github.com/mikespook/possum/auth"
+)
+
+// newSessionServer starts an endpoint with sessions whose handler only waits for the disconnect.
+// The X-User header sets the user of the claims, as an HTTP authentication middleware would.
+func newSessionServer(t *testing.T, store *SessionStore) string {
+	t.Helper()
+	upgrade := WebSocketUpgradeWithConfig(&WebSocketConfig{
+		CORS: &CORSConfig{AllowOrigin: "*"},
+	}, store.Handler(func(conn *WebSocketConn, r *http.Request) {
+		<-conn.Context().Done()
+	}))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user := r.Header.Get("X-User"); user != "" {
+			claims := &auth.JWTClaims{UserID: uuid.MustParse(user)}
+			r = r.WithContext(context.WithValue(r.Context(), ClaimsKey, claims))
+		}
+		upgrade(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+// dialSession connects with optional resume parameters and reads the session frame.
+func dialSession(t *testing.T, url, user, sessionID string, lastSeq uint64) (*websocket.Conn, SessionHello) {
+	t.Helper()
+	if sessionID != "" {
+		url = fmt.Sprintf("%s?%s=%s&%s=%d", url, SessionIDParam, sessionID, LastSeqParam, lastSeq)
+	}
+	header := http.Header{}
+	if user != "" {
+		header.Set("X-User", user)
+	}
+	ws, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	var env Envelope
+	var hello SessionHello
+	if err := ws.ReadJSON(&env); err != nil || env.Type != SessionMessageType {
+		t.Fatalf("Expected session frame, got %+v, %v", env, err)
+	}
+	json.Unmarshal(env.Payload, &hello)
+	return ws, hello
+}
+
+// readMessages reads n text messages.
+func readMessages(t *testing.T, ws *websocket.Conn, n int) []string {
+	t.Helper()
+	var messages []string
+	for range n {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		messages = append(messages, string(data))
+	}
+	return messages
+}
+
+// waitDetached waits until the session has no connection.
+func waitDetached(t *testing.T, s *Session) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		detached := s.conn == nil
+		s.mu.Unlock()
+		if detached {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("Session still attached")
+}
+
+// TestSessionResume tests that a reconnecting client gets the messages it missed, including
+// those sent while it was away, before live messages.
+func TestSessionResume(t *testing.T) {
+	user := uuid.New().String()
+	store := NewSessionStore(nil)
+	url := newSessionServer(t, store)
+
+	ws, hello := dialSession(t, url, user, "", 0)
+	if hello.Resumed || hello.Seq != 0 || hello.SessionID == "" {
+		t.Fatalf("Unexpected hello %+v", hello)
+	}
+	session, ok := store.Get(hello.SessionID)
+	if !ok {
+		t.Fatal("Session not stored")
+	}
+	for _, msg := range []string{"a", "b"} {
+		session.Send(websocket.TextMessage, []byte(msg))
+	}
+	readMessages(t, ws, 2)
+	ws.Close()
+	waitDetached(t, session)
+	session.Send(websocket.TextMessage, []byte("c"))
+
+	// The client only processed "a" before losing the connection
+	ws, hello = dialSession(t, url, user, hello.SessionID, 1)
+	if !hello.Resumed || hello.Seq != 1 || hello.SessionID != session.ID() {
+		t.Fatalf("Unexpected hello %+v", hello)
+	}
+	session.Send(websocket.TextMessage, []byte("d"))
+	messages := readMessages(t, ws, 3)
+	if strings.Join(messages, ",") != "b,c,d" {
+		t.Errorf("Expected b,c,d, got %v", messages)
+	}
+	if session.Seq() != 4 {
+		t.Errorf("Expected seq 4, got %d", session.Seq())
+	}
+}
+
+// TestSessionResumeRejected tests that sessions which cannot be resumed are replaced by new ones.
+func TestSessionResumeRejected(t *testing.T) {
+	owner := uuid.New().String()
+	store := NewSessionStore(&SessionConfig{ReplaySize: 2})
+	url := newSessionServer(t, store)
+
+	ws, hello := dialSession(t, url, owner, "", 0)
+	session, _ := store.Get(hello.SessionID)
+	for i := range 4 {
+		session.Send(websocket.TextMessage, []byte(fmt.Sprint(i)))
+	}
+	readMessages(t, ws, 4)
+	ws.Close()
+	waitDetached(t, session)
+
+	ws, anonymous := dialSession(t, url, "", "", 0)
+	ws.Close()
+
+	tests := []struct {
+		name      string
+		user      string
+		sessionID string
+		lastSeq   uint64
+		resumed   bool
+	}{
+		{name: "Unknown session", user: owner, sessionID: uuid.New().String(), lastSeq: 4},
+		{name: "Other user", user: uuid.New().String(), sessionID: hello.SessionID, lastSeq: 4},
+		{name: "Anonymous", sessionID: hello.SessionID, lastSeq: 4},
+		{name: "Anonymous session", sessionID: anonymous.SessionID, lastSeq: 0},
+		{name: "Sequence ahead", user: owner, sessionID: hello.SessionID, lastSeq: 5},
+		{name: "Replay buffer exceeded", user: owner, sessionID: hello.SessionID, lastSeq: 1},
+		{name: "Resumed", user: owner, sessionID: hello.SessionID, lastSeq: 2, resumed: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ws, got := dialSession(t, url, tc.user, tc.sessionID, tc.lastSeq)
+			defer ws.Close()
+			if got.Resumed != tc.resumed {
+				t.Errorf("Expected resumed %v, got %+v", tc.resumed, got)
+			}
+			if !tc.resumed && (got.SessionID == tc.sessionID || got.Seq != 0) {
+				t.Errorf("Expected a new session, got %+v", got)
+			}
+			if tc.resumed {
+				if messages := readMessages(t, ws, 2); strings.Join(messages, ",") != "2,3" {
+					t.Errorf("Expected 2,3, got %v", messages)
+				}
+			}
+		})
+	}
+}
+
+// TestSessionExpiry tests that a detached session is removed after its TTL.
+func TestSessionExpiry(t *testing.T) {
+	store := NewSessionStore(&SessionConfig{TTL: 10 * time.Millisecond})
+	url := newSessionServer(t, store)
+
+	ws, hello := dialSession(t, url, uuid.New().String(), "", 0)
+	ws.Close()
+	deadline := time.Now().Add(time.Second)
+	for store.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if _, ok := store.Get(hello.SessionID); ok {
+		t.Error("Expected the session to expire")
+	}
+}
+
+// TestSessionAnonymous tests that sessions which cannot be resumed are neither stored nor
+// buffer messages.
+func TestSessionAnonymous(t *testing.T) {
+	store := NewSessionStore(nil)
+	url := newSessionServer(t, store)
+
+	ws, hello := dialSession(t, url, "", "", 0)
+	if hello.SessionID == "" || hello.Resumed {
+		t.Errorf("Unexpected hello %+v", hello)
+	}
+	if store.Len() != 0 {
+		t.Errorf("Expected no stored session, got %d", store.Len())
+	}
+	ws.Close()
+
+	s := &Session{store: store}
+	s.Send(websocket.TextMessage, []byte("lost"))
+	if s.Seq() != 1 || len(s.replay) != 0 {
+		t.Errorf("Expected seq 1 and nothing buffered, got %d and %d", s.Seq(), len(s.replay))
+	}
+}
+
+// TestSessionAuth tests that sessions are only resumed after WebSocketAuth accepted the token of
+// their owner, and that the session frame uses the negotiated codec.
+func TestSessionAuth(t *testing.T) {
+	secret := []byte("test-secret")
+	owner := uuid.New()
+	_, token, _ := auth.GenerateJWT(secret, owner, nil)
+	store := NewSessionStore(nil)
+	server := httptest.NewServer(WebSocketUpgradeWithConfig(&WebSocketConfig{
+		CORS:   &CORSConfig{AllowOrigin: "*"},
+		Codecs: []Codec{MsgpackCodec},
+	}, WebSocketAuth(secret, store.Handler(func(conn *WebSocketConn, r *http.Request) {
+		<-conn.Context().Done()
+	}))))
+	defer server.Close()
+	dial := func(query string) (*websocket.Conn, *Envelope, error) {
+		dialer := websocket.Dialer{Subprotocols: []string{MsgpackCodec.Name()}}
+		ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?"+query, nil)
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		t.Cleanup(func() { ws.Close() })
+		messageType, data, err := ws.ReadMessage()
+		if err != nil {
+			return ws, nil, err
+		}
+		if messageType != websocket.BinaryMessage {
+			t.Errorf("Expected a binary session frame, got type %d", messageType)
+		}
+		env, err := MsgpackCodec.DecodeEnvelope(data)
+		return ws, env, err
+	}
+
+	ws, env, err := dial("token=" + token)
+	var hello SessionHello
+	if err != nil || env.Type != SessionMessageType || MsgpackCodec.Unmarshal(env.Payload, &hello) != nil {
+		t.Fatalf("Expected a MessagePack session frame, got %+v (%v)", env, err)
+	}
+	session, _ := store.Get(hello.SessionID)
+	session.Send(websocket.TextMessage, []byte("secret"))
+	readMessages(t, ws, 1)
+	ws.Close()
+	waitDetached(t, session)
+	session.Send(websocket.TextMessage, []byte("missed"))
+
+	resume := fmt.Sprintf("&%s=%s&%s=0", SessionIDParam, hello.SessionID, LastSeqParam)
+	_, _, err = dial("token=invalid-token" + resume)
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("Expected the connection to be closed before the session frame, got %v", err)
+	}
+	ws, env, err = dial("token=" + token + resume)
+	if err != nil || MsgpackCodec.Unmarshal(env.Payload, &hello) != nil || !hello.Resumed {
+		t.Fatalf("Expected the session to be resumed, got %+v (%v)", hello, err)
+	}
+	if messages := readMessages(t, ws, 2); strings.Join(messages, ",") != "secret,missed" {
+		t.Errorf("Expected secret,missed, got %v", messages)
+	}
+}